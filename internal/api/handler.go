@@ -1,6 +1,8 @@
 package api
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,13 +15,20 @@ import (
 	"gomodlag/internal/storage"
 	"gomodlag/pkg"
 	"gomodlag/support"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type AuthRegDelHandler struct {
 	auth.AuthRegDelLogic
+	Cache *cache.MemoryCache
 	logger.Logger
+	// SessionCookie выдавать токен ещё и в HttpOnly cookie при логине
+	SessionCookie bool
 }
 
 func (a *AuthRegDelHandler) RegisterHandler(c echo.Context, adminToken string) error {
@@ -28,7 +37,11 @@ func (a *AuthRegDelHandler) RegisterHandler(c echo.Context, adminToken string) e
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
-	if Data.AdminToken != adminToken {
+	// регистрация по общему ADMINTOKEN оставлена для совместимости; без него пользователей создает администратор
+	if adminToken == "" {
+		return norute(c, "registration disabled, ask an administrator")
+	}
+	if subtle.ConstantTimeCompare([]byte(Data.AdminToken), []byte(adminToken)) != 1 {
 		return BadReq(c, invalidToken)
 	}
 	if ok := pkg.Validator(Data.Login, Data.Password); !ok {
@@ -47,26 +60,175 @@ func (a *AuthRegDelHandler) RegisterHandler(c echo.Context, adminToken string) e
 	return Ok(c, resp{Login: login}, nil)
 }
 
-func (a *AuthRegDelHandler) AuthHandler(c echo.Context, Ttl time.Duration) error {
+func (a *AuthRegDelHandler) AuthHandler(c echo.Context, ttl auth.TokenTTL) error {
 	var Data auth.Login
 	err := c.Bind(&Data)
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
 
-	token, err := a.LogicLogin(c.Request().Context(), Data, Ttl)
+	meta := storage.SessionMeta{UserAgent: c.Request().UserAgent(), IP: c.RealIP()}
+	tokens, err := a.LogicLogin(c.Request().Context(), Data, ttl, meta)
 
 	if err != nil {
+		var retry *auth.RetryError
+		if errors.As(err, &retry) {
+			return lockedOut(c, retry)
+		}
 		if errors.Is(err, storage.Invaliddata) {
 			return BadReq(c, Invalid) /// 400
 		} else {
 			return somewrong(c) //// 500
 		}
 	}
-	type resp struct {
-		Token string `json:"token"`
+	if tokens.Challenge == "" {
+		a.setSessionCookie(c, tokens.AccessToken, ttl.Access)
+	}
+	return Ok(c, tokens, nil)
+}
+
+// lockedOut 423 для заблокированного логина, 429 для ip
+func lockedOut(c echo.Context, retry *auth.RetryError) error {
+	if errors.Is(retry, auth.Locked) {
+		return retryLater(c, http.StatusLocked, retry.Error(), retry.RetryAfter)
+	}
+	return retryLater(c, http.StatusTooManyRequests, retry.Error(), retry.RetryAfter)
+}
+
+// TwoFactorHandler второй шаг входа: challenge из AuthHandler и код 2fa меняются на пару токенов
+func (a *AuthRegDelHandler) TwoFactorHandler(c echo.Context, ttl auth.TokenTTL) error {
+	var Data auth.TwoFactorLogin
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	meta := storage.SessionMeta{UserAgent: c.Request().UserAgent(), IP: c.RealIP()}
+	tokens, err := a.LogicTwoFactor(c.Request().Context(), Data, ttl, meta)
+	if err != nil {
+		var retry *auth.RetryError
+		if errors.As(err, &retry) {
+			return lockedOut(c, retry)
+		}
+		if errors.Is(err, storage.Invalidtoken) {
+			return unauth(c)
+		}
+		return somewrong(c)
+	}
+	a.setSessionCookie(c, tokens.AccessToken, ttl.Access)
+	return Ok(c, tokens, nil)
+}
+
+// RefreshHandler выдает новую пару токенов по refresh токену, старый refresh токен больше не действует
+func (a *AuthRegDelHandler) RefreshHandler(c echo.Context, ttl auth.TokenTTL) error {
+	var Data auth.Refresh
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	tokens, err := a.LogicRefresh(c.Request().Context(), Data.RefreshToken, ttl)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.Invalidtoken), errors.Is(err, storage.TokenReused):
+			return unauth(c)
+		default:
+			return somewrong(c)
+		}
+	}
+	a.setSessionCookie(c, tokens.AccessToken, ttl.Access)
+	return Ok(c, tokens, nil)
+}
+
+// oidcStateCookie привязывает вход через OIDC к браузеру, который его начал
+const oidcStateCookie = "oidc_state"
+
+// OIDCLoginHandler отправляет пользователя к OIDC провайдеру
+func (a *AuthRegDelHandler) OIDCLoginHandler(c echo.Context) error {
+	url, state, err := a.OIDCStartLogic(c.Request().Context(), 0)
+	if err != nil {
+		if errors.Is(err, auth.OIDCDisabled) {
+			return notImpl(c)
+		}
+		return somewrong(c)
+	}
+	setOIDCState(c, state)
+	return c.Redirect(http.StatusFound, url)
+}
+
+// OIDCLinkHandler начинает привязку учетной записи провайдера к текущему пользователю. Возвращает адрес
+// провайдера, переходить по нему браузер должен сам: при переходе заголовок Authorization не отправится
+func (a *AuthRegDelHandler) OIDCLinkHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	url, state, err := a.OIDCStartLogic(c.Request().Context(), user.UserId)
+	if err != nil {
+		if errors.Is(err, auth.OIDCDisabled) {
+			return notImpl(c)
+		}
+		return somewrong(c)
 	}
-	return Ok(c, resp{Token: token}, nil)
+	setOIDCState(c, state)
+	return Ok(c, map[string]string{"url": url}, nil)
+}
+
+func setOIDCState(c echo.Context, state string) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(auth.OIDCLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// провайдер возвращает пользователя переходом с другого сайта, Strict cookie бы не отправил
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// OIDCCallbackHandler возврат от провайдера с ?code=&state=, выдает пару токенов (или challenge 2fa) как обычный логин
+func (a *AuthRegDelHandler) OIDCCallbackHandler(c echo.Context, ttl auth.TokenTTL) error {
+	if errText := c.QueryParam("error"); errText != "" {
+		return BadReq(c, "oidc: "+errText)
+	}
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return BadReq(c, invalidToken)
+	}
+	c.SetCookie(&http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	meta := storage.SessionMeta{UserAgent: c.Request().UserAgent(), IP: c.RealIP()}
+	tokens, err := a.OIDCCallbackLogic(c.Request().Context(), c.QueryParam("code"), state, ttl, meta)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.OIDCDisabled):
+			return notImpl(c)
+		case errors.Is(err, storage.Invalidtoken):
+			return unauth(c)
+		case errors.Is(err, storage.Forbidden):
+			return norute(c, "no account for this identity")
+		default:
+			return somewrong(c)
+		}
+	}
+	if tokens.Challenge == "" {
+		a.setSessionCookie(c, tokens.AccessToken, ttl.Access)
+	}
+	return Ok(c, tokens, nil)
+}
+
+func (a *AuthRegDelHandler) setSessionCookie(c echo.Context, token string, ttl time.Duration) {
+	if !a.SessionCookie {
+		return
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/api",
+		Expires:  time.Now().Add(ttl),
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
 }
 
 func (a *AuthRegDelHandler) LogOutHandler(c echo.Context) error {
@@ -83,30 +245,404 @@ func (a *AuthRegDelHandler) LogOutHandler(c echo.Context) error {
 			return somewrong(c)
 		}
 	}
+	if cookie, err := c.Cookie(SessionCookie); err == nil && cookie.Value == token {
+		c.SetCookie(&http.Cookie{
+			Name:     SessionCookie,
+			Path:     "/api",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
 	type resp map[string]bool
 	return Ok(c, resp{token: true}, nil)
 }
 
+func (a *AuthRegDelHandler) ListSessionsHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	sessions, err := a.ListSessionsLogic(c.Request().Context(), user.UserId, user.Token)
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, map[string]any{
+		"sessions": sessions,
+	})
+}
+
+func (a *AuthRegDelHandler) DeleteSessionHandler(c echo.Context) error {
+	idSession, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	err = a.DeleteSessionByIdLogic(c.Request().Context(), userID, idSession)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "session not found")
+		}
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{c.Param("id"): true}, nil)
+}
+
+// LogoutAllHandler выход со всех устройств, включая текущее
+func (a *AuthRegDelHandler) LogoutAllHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	if err := a.LogoutAllLogic(c.Request().Context(), userID); err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{"all": true}, nil)
+}
+
+// ChangePasswordHandler смена пароля; остальные сессии пользователя завершаются
+func (a *AuthRegDelHandler) ChangePasswordHandler(c echo.Context) error {
+	var Data auth.ChangePassword
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	if !pkg.ValidatePassword(Data.NewPassword) {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	err := a.ChangePasswordLogic(c.Request().Context(), user.UserId, user.Token, c.RealIP(), Data)
+	if err != nil {
+		var retry *auth.RetryError
+		if errors.As(err, &retry) {
+			return lockedOut(c, retry)
+		}
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "wrong password")
+		}
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{"changed": true}, nil)
+}
+
+// EnrollTOTPHandler новый секрет 2fa и otpauth:// URI для QR-кода
+func (a *AuthRegDelHandler) EnrollTOTPHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	enrollment, err := a.EnrollTOTPLogic(c.Request().Context(), user.UserId)
+	if err != nil {
+		if errors.Is(err, storage.Forbidden) {
+			return BadReq(c, "2fa already enabled")
+		}
+		return somewrong(c)
+	}
+	return Ok(c, enrollment, nil)
+}
+
+// ConfirmTOTPHandler включает 2fa по коду из приложения и возвращает коды восстановления
+func (a *AuthRegDelHandler) ConfirmTOTPHandler(c echo.Context) error {
+	var Data auth.TOTPCode
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	codes, err := a.ConfirmTOTPLogic(c.Request().Context(), user.UserId, Data.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.Forbidden):
+			return BadReq(c, "2fa already enabled")
+		case errors.Is(err, storage.Invaliddata):
+			return BadReq(c, "2fa not enrolled")
+		case errors.Is(err, storage.Invalidtoken):
+			return BadReq(c, "invalid code")
+		default:
+			return somewrong(c)
+		}
+	}
+	return Ok(c, map[string]any{"recovery_codes": codes}, nil)
+}
+
+// ResetPasswordHandler новый пароль по токену сброса
+func (a *AuthRegDelHandler) ResetPasswordHandler(c echo.Context) error {
+	var Data auth.ResetPassword
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	if !pkg.ValidatePassword(Data.Password) {
+		return BadReq(c, Invalid)
+	}
+	if err := a.ResetPasswordLogic(c.Request().Context(), Data); err != nil {
+		if errors.Is(err, storage.Invalidtoken) {
+			return BadReq(c, invalidToken)
+		}
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{"reset": true}, nil)
+}
+
+// DeleteAccountHandler удаляет свой аккаунт вместе с документами и файлами
+func (a *AuthRegDelHandler) DeleteAccountHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	deleted, err := a.DeleteAccountLogic(c.Request().Context(), user.UserId)
+	if err != nil {
+		if errors.Is(err, storage.UnknownUser) {
+			return unauth(c)
+		}
+		return somewrong(c)
+	}
+	forgetDocks(a.Cache, deleted)
+	if a.SessionCookie {
+		c.SetCookie(&http.Cookie{
+			Name:     SessionCookie,
+			Path:     "/api",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return Ok(c, map[string]bool{"deleted": true}, nil)
+}
+
+type AdminHandler struct {
+	auth.AdminLogic
+	GC    *docks.BlobGC
+	Cache *cache.MemoryCache
+	logger.Logger
+}
+
+// forgetDocks убирает удаленные документы из кеша, иначе грантополучатели видели бы их до истечения TTL
+func forgetDocks(c *cache.MemoryCache, ids []uuid.UUID) {
+	if c == nil {
+		return
+	}
+	for _, id := range ids {
+		c.DeleteByPrefix(fmt.Sprintf(cache.DockPrefix, id.String()))
+	}
+}
+
+// adminError ответ на ошибку действия администратора
+func adminError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, storage.UnknownUser):
+		return BadReq(c, err.Error())
+	case errors.Is(err, storage.Forbidden):
+		return norute(c, "cannot apply to yourself")
+	default:
+		return somewrong(c)
+	}
+}
+
+func (a *AdminHandler) ListUsersHandler(c echo.Context) error {
+	users, err := a.ListUsersLogic(c.Request().Context())
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, map[string]any{
+		"users": users,
+	})
+}
+
+func (a *AdminHandler) CreateUserHandler(c echo.Context) error {
+	var Data auth.NewUser
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	if ok := pkg.Validator(Data.Login, Data.Password); !ok {
+		return BadReq(c, Invalid)
+	}
+	admin, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	user, err := a.CreateUserLogic(c.Request().Context(), admin.UserId, Data)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, Invalid)
+		}
+		return somewrong(c)
+	}
+	return Ok(c, user, nil)
+}
+
+// SetDisabledHandler блокирует (disabled=true) или разблокирует пользователя :login
+func (a *AdminHandler) SetDisabledHandler(c echo.Context, disabled bool) error {
+	admin, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	login := c.Param("login")
+	if err := a.SetDisabledLogic(c.Request().Context(), admin.UserId, login, disabled); err != nil {
+		return adminError(c, err)
+	}
+	return Ok(c, map[string]bool{"disabled": disabled}, nil)
+}
+
+func (a *AdminHandler) DeleteUserHandler(c echo.Context) error {
+	admin, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	login := c.Param("login")
+	deleted, err := a.DeleteUserLogic(c.Request().Context(), admin.UserId, login)
+	if err != nil {
+		return adminError(c, err)
+	}
+	forgetDocks(a.Cache, deleted)
+	return Ok(c, map[string]bool{login: true}, nil)
+}
+
+// ResetHandler выдает администратору одноразовый токен сброса пароля пользователя :login
+func (a *AdminHandler) ResetHandler(c echo.Context, ttl time.Duration) error {
+	admin, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	reset, err := a.IssueResetTokenLogic(c.Request().Context(), admin.UserId, c.Param("login"), ttl)
+	if err != nil {
+		return adminError(c, err)
+	}
+	return Ok(c, reset, nil)
+}
+
+// UnlockHandler снимает блокировку входа с пользователя :login
+func (a *AdminHandler) UnlockHandler(c echo.Context) error {
+	admin, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	login := c.Param("login")
+	unlocked, err := a.UnlockLogic(c.Request().Context(), admin.UserId, login)
+	if err != nil {
+		if errors.Is(err, storage.UnknownUser) {
+			return notFound(c, err.Error())
+		}
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{login: unlocked}, nil)
+}
+
+// AuditHandler последние действия администраторов (?limit=, по умолчанию 100)
+func (a *AdminHandler) AuditHandler(c echo.Context) error {
+	limit, _ := strconv.Atoi(c.QueryParam("limit"))
+	entries, err := a.ListAuditLogic(c.Request().Context(), limit)
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, map[string]any{
+		"audit": entries,
+	})
+}
+
+// OrphansHandler файлы в хранилище, на которые не ссылается ни один документ; ничего не удаляет
+func (a *AdminHandler) OrphansHandler(c echo.Context) error {
+	if a.GC == nil {
+		return notImpl(c)
+	}
+	report, err := a.GC.CollectOrphans(c.Request().Context(), true)
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, report)
+}
+
+type KeysHandler struct {
+	auth.APIKeyLogic
+	logger.Logger
+}
+
+// CreateKeyHandler выпускает API ключ; ключ возвращается только в этом ответе
+func (k *KeysHandler) CreateKeyHandler(c echo.Context) error {
+	var Data auth.NewAPIKey
+	if err := c.Bind(&Data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	key, err := k.CreateAPIKeyLogic(c.Request().Context(), user.UserId, Data)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, Invalid)
+		}
+		return somewrong(c)
+	}
+	return Ok(c, key, nil)
+}
+
+func (k *KeysHandler) ListKeysHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	keys, err := k.ListAPIKeysLogic(c.Request().Context(), user.UserId)
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, map[string]any{
+		"keys": keys,
+	})
+}
+
+// DeleteKeyHandler отзывает ключ :id; запросы с ним сразу перестают приниматься
+func (k *KeysHandler) DeleteKeyHandler(c echo.Context) error {
+	idKey, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	if err = k.DeleteAPIKeyLogic(c.Request().Context(), user.UserId, idKey); err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "key not found")
+		}
+		return somewrong(c)
+	}
+	return Ok(c, map[string]bool{c.Param("id"): true}, nil)
+}
+
 type DockHandler struct {
 	docks.DockLogic
 	Cache *cache.MemoryCache
 	logger.Logger
+	CacheFileMax int64
 }
 
-func (d *DockHandler) UploadDocHandler(c echo.Context, db storage.TokenValidator) error {
+func (d *DockHandler) UploadDocHandler(c echo.Context) error {
 	data, err := support.ParseUploadRequest(c)
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
-
-	id, err := db.ValidateToken(c.Request().Context(), data.Meta.Token)
-	if err != nil {
-		return BadReq(c, invalidToken)
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
 	}
 
-	data.Meta.OwnerId = id
+	data.Meta.OwnerId = user.UserId
 
 	if err := d.AddNewLogic(c.Request().Context(), data); err != nil {
+		if errors.Is(err, storage.UnknownUser) {
+			return BadReq(c, err.Error())
+		}
 		return somewrong(c)
 	}
 	resp := map[string]any{
@@ -129,10 +665,11 @@ func (d *DockHandler) ListDocsHandler(c echo.Context) error {
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
-	userID, o := c.Get("userid").(int)
+	user, o := currentUser(c)
 	if !o {
 		return BadReq(c, "invalid user context")
 	}
+	userID := user.UserId
 	FilterData.Id = userID
 	if FilterData.Limit == 0 {
 		FilterData.Limit = 50
@@ -159,23 +696,30 @@ func (d *DockHandler) ListDocsHandler(c echo.Context) error {
 	})
 }
 
+// GetDocHandler отдает документ; HEAD идет тем же путем, что и GET
 func (d *DockHandler) GetDocHandler(c echo.Context) error {
-	if c.Request().Method == http.MethodHead {
-		return c.NoContent(http.StatusOK)
-	}
 	id := c.Param("id")
 	dockId, err := uuid.Parse(id)
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
-	userID, o := c.Get("userid").(int)
+	user, o := currentUser(c)
 	if !o {
 		return BadReq(c, "invalid user context")
 	}
+	userID := user.UserId
+	data := docks.DockById{
+		IdUser: userID, IdDock: dockId,
+	}
+	// доступ проверяется всегда: кеш экономит только чтение документа, иначе отозванный грант
+	// продолжал бы работать до истечения записи
+	if err := d.Authorize(c.Request().Context(), data, docks.PermRead); err != nil {
+		return denied(c, err)
+	}
 	cacheKey := fmt.Sprintf(cache.Key, dockId.String(), userID)
 	///file
-	if docData, mimeType, found := d.Cache.GetFile(cacheKey); found {
-		return c.Blob(http.StatusOK, mimeType, docData)
+	if item, found := d.Cache.GetFile(cacheKey); found {
+		return serveContent(c, item.Mime, item.ETag, item.ModTime, bytes.NewReader(item.Data))
 	}
 	///json
 	var cachedJson json.RawMessage
@@ -184,10 +728,27 @@ func (d *DockHandler) GetDocHandler(c echo.Context) error {
 		return Ok(c, nil, resp)
 	}
 
-	data := docks.DockById{
-		IdUser: userID, IdDock: dockId,
+	doc, err := d.GetDockByIdLogic(c.Request().Context(), data)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "document not found")
+		}
+		return somewrong(c)
 	}
+	return d.sendDoc(c, doc, cacheKey)
+}
 
+// PublicDocHandler отдает публичный документ без авторизации
+func (d *DockHandler) PublicDocHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	// анонимный пользователь имеет id 0 и видит только публичные документы
+	data := docks.DockById{IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), data, docks.PermRead); err != nil {
+		return denied(c, err)
+	}
 	doc, err := d.GetDockByIdLogic(c.Request().Context(), data)
 	if err != nil {
 		if errors.Is(err, storage.Invaliddata) {
@@ -195,16 +756,33 @@ func (d *DockHandler) GetDocHandler(c echo.Context) error {
 		}
 		return somewrong(c)
 	}
+	return d.sendDoc(c, doc, fmt.Sprintf(cache.Key, dockId.String(), 0))
+}
+
+// sendDoc отдает файл потоком или json документа; пустой cacheKey - без кеширования
+func (d *DockHandler) sendDoc(c echo.Context, doc storage.DocumentWithGrants, cacheKey string) error {
 	if doc.IsFile {
-		if doc.File == nil {
+		file, info, err := d.OpenDockFile(c.Request().Context(), doc)
+		if err != nil {
 			return somewrong(c)
 		}
-		d.Cache.SetFile(cacheKey, doc.File, doc.Mime)
-		return c.Blob(http.StatusOK, doc.Mime, doc.File)
+		defer file.Close()
+		// ключ файла в хранилище уникален для каждой загрузки, поэтому годится как ETag
+		etag := fmt.Sprintf("%q", doc.Filepath)
+		if cacheKey == "" || info.Size > d.CacheFileMax {
+			return serveContent(c, doc.Mime, etag, info.ModTime, file)
+		}
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return somewrong(c)
+		}
+		d.Cache.SetFile(cacheKey, content, doc.Mime, etag, info.ModTime)
+		return serveContent(c, doc.Mime, etag, info.ModTime, bytes.NewReader(content))
 	}
-	err = d.Cache.SetJSON(cacheKey, doc.Json)
-	if err != nil {
-		d.Logger.Info("failed cache set", err)
+	if cacheKey != "" {
+		if err := d.Cache.SetJSON(cacheKey, doc.Json); err != nil {
+			d.Logger.Info("failed cache set", slog.String("error", err.Error()))
+		}
 	}
 	resp := map[string]any{
 		"data": doc.Json,
@@ -218,18 +796,352 @@ func (d *DockHandler) DeleteDocHandler(c echo.Context) error {
 	if err != nil {
 		return BadReq(c, Invalid)
 	}
-	userID := c.Get("userid").(int)
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
 	data := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), data, docks.PermDelete); err != nil {
+		return denied(c, err)
+	}
 
 	err = d.DeleteDockLogic(c.Request().Context(), data)
 	if err != nil {
-		if errors.Is(err, storage.Forbidden) {
-			return norute(c, "you cannot delete this document")
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "document not found")
 		}
 		return somewrong(c)
 	}
-	cacheKey := fmt.Sprintf(cache.Key, dockId.String(), userID)
-	d.Cache.Delete(cacheKey)
+	d.Cache.DeleteByPrefix(fmt.Sprintf(cache.DockPrefix, dockId.String()))
 
 	return Ok(c, map[string]bool{id: true}, nil)
 }
+
+func (d *DockHandler) ReplaceDocHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	data, err := support.ParseUploadRequest(c)
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermWrite); err != nil {
+		return denied(c, err)
+	}
+
+	err = d.ReplaceDockLogic(c.Request().Context(), id, data)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.Forbidden):
+			return norute(c, "only owner can change public")
+		case errors.Is(err, storage.Invaliddata):
+			return BadReq(c, Invalid)
+		default:
+			return somewrong(c)
+		}
+	}
+	d.Cache.DeleteByPrefix(fmt.Sprintf(cache.DockPrefix, dockId.String()))
+
+	return Ok(c, map[string]bool{dockId.String(): true}, nil)
+}
+
+func (d *DockHandler) PatchDocHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermWrite); err != nil {
+		return denied(c, err)
+	}
+	contentType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if contentType != docks.MergePatch && contentType != docks.JsonPatch {
+		return unsupported(c)
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+
+	patch := docks.DockPatch{Type: contentType, Body: body}
+	doc, err := d.PatchDockLogic(c.Request().Context(), id, patch)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.Invaliddata):
+			return BadReq(c, "document not found")
+		case errors.Is(err, storage.NotJson):
+			return BadReq(c, "document is a file")
+		case errors.Is(err, storage.InvalidPatch):
+			return BadReq(c, "invalid patch")
+		default:
+			return somewrong(c)
+		}
+	}
+	d.Cache.DeleteByPrefix(fmt.Sprintf(cache.DockPrefix, dockId.String()))
+
+	return Ok(c, nil, map[string]any{"data": doc})
+}
+
+func (d *DockHandler) ListVersionsHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermRead); err != nil {
+		return denied(c, err)
+	}
+	versions, err := d.ListVersionsLogic(c.Request().Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "document not found")
+		}
+		return somewrong(c)
+	}
+	respVersions := make([]map[string]any, 0, len(versions))
+	for _, v := range versions {
+		respVersions = append(respVersions, map[string]any{
+			"version": v.Version,
+			"author":  v.Author,
+			"hash":    v.ContentHash,
+			"name":    v.Name,
+			"mime":    v.Mime,
+			"file":    v.IsFile,
+			"public":  v.Public,
+			"created": v.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return Ok(c, nil, map[string]any{
+		"versions": respVersions,
+	})
+}
+
+func (d *DockHandler) GetVersionHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	version, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermRead); err != nil {
+		return denied(c, err)
+	}
+	v, err := d.GetVersionLogic(c.Request().Context(), id, version)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "version not found")
+		}
+		return somewrong(c)
+	}
+	return d.sendDoc(c, v.DocumentWithGrants, "")
+}
+
+func (d *DockHandler) RestoreVersionHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	version, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermWrite); err != nil {
+		return denied(c, err)
+	}
+	restored, err := d.RestoreVersionLogic(c.Request().Context(), id, version)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "version not found")
+		}
+		return somewrong(c)
+	}
+	d.Cache.DeleteByPrefix(fmt.Sprintf(cache.DockPrefix, dockId.String()))
+
+	return Ok(c, map[string]int{"version": restored}, nil)
+}
+
+func (d *DockHandler) DiffVersionsHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	from, err := strconv.Atoi(c.QueryParam("from"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	to, err := strconv.Atoi(c.QueryParam("to"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermRead); err != nil {
+		return denied(c, err)
+	}
+	diff, err := d.DiffVersionsLogic(c.Request().Context(), id, from, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.Invaliddata):
+			return BadReq(c, "version not found")
+		case errors.Is(err, storage.NotJson):
+			return BadReq(c, "document is a file")
+		default:
+			return somewrong(c)
+		}
+	}
+	return Ok(c, nil, map[string]any{
+		"from": from,
+		"to":   to,
+		"diff": diff,
+	})
+}
+
+func (d *DockHandler) ListGrantsHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermManageGrants); err != nil {
+		return denied(c, err)
+	}
+	grants, err := d.ListGrantsLogic(c.Request().Context(), id)
+	if err != nil {
+		return somewrong(c)
+	}
+	return Ok(c, nil, map[string]any{
+		"grants": grants,
+	})
+}
+
+func (d *DockHandler) AddGrantsHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	var data struct {
+		Grant []string `json:"grant"`
+		Role  string   `json:"role"`
+	}
+	if err := c.Bind(&data); err != nil {
+		return BadReq(c, Invalid)
+	}
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+
+	role, ok := docks.ParseRole(data.Role)
+	if !ok {
+		return BadReq(c, "invalid role")
+	}
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermManageGrants); err != nil {
+		return denied(c, err)
+	}
+
+	err = d.AddGrantsLogic(c.Request().Context(), id, data.Grant, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.UnknownUser):
+			return BadReq(c, err.Error())
+		case errors.Is(err, storage.Invaliddata):
+			return BadReq(c, Invalid)
+		default:
+			return somewrong(c)
+		}
+	}
+	return Ok(c, map[string]any{"grant": data.Grant, "role": role}, nil)
+}
+
+func (d *DockHandler) RevokeGrantHandler(c echo.Context) error {
+	dockId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return BadReq(c, Invalid)
+	}
+	login := c.Param("login")
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	userID := user.UserId
+	id := docks.DockById{IdUser: userID, IdDock: dockId}
+	if err := d.Authorize(c.Request().Context(), id, docks.PermManageGrants); err != nil {
+		return denied(c, err)
+	}
+	revoked, err := d.RevokeGrantLogic(c.Request().Context(), id, login)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return BadReq(c, "grant not found")
+		}
+		return somewrong(c)
+	}
+	d.Cache.Delete(fmt.Sprintf(cache.Key, dockId.String(), revoked))
+
+	return Ok(c, map[string]bool{login: true}, nil)
+}
+
+// ExportHandler ZIP со всеми документами пользователя: файлы, json и manifest.json с метаданными
+func (d *DockHandler) ExportHandler(c echo.Context) error {
+	user, o := currentUser(c)
+	if !o {
+		return BadReq(c, "invalid user context")
+	}
+	docs, err := d.ExportDocksLogic(c.Request().Context(), user.UserId)
+	if err != nil {
+		return somewrong(c)
+	}
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "application/zip")
+	h.Set(echo.HeaderContentDisposition, `attachment; filename="export.zip"`)
+	c.Response().WriteHeader(http.StatusOK)
+	if err = d.WriteExport(c.Request().Context(), docs, c.Response()); err != nil {
+		// заголовки уже отправлены, клиент получит оборванный архив; недоступные файлы
+		// сюда не попадают - WriteExport пропускает их и отмечает в manifest.json
+		d.Logger.Error("WriteExport", slog.String("error", err.Error()))
+	}
+	return nil
+}
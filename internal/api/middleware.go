@@ -1,11 +1,19 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/labstack/echo/v4"
+	"gomodlag/internal/auth"
 	"gomodlag/internal/storage"
+	"io"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -34,32 +42,125 @@ func unauth(c echo.Context) error {
 func norute(c echo.Context, msg string) error {
 	return c.JSON(http.StatusForbidden, ApiResp{Error: &apiError{Code: 403, Text: msg}})
 }
+func notFound(c echo.Context, msg string) error {
+	return c.JSON(http.StatusNotFound, ApiResp{Error: &apiError{Code: 404, Text: msg}})
+}
 func notImpl(c echo.Context) error {
 	return c.JSON(http.StatusNotImplemented, ApiResp{Error: &apiError{Code: 501, Text: "not implemented"}})
 }
+
+// retryLater ответ 423/429 с Retry-After в секундах
+func retryLater(c echo.Context, status int, msg string, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return c.JSON(status, ApiResp{Error: &apiError{Code: status, Text: msg}})
+}
+
+// denied ответ на ошибку docks.Authorize
+func denied(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, storage.Invaliddata):
+		return BadReq(c, "document not found")
+	case errors.Is(err, storage.Forbidden):
+		return norute(c, "access denied")
+	default:
+		return somewrong(c)
+	}
+}
+func unsupported(c echo.Context) error {
+	return c.JSON(http.StatusUnsupportedMediaType, ApiResp{Error: &apiError{Code: 415, Text: "unsupported media type"}})
+}
 func somewrong(c echo.Context) error {
 	return c.JSON(http.StatusNotImplemented, ApiResp{Error: &apiError{Code: 500, Text: "something went wrong"}})
 }
 
-func AuthTokenRequired(db storage.TokenValidator) echo.MiddlewareFunc {
+// serveContent отдает содержимое с поддержкой Range/If-Range (206 Partial Content)
+func serveContent(c echo.Context, mime, etag string, modTime time.Time, content io.ReadSeeker) error {
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, mime)
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	http.ServeContent(c.Response(), c.Request(), "", modTime, content)
+	return nil
+}
+
+// SessionCookie имя HttpOnly cookie с токеном сессии
+const SessionCookie = "session"
+
+// tokenFromRequest ищет токен по порядку: Authorization: Bearer, cookie сессии,
+// параметр token в query и (для совместимости) поле token в теле запроса
+func tokenFromRequest(c echo.Context) string {
+	if h := c.Request().Header.Get(echo.HeaderAuthorization); h != "" {
+		scheme, token, found := strings.Cut(h, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if cookie, err := c.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	if token := c.QueryParam("token"); token != "" {
+		return token
+	}
+	return tokenFromBody(c)
+}
+
+// tokenFromBody читает token из json или multipart тела, не забирая тело у обработчика
+func tokenFromBody(c echo.Context) string {
+	req := c.Request()
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	var body struct {
+		Token string `json:"token"`
+	}
+	switch contentType {
+	case echo.MIMEApplicationJSON:
+		if req.Body == nil {
+			return ""
+		}
+		raw, err := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(raw))
+		if err != nil || json.Unmarshal(raw, &body) != nil {
+			return ""
+		}
+	case echo.MIMEMultipartForm, echo.MIMEApplicationForm:
+		if token := c.FormValue("token"); token != "" {
+			return token
+		}
+		// при загрузке документа токен лежит в meta
+		if json.Unmarshal([]byte(c.FormValue("meta")), &body) != nil {
+			return ""
+		}
+	}
+	return body.Token
+}
+
+// currentUser пользователь, которого положил AuthTokenRequired
+func currentUser(c echo.Context) (auth.Identity, bool) {
+	return auth.IdentityFrom(c.Request().Context())
+}
+
+// AuthTokenRequired принимает access токен сессии или API ключ (keys; nil - ключи не принимаются)
+func AuthTokenRequired(db storage.TokenValidator, keys auth.APIKeyValidator) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			var body map[string]interface{}
-			if err := c.Bind(&body); err != nil {
-				return BadReq(c, Invalid)
-			}
-			tokenRaw, ok := body["token"]
-			if !ok {
-				return unauth(c)
-			}
-
-			tokenStr, ok := tokenRaw.(string)
-			if !ok || tokenStr == "" {
+			tokenStr := tokenFromRequest(c)
+			if tokenStr == "" {
 				return unauth(c)
 			}
 			ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*2)
 			defer cancel()
-			userid, err := db.ValidateToken(ctx, tokenStr)
+			var identity auth.Identity
+			var err error
+			if auth.IsAPIKey(tokenStr) {
+				if keys == nil {
+					return BadReq(c, invalidToken)
+				}
+				identity, err = keys.ValidateAPIKey(ctx, tokenStr)
+			} else {
+				identity.Token = tokenStr
+				identity.UserId, err = db.ValidateToken(ctx, tokenStr)
+			}
 			if err != nil {
 				cancel()
 				if errors.Is(err, storage.Invalidtoken) {
@@ -68,12 +169,68 @@ func AuthTokenRequired(db storage.TokenValidator) echo.MiddlewareFunc {
 					return somewrong(c)
 				}
 			}
-			c.Set("userid", userid)
+			c.SetRequest(c.Request().WithContext(auth.WithIdentity(c.Request().Context(), identity)))
+			return next(c)
+
+		}
+	}
+}
+
+// AdminRequired пускает только администраторов; ставится после AuthTokenRequired
+func AdminRequired(db storage.UserGetter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := currentUser(c)
+			if !ok {
+				return unauth(c)
+			}
+			user, err := db.GetUser(c.Request().Context(), identity.UserId)
+			if err != nil {
+				if errors.Is(err, storage.UnknownUser) {
+					return unauth(c)
+				}
+				return somewrong(c)
+			}
+			if user.Role != storage.RoleAdmin || user.Disabled {
+				return norute(c, "admin only")
+			}
+			return next(c)
+		}
+	}
+}
+
+// ScopeRequired пропускает API ключ, только если у него есть область scope; сессиям можно все
+func ScopeRequired(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := currentUser(c)
+			if !ok {
+				return unauth(c)
+			}
+			if !identity.Allows(scope) {
+				return norute(c, "api key scope required: "+scope)
+			}
 			return next(c)
+		}
+	}
+}
 
+// SessionRequired не пускает API ключи: аккаунтом, сессиями и ключами управляют только после входа
+func SessionRequired() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := currentUser(c)
+			if !ok {
+				return unauth(c)
+			}
+			if identity.APIKey != 0 {
+				return norute(c, "session token required")
+			}
+			return next(c)
 		}
 	}
 }
+
 func AddContext(timectx time.Duration) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
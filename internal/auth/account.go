@@ -0,0 +1,19 @@
+package auth
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"log/slog"
+)
+
+// DeleteAccountLogic удаляет аккаунт пользователя: сессии, гранты и документы; файлы документов
+// удаляются из хранилища фоново через очередь. Возвращает id удаленных документов, чтобы их можно было убрать из кеша
+func (s *ServiceDB) DeleteAccountLogic(ctx context.Context, idUser int) ([]uuid.UUID, error) {
+	deleted, err := s.DeleteAccount(ctx, idUser)
+	if err != nil {
+		return nil, err
+	}
+	_ = s.SyncRevoked(ctx)
+	s.Logger.Info("account deleted", slog.Int("user", idUser), slog.Int("files", len(deleted.Files)))
+	return deleted.Documents, nil
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"log/slog"
+	"time"
+)
+
+var WeakBootstrapPassword = errors.New("ADMINPASSWORD does not meet password requirements")
+
+// Действия администраторов в журнале
+const (
+	AuditCreateUser    = "create_user"
+	AuditDisableUser   = "disable_user"
+	AuditEnableUser    = "enable_user"
+	AuditDeleteUser    = "delete_user"
+	AuditResetPassword = "reset_password"
+	AuditUnlockUser    = "unlock_user"
+)
+
+// NewUser пользователь, создаваемый администратором
+type NewUser struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// audit пишет действие администратора в журнал и в лог
+func (s *ServiceDB) audit(ctx context.Context, idAdmin int, action, target string) {
+	s.Logger.Info("admin action", slog.Int("admin", idAdmin), slog.String("action", action), slog.String("target", target))
+	if err := s.AddAudit(ctx, idAdmin, action, target); err != nil {
+		s.Logger.Error("AddAudit", slog.String("error", err.Error()))
+	}
+}
+
+// notSelf администратор не может заблокировать или удалить сам себя
+func (s *ServiceDB) notSelf(ctx context.Context, idAdmin int, login string) error {
+	if idAdmin == storage.SystemAdmin {
+		return nil
+	}
+	admin, err := s.GetUser(ctx, idAdmin)
+	if err != nil {
+		return err
+	}
+	if admin.Login == login {
+		return storage.Forbidden
+	}
+	return nil
+}
+
+func (s *ServiceDB) CreateUserLogic(ctx context.Context, idAdmin int, data NewUser) (storage.User, error) {
+	if data.Role == "" {
+		data.Role = storage.RoleUser
+	}
+	if data.Role != storage.RoleUser && data.Role != storage.RoleAdmin {
+		return storage.User{}, storage.Invaliddata
+	}
+	hash, err := s.Hasher.Hash(data.Password)
+	if err != nil {
+		return storage.User{}, storage.SomeWrong
+	}
+	user, err := s.CreateUser(ctx, data.Login, hash, data.Role)
+	if err != nil {
+		return storage.User{}, err
+	}
+	s.audit(ctx, idAdmin, AuditCreateUser, data.Login)
+	return user, nil
+}
+
+func (s *ServiceDB) ListUsersLogic(ctx context.Context) ([]storage.User, error) {
+	return s.ListUsers(ctx)
+}
+
+// SetDisabledLogic блокирует пользователя (все его сессии завершаются) или снимает блокировку
+func (s *ServiceDB) SetDisabledLogic(ctx context.Context, idAdmin int, login string, disabled bool) error {
+	if err := s.notSelf(ctx, idAdmin, login); err != nil {
+		return err
+	}
+	if err := s.SetUserDisabled(ctx, login, disabled); err != nil {
+		return err
+	}
+	action := AuditEnableUser
+	if disabled {
+		action = AuditDisableUser
+		_ = s.SyncRevoked(ctx)
+	}
+	s.audit(ctx, idAdmin, action, login)
+	return nil
+}
+
+// DeleteUserLogic удаляет пользователя с документами; возвращает id удаленных документов
+func (s *ServiceDB) DeleteUserLogic(ctx context.Context, idAdmin int, login string) ([]uuid.UUID, error) {
+	if err := s.notSelf(ctx, idAdmin, login); err != nil {
+		return nil, err
+	}
+	deleted, err := s.DeleteUser(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	_ = s.SyncRevoked(ctx)
+	s.audit(ctx, idAdmin, AuditDeleteUser, login)
+	return deleted.Documents, nil
+}
+
+// IssueResetTokenLogic выдает одноразовый токен сброса пароля; в базе хранится только его хеш
+func (s *ServiceDB) IssueResetTokenLogic(ctx context.Context, idAdmin int, login string, ttl time.Duration) (ResetToken, error) {
+	reset, err := s.issueResetToken(ctx, login, ttl)
+	if err != nil {
+		return ResetToken{}, err
+	}
+	s.audit(ctx, idAdmin, AuditResetPassword, login)
+	return reset, nil
+}
+
+// UnlockLogic снимает блокировку входа с логина и обнуляет счетчик неудач; в журнал попадает,
+// только если логин действительно был заблокирован. Возвращает, была ли блокировка
+func (s *ServiceDB) UnlockLogic(ctx context.Context, idAdmin int, login string) (bool, error) {
+	if _, err := s.GetUserByLogin(ctx, login); err != nil {
+		return false, err
+	}
+	locks, err := s.GetLoginLocks(ctx, userSubject(login))
+	if err != nil {
+		return false, err
+	}
+	if err = s.ResetLoginFailures(ctx, userSubject(login)); err != nil {
+		return false, err
+	}
+	_, locked := locks[userSubject(login)]
+	if locked {
+		s.audit(ctx, idAdmin, AuditUnlockUser, login)
+	}
+	return locked, nil
+}
+
+func (s *ServiceDB) ListAuditLogic(ctx context.Context, limit int) ([]storage.AuditEntry, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	return s.ListAudit(ctx, limit)
+}
+
+// BootstrapAdmin создает первого администратора, если администраторов еще нет.
+// Пароль проверяется по тем же правилам, что при создании пользователя; слабый - администратор не создается
+func (s *ServiceDB) BootstrapAdmin(ctx context.Context, login, password string) (bool, error) {
+	exists, err := s.HasAdmin(ctx)
+	if err != nil || exists {
+		return false, err
+	}
+	if !pkg.ValidatePassword(password) {
+		return false, WeakBootstrapPassword
+	}
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return false, storage.SomeWrong
+	}
+	if _, err = s.CreateUser(ctx, login, hash, storage.RoleAdmin); err != nil {
+		return false, err
+	}
+	s.Logger.Info("bootstrap admin created", slog.String("login", login))
+	return true, nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"slices"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix начало каждого API ключа; по нему middleware отличает ключ от токена сессии
+const APIKeyPrefix = "dk_"
+
+// области API ключа; ключ без областей может все, что и эти три
+const (
+	ScopeDocsRead     = "docs:read"
+	ScopeDocsWrite    = "docs:write"
+	ScopeGrantsManage = "grants:manage"
+)
+
+var apiKeyScopes = []string{ScopeDocsRead, ScopeDocsWrite, ScopeGrantsManage}
+
+// apiKeyShown сколько символов ключа хранится открыто, чтобы его можно было узнать в списке
+const apiKeyShown = len(APIKeyPrefix) + 6
+
+// NewAPIKey запрос на выпуск ключа; ExpiresIn в секундах, 0 - бессрочный
+type NewAPIKey struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"`
+}
+
+// CreatedAPIKey выпущенный ключ; Key показывается только один раз
+type CreatedAPIKey struct {
+	Key string `json:"key"`
+	storage.APIKey
+}
+
+type APIKeyLogic interface {
+	CreateAPIKeyLogic(ctx context.Context, idUser int, data NewAPIKey) (CreatedAPIKey, error)
+	ListAPIKeysLogic(ctx context.Context, idUser int) ([]storage.APIKey, error)
+	DeleteAPIKeyLogic(ctx context.Context, idUser int, idKey int) error
+}
+
+// APIKeyValidator проверка API ключа для AuthTokenRequired
+type APIKeyValidator interface {
+	ValidateAPIKey(ctx context.Context, key string) (Identity, error)
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func (s *ServiceDB) CreateAPIKeyLogic(ctx context.Context, idUser int, data NewAPIKey) (CreatedAPIKey, error) {
+	name := strings.TrimSpace(data.Name)
+	if name == "" || len(name) > 100 || data.ExpiresIn < 0 {
+		return CreatedAPIKey{}, storage.Invaliddata
+	}
+	scopes := []string{}
+	for _, scope := range data.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return CreatedAPIKey{}, storage.Invaliddata
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	key := APIKeyPrefix + pkg.GenerateSecret()
+	now := time.Now()
+	apiKey := storage.APIKey{Name: name, Prefix: key[:apiKeyShown], Scopes: scopes, CreatedAt: now}
+	if data.ExpiresIn > 0 {
+		expire := now.Add(time.Duration(data.ExpiresIn) * time.Second)
+		apiKey.ExpireAt = &expire
+	}
+	apiKey, err := s.CreateAPIKey(ctx, idUser, pkg.HashContent([]byte(key)), apiKey)
+	if err != nil {
+		return CreatedAPIKey{}, err
+	}
+	return CreatedAPIKey{Key: key, APIKey: apiKey}, nil
+}
+
+func (s *ServiceDB) ListAPIKeysLogic(ctx context.Context, idUser int) ([]storage.APIKey, error) {
+	return s.ListAPIKeys(ctx, idUser)
+}
+
+func (s *ServiceDB) DeleteAPIKeyLogic(ctx context.Context, idUser int, idKey int) error {
+	return s.DeleteAPIKey(ctx, idUser, idKey)
+}
+
+// ValidateAPIKey ищет ключ по хешу и отмечает его использование; истекшие ключи и ключи
+// заблокированных пользователей не принимаются
+func (s *ServiceDB) ValidateAPIKey(ctx context.Context, key string) (Identity, error) {
+	if !IsAPIKey(key) {
+		return Identity{}, storage.Invalidtoken
+	}
+	apiKey, err := s.UseAPIKey(ctx, pkg.HashContent([]byte(key)))
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{UserId: apiKey.UserId, Token: key, APIKey: apiKey.Id, Scopes: apiKey.Scopes}, nil
+}
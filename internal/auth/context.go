@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+	"slices"
+)
+
+// Identity пользователь, от имени которого выполняется запрос.
+// Для запроса по API ключу APIKey - id ключа, Scopes - его области (пусто - все)
+type Identity struct {
+	UserId int
+	Token  string
+	APIKey int
+	Scopes []string
+}
+
+// Allows можно ли выполнить действие из области scope; сессии пользователя можно все
+func (i Identity) Allows(scope string) bool {
+	return i.APIKey == 0 || len(i.Scopes) == 0 || slices.Contains(i.Scopes, scope)
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
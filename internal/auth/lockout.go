@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var Locked = errors.New("account locked")
+var TooManyAttempts = errors.New("too many login attempts")
+
+// RetryError вход временно запрещен; Err - Locked (логин) или TooManyAttempts (ip)
+type RetryError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// LoginLimits защита от подбора пароля. После UserAttempts неудач подряд по логину (IPAttempts по ip)
+// вход блокируется на LockBase, каждая следующая неудача удваивает блокировку до LockMax.
+// Нулевое число попыток отключает соответствующую проверку
+type LoginLimits struct {
+	UserAttempts int
+	IPAttempts   int
+	LockBase     time.Duration
+	LockMax      time.Duration
+	// Window счетчик неудач без новых попыток дольше Window обнуляется
+	Window time.Duration
+}
+
+// LockDuration на сколько блокировать вход после failures неудач подряд при пороге attempts
+func (l LoginLimits) LockDuration(failures, attempts int) time.Duration {
+	if attempts == 0 || failures < attempts {
+		return 0
+	}
+	lock := l.LockBase
+	for i := attempts; i < failures && lock < l.LockMax; i++ {
+		lock *= 2
+	}
+	return min(lock, l.LockMax)
+}
+
+func userSubject(login string) string {
+	return "user:" + login
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// checkLockout не пускает к проверке пароля, пока логин или ip заблокированы
+func (s *ServiceDB) checkLockout(ctx context.Context, login, ip string) error {
+	if s.Limits.UserAttempts == 0 && s.Limits.IPAttempts == 0 {
+		return nil
+	}
+	locks, err := s.GetLoginLocks(ctx, userSubject(login), ipSubject(ip))
+	if err != nil {
+		return err
+	}
+	if until, ok := locks[userSubject(login)]; ok {
+		return &RetryError{Err: Locked, RetryAfter: time.Until(until)}
+	}
+	if until, ok := locks[ipSubject(ip)]; ok {
+		return &RetryError{Err: TooManyAttempts, RetryAfter: time.Until(until)}
+	}
+	return nil
+}
+
+// loginFailed учитывает неудачный вход и блокирует логин или ip при превышении порога
+func (s *ServiceDB) loginFailed(ctx context.Context, login, ip string) {
+	for _, v := range []struct {
+		subject  string
+		attempts int
+	}{
+		{userSubject(login), s.Limits.UserAttempts},
+		{ipSubject(ip), s.Limits.IPAttempts},
+	} {
+		if v.attempts == 0 {
+			continue
+		}
+		failures, err := s.AddLoginFailure(ctx, v.subject, s.Limits.Window)
+		if err != nil {
+			s.Logger.Error("AddLoginFailure", slog.String("error", err.Error()))
+			continue
+		}
+		if lock := s.Limits.LockDuration(failures, v.attempts); lock > 0 {
+			if err = s.LockLogin(ctx, v.subject, time.Now().Add(lock)); err != nil {
+				s.Logger.Error("LockLogin", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// loginSucceeded обнуляет счетчик неудач логина после полного входа
+func (s *ServiceDB) loginSucceeded(ctx context.Context, login string) {
+	if s.Limits.UserAttempts > 0 {
+		_ = s.ResetLoginFailures(ctx, userSubject(login))
+	}
+}
@@ -2,8 +2,10 @@ package auth
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"gomodlag/internal/logger"
 	"gomodlag/internal/storage"
+	"gomodlag/pkg"
 	"time"
 )
 
@@ -17,14 +19,83 @@ type Login struct {
 	Password string `json:"password"`
 }
 
+// TokenTTL время жизни access и refresh токенов
+type TokenTTL struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+// Tokens пара токенов, выдаваемая при логине и обновлении.
+// Если у пользователя включена 2fa, логин вместо пары возвращает Challenge для LogicTwoFactor
+type Tokens struct {
+	AccessToken  string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Challenge    string `json:"challenge,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// ChangePassword смена пароля пользователем
+type ChangePassword struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ResetPassword новый пароль по токену сброса от администратора
+type ResetPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetToken одноразовый токен сброса пароля
+type ResetToken struct {
+	Token    string    `json:"reset_token"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+type Refresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type ServiceDB struct {
 	storage.AuthRegDelModel
+	storage.AdminModel
+	storage.APIKeyModel
+	storage.OIDCModel
 	logger.Logger
-	storage.TokenValidator
+	AccessTokens
+	Hasher pkg.PasswordHasher
+	Limits LoginLimits
+	// TOTPIssuer имя сервиса в приложении-аутентификаторе
+	TOTPIssuer string
+	// OIDC вход через провайдера; nil - выключен
+	OIDC *OIDCProvider
 }
 
 type AuthRegDelLogic interface {
 	DeleteSession(ctx context.Context, token string) error
-	LogicLogin(ctx context.Context, data Login, ttl time.Duration) (string, error)
+	LogicLogin(ctx context.Context, data Login, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error)
+	LogicRefresh(ctx context.Context, refreshToken string, ttl TokenTTL) (Tokens, error)
 	LogicRegister(ctx context.Context, data Register) (string, error)
+	ListSessionsLogic(ctx context.Context, idUser int, currentToken string) ([]storage.Session, error)
+	DeleteSessionByIdLogic(ctx context.Context, idUser int, idSession int) error
+	LogoutAllLogic(ctx context.Context, idUser int) error
+	ChangePasswordLogic(ctx context.Context, idUser int, currentToken, ip string, data ChangePassword) error
+	ResetPasswordLogic(ctx context.Context, data ResetPassword) error
+	EnrollTOTPLogic(ctx context.Context, idUser int) (TOTPEnrollment, error)
+	ConfirmTOTPLogic(ctx context.Context, idUser int, code string) ([]string, error)
+	LogicTwoFactor(ctx context.Context, data TwoFactorLogin, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error)
+	OIDCStartLogic(ctx context.Context, linkUserId int) (string, string, error)
+	OIDCCallbackLogic(ctx context.Context, code, state string, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error)
+	DeleteAccountLogic(ctx context.Context, idUser int) ([]uuid.UUID, error)
+}
+
+// AdminLogic действия администраторов; idAdmin пишется в журнал
+type AdminLogic interface {
+	CreateUserLogic(ctx context.Context, idAdmin int, data NewUser) (storage.User, error)
+	ListUsersLogic(ctx context.Context) ([]storage.User, error)
+	SetDisabledLogic(ctx context.Context, idAdmin int, login string, disabled bool) error
+	DeleteUserLogic(ctx context.Context, idAdmin int, login string) ([]uuid.UUID, error)
+	IssueResetTokenLogic(ctx context.Context, idAdmin int, login string, ttl time.Duration) (ResetToken, error)
+	UnlockLogic(ctx context.Context, idAdmin int, login string) (bool, error)
+	ListAuditLogic(ctx context.Context, limit int) ([]storage.AuditEntry, error)
 }
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// OIDCLoginTTL сколько ждем возврата пользователя от провайдера
+const OIDCLoginTTL = 10 * time.Minute
+
+var OIDCDisabled = errors.New("oidc login is not configured")
+
+// OIDCProvider вход через OpenID Connect провайдера: authorization code + PKCE,
+// ID токен проверяется по ключам из JWKS провайдера
+type OIDCProvider struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// Provision создавать пользователя при первом входе; иначе входить могут только уже заведенные логины
+	Provision bool
+}
+
+// OIDCClaims кто вошел: пара issuer + subject постоянна, Username - логин для сопоставления с users
+type OIDCClaims struct {
+	Issuer   string
+	Subject  string
+	Username string
+}
+
+// NewOIDCProvider читает метаданные провайдера из issuer/.well-known/openid-configuration
+func NewOIDCProvider(ctx context.Context, issuer, clientId, clientSecret, redirectURL string, provision bool) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCProvider{
+		oauth: oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile"},
+		},
+		verifier:  provider.Verifier(&oidc.Config{ClientID: clientId}),
+		Provision: provision,
+	}, nil
+}
+
+// AuthURL адрес провайдера, на который отправляется пользователь
+func (p *OIDCProvider) AuthURL(state, nonce, verifier string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange меняет код на токены и проверяет ID токен: подпись, issuer, audience, срок и nonce
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (OIDCClaims, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return OIDCClaims{}, storage.Invalidtoken
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return OIDCClaims{}, storage.Invalidtoken
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return OIDCClaims{}, storage.Invalidtoken
+	}
+	var claims struct {
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err = idToken.Claims(&claims); err != nil {
+		return OIDCClaims{}, storage.Invalidtoken
+	}
+	return OIDCClaims{Issuer: idToken.Issuer, Subject: idToken.Subject, Username: strings.TrimSpace(claims.PreferredUsername)}, nil
+}
+
+// OIDCStartLogic начало входа: адрес провайдера и state. State, nonce и PKCE verifier
+// сохраняются (state - хешем) до возврата пользователя. linkUserId - пользователь, из сессии которого
+// начата привязка учетной записи провайдера; 0 - обычный вход
+func (s *ServiceDB) OIDCStartLogic(ctx context.Context, linkUserId int) (string, string, error) {
+	if s.OIDC == nil {
+		return "", "", OIDCDisabled
+	}
+	now := time.Now()
+	state := pkg.GenerateSecret()
+	login := storage.OIDCLogin{
+		Verifier:   oauth2.GenerateVerifier(),
+		Nonce:      pkg.GenerateSecret(),
+		CreatedAt:  now,
+		ExpireAt:   now.Add(OIDCLoginTTL),
+		LinkUserId: linkUserId,
+	}
+	if err := s.CreateOIDCLogin(ctx, pkg.HashContent([]byte(state)), login); err != nil {
+		return "", "", err
+	}
+	return s.OIDC.AuthURL(state, login.Nonce, login.Verifier), state, nil
+}
+
+// OIDCCallbackLogic возврат от провайдера: state одноразовый, после проверки ID токена выдается обычная сессия
+// или, с включенной 2fa, токен второго шага (POST /api/auth/2fa)
+func (s *ServiceDB) OIDCCallbackLogic(ctx context.Context, code, state string, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error) {
+	if s.OIDC == nil {
+		return Tokens{}, OIDCDisabled
+	}
+	if code == "" || state == "" {
+		return Tokens{}, storage.Invalidtoken
+	}
+	login, err := s.UseOIDCLogin(ctx, pkg.HashContent([]byte(state)))
+	if err != nil {
+		return Tokens{}, err
+	}
+	claims, err := s.OIDC.Exchange(ctx, code, login.Verifier, login.Nonce)
+	if err != nil {
+		return Tokens{}, err
+	}
+	var userId int
+	if login.LinkUserId != 0 {
+		userId, err = s.oidcLink(ctx, claims, login.LinkUserId)
+	} else {
+		userId, err = s.oidcUser(ctx, claims)
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+	// провайдер подтверждает только учетную запись у себя; 2fa пользователя проверяется как при входе по паролю
+	twoFactor, err := s.twoFactorEnabled(ctx, userId)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if twoFactor {
+		return s.newChallenge(ctx, userId)
+	}
+	return s.createSession(ctx, userId, ttl, meta)
+}
+
+// oidcUser пользователь для внешней учетной записи. Связанная запись входит по sub. Несвязанная
+// к существующим пользователям не привязывается (preferred_username провайдер не проверяет, совпадение
+// логина ничего не доказывает): привязать ее можно только из сессии пользователя (oidcLink), а при включенном
+// Provision создается новый пользователь без локального пароля. Forbidden - входить некому
+func (s *ServiceDB) oidcUser(ctx context.Context, claims OIDCClaims) (int, error) {
+	userId, err := s.FindIdentity(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return userId, s.checkEnabled(ctx, userId)
+	}
+	if !errors.Is(err, storage.Invaliddata) {
+		return 0, err
+	}
+	if !s.OIDC.Provision {
+		return 0, storage.Forbidden
+	}
+
+	login := claims.Username
+	if login == "" {
+		login = claims.Subject
+	}
+	user, err := s.CreateUser(ctx, login, "", storage.RoleUser)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			// логин уже занят
+			return 0, storage.Forbidden
+		}
+		return 0, err
+	}
+	s.Logger.Info("oidc user provisioned", slog.String("login", login), slog.String("issuer", claims.Issuer))
+	if err = s.LinkIdentity(ctx, claims.Issuer, claims.Subject, user.Id); err != nil {
+		return 0, err
+	}
+	return user.Id, nil
+}
+
+// oidcLink привязывает учетную запись провайдера к пользователю, начавшему вход из своей сессии;
+// учетная запись, уже привязанная к другому пользователю, - Forbidden
+func (s *ServiceDB) oidcLink(ctx context.Context, claims OIDCClaims, idUser int) (int, error) {
+	if err := s.checkEnabled(ctx, idUser); err != nil {
+		return 0, err
+	}
+	linked, err := s.FindIdentity(ctx, claims.Issuer, claims.Subject)
+	switch {
+	case err == nil && linked != idUser:
+		return 0, storage.Forbidden
+	case err == nil:
+		return idUser, nil
+	case !errors.Is(err, storage.Invaliddata):
+		return 0, err
+	}
+	if err = s.LinkIdentity(ctx, claims.Issuer, claims.Subject, idUser); err != nil {
+		return 0, err
+	}
+	s.Logger.Info("oidc identity linked", slog.Int("user", idUser), slog.String("issuer", claims.Issuer))
+	return idUser, nil
+}
+
+// checkEnabled заблокированный пользователь через провайдера не входит
+func (s *ServiceDB) checkEnabled(ctx context.Context, idUser int) error {
+	user, err := s.GetUser(ctx, idUser)
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return storage.Forbidden
+	}
+	return nil
+}
@@ -12,7 +12,10 @@ import (
 )
 
 func (s *ServiceDB) LogicRegister(ctx context.Context, data Register) (string, error) {
-	hashpass := pkg.CreateHash(data.Password)
+	hashpass, err := s.Hasher.Hash(data.Password)
+	if err != nil {
+		return "", storage.SomeWrong
+	}
 	login, err := s.Register(ctx, hashpass, data.Login)
 	if err != nil {
 		var pgErr *pgconn.PgError
@@ -26,26 +29,211 @@ func (s *ServiceDB) LogicRegister(ctx context.Context, data Register) (string, e
 					slog.String("message", pgErr.Message))
 			}
 		}
-		s.Logger.Info("LogicRegister err: ", err, slog.String("username", data.Login))
+		s.Logger.Info("LogicRegister err", slog.String("error", err.Error()), slog.String("username", data.Login))
 		return "", storage.SomeWrong
 	}
 	return login, nil
 }
 
-func (s *ServiceDB) LogicLogin(ctx context.Context, data Login, ttl time.Duration) (string, error) {
-	hashpass := pkg.CreateHash(data.Password)
-	newtoken := pkg.GenerateToken()
-	err := s.Login(ctx, hashpass, data.Login, newtoken, ttl)
+// newTokens токены новой сессии; в базу уходят токен сессии и хеш refresh токена,
+// access токен выпускается после того, как станет известен пользователь
+func newTokens(ttl TokenTTL) (Tokens, storage.Token, storage.Token) {
+	now := time.Now()
+	tokens := Tokens{
+		RefreshToken: pkg.GenerateSecret(),
+		ExpiresIn:    int(ttl.Access.Seconds()),
+	}
+	access := storage.Token{Token: pkg.GenerateToken(), TimeCreated: now, TimeExpired: now.Add(ttl.Access)}
+	refresh := storage.Token{Token: pkg.HashContent([]byte(tokens.RefreshToken)), TimeCreated: now, TimeExpired: now.Add(ttl.Refresh)}
+	return tokens, access, refresh
+}
+
+// LogicLogin вход по логину и паролю с учетом блокировок. Без 2fa создает сессию и возвращает пару токенов,
+// с 2fa - только Challenge, который меняется на токены в LogicTwoFactor
+func (s *ServiceDB) LogicLogin(ctx context.Context, data Login, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error) {
+	if err := s.checkLockout(ctx, data.Login, meta.IP); err != nil {
+		return Tokens{}, err
+	}
+	userId, err := s.checkPassword(ctx, data)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			s.loginFailed(ctx, data.Login, meta.IP)
+		}
+		return Tokens{}, err
+	}
+	// с включенной 2fa сессия создается только после кода (LogicTwoFactor); до него счетчик неудач
+	// не сбрасывается, иначе каждый верный пароль давал бы новые попытки подобрать код
+	twoFactor, err := s.twoFactorEnabled(ctx, userId)
+	if err != nil {
+		return Tokens{}, err
+	}
+	if twoFactor {
+		return s.newChallenge(ctx, userId)
+	}
+	s.loginSucceeded(ctx, data.Login)
+	return s.createSession(ctx, userId, ttl, meta)
+}
+
+func (s *ServiceDB) createSession(ctx context.Context, userId int, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error) {
+	tokens, access, refresh := newTokens(ttl)
+	err := s.CreateSession(ctx, userId, access, refresh, meta)
+	if err != nil {
+		return Tokens{}, err
+	}
+	tokens.AccessToken, err = s.Issue(userId, access.Token, access.TimeExpired)
+	if err != nil {
+		return Tokens{}, storage.SomeWrong
+	}
+	return tokens, nil
+}
+
+// dummyHash сравнивается с паролем, когда пользователя нет, чтобы время ответа не выдавало существующие логины
+var dummyHash = pkg.CreateHash("dummy password")
+
+// checkPassword проверяет пароль и при необходимости пересчитывает хеш с текущими параметрами
+func (s *ServiceDB) checkPassword(ctx context.Context, data Login) (int, error) {
+	userId, hash, err := s.GetCredentials(ctx, data.Login)
 	if err != nil {
-		return "", err
+		if errors.Is(err, storage.Invaliddata) {
+			s.Hasher.Verify(dummyHash, data.Password)
+		}
+		return 0, err
+	}
+	ok, rehash := s.Hasher.Verify(hash, data.Password)
+	if !ok {
+		return 0, storage.Invaliddata
+	}
+	if rehash {
+		if newHash, err := s.Hasher.Hash(data.Password); err == nil {
+			if err = s.UpdatePasswordHash(ctx, userId, newHash); err != nil {
+				s.Logger.Error("rehash password", slog.String("error", err.Error()))
+			}
+		}
 	}
-	return newtoken, nil
+	return userId, nil
+}
+
+// LogicRefresh обменивает refresh токен на новую пару (ротация)
+func (s *ServiceDB) LogicRefresh(ctx context.Context, refreshToken string, ttl TokenTTL) (Tokens, error) {
+	if refreshToken == "" {
+		return Tokens{}, storage.Invalidtoken
+	}
+	tokens, access, refresh := newTokens(ttl)
+	userId, err := s.RotateRefreshToken(ctx, pkg.HashContent([]byte(refreshToken)), access, refresh)
+	if err != nil {
+		if errors.Is(err, storage.TokenReused) {
+			s.Logger.Warn("refresh token reuse, session revoked")
+			_ = s.SyncRevoked(ctx)
+		}
+		return Tokens{}, err
+	}
+	tokens.AccessToken, err = s.Issue(userId, access.Token, access.TimeExpired)
+	if err != nil {
+		return Tokens{}, storage.SomeWrong
+	}
+	return tokens, nil
 }
 
 func (s *ServiceDB) DeleteSession(ctx context.Context, token string) error {
-	id, err := s.TokenValidator.ValidateToken(ctx, token)
+	_, err := s.ValidateToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	sessionToken, err := s.SessionToken(token)
+	if err != nil {
+		return err
+	}
+	if err = s.DeleteToken(ctx, sessionToken); err != nil {
+		return err
+	}
+	return s.SyncRevoked(ctx)
+}
+
+func (s *ServiceDB) ListSessionsLogic(ctx context.Context, idUser int, currentToken string) ([]storage.Session, error) {
+	sessionToken, err := s.SessionToken(currentToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListSessions(ctx, idUser, sessionToken)
+}
+
+func (s *ServiceDB) DeleteSessionByIdLogic(ctx context.Context, idUser int, idSession int) error {
+	if err := s.DeleteSessionById(ctx, idUser, idSession); err != nil {
+		return err
+	}
+	return s.SyncRevoked(ctx)
+}
+
+func (s *ServiceDB) LogoutAllLogic(ctx context.Context, idUser int) error {
+	if err := s.DeleteUserSessions(ctx, idUser); err != nil {
+		return err
+	}
+	return s.SyncRevoked(ctx)
+}
+
+// PurgeExpiredLogic чистит истекшие сессии и одноразовые токены
+func (s *ServiceDB) PurgeExpiredLogic(ctx context.Context) (int, error) {
+	n, err := s.PurgeExpired(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.Logger.Info("expired sessions purged", slog.Int("sessions", n))
+	return n, nil
+}
+
+// ChangePasswordLogic меняет пароль после проверки текущего и завершает остальные сессии пользователя.
+// Неверный текущий пароль считается неудачным входом: украденная сессия не дает подбирать пароль
+func (s *ServiceDB) ChangePasswordLogic(ctx context.Context, idUser int, currentToken, ip string, data ChangePassword) error {
+	login, err := s.GetLogin(ctx, idUser)
+	if err != nil {
+		return err
+	}
+	if err = s.checkLockout(ctx, login, ip); err != nil {
+		return err
+	}
+	hash, err := s.GetPasswordHash(ctx, idUser)
 	if err != nil {
 		return err
 	}
-	return s.DeleteToken(ctx, id)
+	if ok, _ := s.Hasher.Verify(hash, data.CurrentPassword); !ok {
+		s.loginFailed(ctx, login, ip)
+		return storage.Invaliddata
+	}
+	newHash, err := s.Hasher.Hash(data.NewPassword)
+	if err != nil {
+		return storage.SomeWrong
+	}
+	sessionToken, err := s.SessionToken(currentToken)
+	if err != nil {
+		return err
+	}
+	if err = s.ChangePassword(ctx, idUser, newHash, sessionToken); err != nil {
+		return err
+	}
+	return s.SyncRevoked(ctx)
+}
+
+func (s *ServiceDB) issueResetToken(ctx context.Context, login string, ttl time.Duration) (ResetToken, error) {
+	now := time.Now()
+	reset := ResetToken{Token: pkg.GenerateSecret(), ExpireAt: now.Add(ttl)}
+	token := storage.Token{Token: pkg.HashContent([]byte(reset.Token)), TimeCreated: now, TimeExpired: reset.ExpireAt}
+	if err := s.CreateResetToken(ctx, login, token); err != nil {
+		return ResetToken{}, err
+	}
+	return reset, nil
+}
+
+// ResetPasswordLogic ставит новый пароль по токену сброса, все сессии пользователя завершаются
+func (s *ServiceDB) ResetPasswordLogic(ctx context.Context, data ResetPassword) error {
+	if data.Token == "" {
+		return storage.Invalidtoken
+	}
+	hash, err := s.Hasher.Hash(data.Password)
+	if err != nil {
+		return storage.SomeWrong
+	}
+	if _, err = s.UseResetToken(ctx, pkg.HashContent([]byte(data.Token)), hash); err != nil {
+		return err
+	}
+	return s.SyncRevoked(ctx)
 }
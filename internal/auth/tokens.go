@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"gomodlag/internal/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessTokens выпуск и проверка access токенов.
+// В базе у сессии всегда хранится свой токен сессии; access токен либо совпадает с ним (DBTokens),
+// либо это подписанный токен, который на него ссылается (JWTTokens)
+type AccessTokens interface {
+	storage.TokenValidator
+	// Issue access токен для сессии sessionToken пользователя userId
+	Issue(userId int, sessionToken string, expire time.Time) (string, error)
+	// SessionToken токен сессии в базе, на который ссылается access токен
+	SessionToken(token string) (string, error)
+	// SyncRevoked подтягивает отозванные токены после удаления сессий
+	SyncRevoked(ctx context.Context) error
+}
+
+// DBTokens access токен - это токен сессии, каждый запрос проверяется в базе
+type DBTokens struct {
+	storage.TokenValidator
+}
+
+func (d DBTokens) Issue(_ int, sessionToken string, _ time.Time) (string, error) {
+	return sessionToken, nil
+}
+
+func (d DBTokens) SessionToken(token string) (string, error) {
+	return token, nil
+}
+
+func (d DBTokens) SyncRevoked(context.Context) error {
+	return nil
+}
+
+// JWTTokens подписанные access токены, проверяются без обращения к базе.
+// jti токена - токен сессии, sub - id пользователя, kid - ключ подписи
+type JWTTokens struct {
+	keys    map[string]signingKey
+	active  string
+	store   storage.RevocationStore
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+}
+
+type signingKey struct {
+	method jwt.SigningMethod
+	sign   any
+	verify any
+}
+
+// NewJWTTokens разбирает ключи вида "kid:hs256:base64" или "kid:ed25519:base64(seed)" через запятую.
+// Подписывает ключ active (по умолчанию первый), проверяются все - так ключи ротируются без разлогина
+func NewJWTTokens(keys, active string, store storage.RevocationStore) (*JWTTokens, error) {
+	j := &JWTTokens{keys: map[string]signingKey{}, active: active, store: store, revoked: map[string]struct{}{}}
+	for _, item := range strings.Split(keys, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid jwt key %q", item)
+		}
+		kid, alg := parts[0], strings.ToLower(parts[1])
+		raw, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt key %s: %w", kid, err)
+		}
+		switch alg {
+		case "hs256":
+			if len(raw) < 32 {
+				return nil, fmt.Errorf("jwt key %s: hs256 secret must be at least 32 bytes", kid)
+			}
+			j.keys[kid] = signingKey{method: jwt.SigningMethodHS256, sign: raw, verify: raw}
+		case "ed25519":
+			if len(raw) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwt key %s: ed25519 seed must be %d bytes", kid, ed25519.SeedSize)
+			}
+			priv := ed25519.NewKeyFromSeed(raw)
+			j.keys[kid] = signingKey{method: jwt.SigningMethodEdDSA, sign: priv, verify: priv.Public()}
+		default:
+			return nil, fmt.Errorf("jwt key %s: unknown algorithm %q", kid, alg)
+		}
+		if j.active == "" {
+			j.active = kid
+		}
+	}
+	if _, ok := j.keys[j.active]; !ok {
+		return nil, fmt.Errorf("jwt signing key %q not configured", j.active)
+	}
+	return j, nil
+}
+
+func (j *JWTTokens) Issue(userId int, sessionToken string, expire time.Time) (string, error) {
+	key := j.keys[j.active]
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.Itoa(userId),
+		ID:        sessionToken,
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expire),
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = j.active
+	return token.SignedString(key.sign)
+}
+
+func (j *JWTTokens) parse(token string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := j.keys[kid]
+		if !ok || t.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("unknown key")
+		}
+		return key.verify, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || claims.ID == "" {
+		return nil, storage.Invalidtoken
+	}
+	return claims, nil
+}
+
+// ValidateToken проверяет подпись, срок и список отозванных, не обращаясь к базе.
+// Блокировка и удаление пользователя отзывают его сессии, так что disabled отдельно не проверяется
+func (j *JWTTokens) ValidateToken(_ context.Context, token string) (int, error) {
+	claims, err := j.parse(token)
+	if err != nil {
+		return 0, err
+	}
+	j.mu.RLock()
+	_, revoked := j.revoked[claims.ID]
+	j.mu.RUnlock()
+	if revoked {
+		return 0, storage.Invalidtoken
+	}
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, storage.Invalidtoken
+	}
+	return userId, nil
+}
+
+func (j *JWTTokens) SessionToken(token string) (string, error) {
+	claims, err := j.parse(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.ID, nil
+}
+
+// SyncRevoked заменяет локальный список отозванных токенов списком из базы
+func (j *JWTTokens) SyncRevoked(ctx context.Context) error {
+	tokens, err := j.store.ListRevoked(ctx)
+	if err != nil {
+		return err
+	}
+	revoked := make(map[string]struct{}, len(tokens))
+	for _, t := range tokens {
+		revoked[t] = struct{}{}
+	}
+	j.mu.Lock()
+	j.revoked = revoked
+	j.mu.Unlock()
+	return nil
+}
+
+// RunRevocationSync периодически синхронизирует список отозванных, чтобы logout на другом инстансе
+// начинал действовать не позже чем через interval
+func (j *JWTTokens) RunRevocationSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = j.SyncRevoked(ctx)
+		}
+	}
+}
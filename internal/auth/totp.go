@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"strings"
+	"time"
+)
+
+const (
+	// ChallengeTTL сколько живет токен второго шага входа
+	ChallengeTTL = 5 * time.Minute
+	// challengeAttempts сколько кодов можно попробовать с одним токеном второго шага
+	challengeAttempts = 5
+	recoveryCodes     = 10
+	totpPeriod        = 30
+)
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// TOTPEnrollment секрет и otpauth:// URI для QR-кода в приложении-аутентификаторе
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPCode код из приложения или одноразовый код восстановления
+type TOTPCode struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// TwoFactorLogin второй шаг входа
+type TwoFactorLogin struct {
+	Challenge string `json:"challenge"`
+	TOTPCode
+}
+
+// EnrollTOTPLogic создает новый секрет; 2fa включится после подтверждения кодом
+func (s *ServiceDB) EnrollTOTPLogic(ctx context.Context, idUser int) (TOTPEnrollment, error) {
+	login, err := s.GetLogin(ctx, idUser)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.TOTPIssuer, AccountName: login, Period: totpPeriod})
+	if err != nil {
+		return TOTPEnrollment{}, storage.SomeWrong
+	}
+	if err = s.SaveTOTPSecret(ctx, idUser, key.Secret()); err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{Secret: key.Secret(), URI: key.String()}, nil
+}
+
+// ConfirmTOTPLogic включает 2fa по первому верному коду и выдает коды восстановления (показываются один раз)
+func (s *ServiceDB) ConfirmTOTPLogic(ctx context.Context, idUser int, code string) ([]string, error) {
+	t, err := s.GetTOTP(ctx, idUser)
+	if err != nil {
+		return nil, err
+	}
+	if t.Confirmed {
+		return nil, storage.Forbidden
+	}
+	step, ok := totpStep(t.Secret, code, time.Now())
+	if !ok {
+		return nil, storage.Invalidtoken
+	}
+	codes := make([]string, recoveryCodes)
+	hashes := make([]string, recoveryCodes)
+	for i := range codes {
+		codes[i] = pkg.GenerateSecret()[:10]
+		hashes[i] = pkg.HashContent([]byte(codes[i]))
+	}
+	if err = s.ConfirmTOTP(ctx, idUser, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// LogicTwoFactor второй шаг входа: токен второго шага и код 2fa меняются на сессию
+func (s *ServiceDB) LogicTwoFactor(ctx context.Context, data TwoFactorLogin, ttl TokenTTL, meta storage.SessionMeta) (Tokens, error) {
+	if data.Challenge == "" {
+		return Tokens{}, storage.Invalidtoken
+	}
+	challengeHash := pkg.HashContent([]byte(data.Challenge))
+	userId, err := s.UseChallenge(ctx, challengeHash, challengeAttempts)
+	if err != nil {
+		return Tokens{}, err
+	}
+	login, err := s.GetLogin(ctx, userId)
+	if err != nil {
+		return Tokens{}, err
+	}
+	// неверные коды блокируют логин так же, как неверные пароли: новый challenge попыток не добавляет
+	if err = s.checkLockout(ctx, login, meta.IP); err != nil {
+		return Tokens{}, err
+	}
+	if err = s.checkSecondFactor(ctx, userId, data.TOTPCode); err != nil {
+		if errors.Is(err, storage.Invalidtoken) {
+			s.loginFailed(ctx, login, meta.IP)
+		}
+		return Tokens{}, err
+	}
+	_ = s.DeleteChallenge(ctx, challengeHash)
+	s.loginSucceeded(ctx, login)
+	return s.createSession(ctx, userId, ttl, meta)
+}
+
+// checkSecondFactor проверяет код приложения (каждый шаг принимается один раз) или код восстановления
+func (s *ServiceDB) checkSecondFactor(ctx context.Context, idUser int, code TOTPCode) error {
+	if code.RecoveryCode != "" {
+		return s.UseRecoveryCode(ctx, idUser, pkg.HashContent([]byte(strings.TrimSpace(code.RecoveryCode))))
+	}
+	t, err := s.GetTOTP(ctx, idUser)
+	if err != nil {
+		return storage.Invalidtoken
+	}
+	step, ok := totpStep(t.Secret, code.Code, time.Now())
+	if !ok {
+		return storage.Invalidtoken
+	}
+	return s.UseTOTPStep(ctx, idUser, step)
+}
+
+// twoFactorEnabled у пользователя подтвержденная 2fa
+func (s *ServiceDB) twoFactorEnabled(ctx context.Context, idUser int) (bool, error) {
+	t, err := s.GetTOTP(ctx, idUser)
+	if err != nil {
+		if errors.Is(err, storage.Invaliddata) {
+			return false, nil
+		}
+		return false, err
+	}
+	return t.Confirmed, nil
+}
+
+// newChallenge выдается вместо токенов, когда у пользователя включена 2fa (LogicLogin, вход через OIDC);
+// живет ChallengeTTL, в базе хранится только хеш
+func (s *ServiceDB) newChallenge(ctx context.Context, idUser int) (Tokens, error) {
+	now := time.Now()
+	challenge := pkg.GenerateSecret()
+	token := storage.Token{Token: pkg.HashContent([]byte(challenge)), TimeCreated: now, TimeExpired: now.Add(ChallengeTTL)}
+	if err := s.CreateChallenge(ctx, idUser, token); err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{Challenge: challenge, ExpiresIn: int(ChallengeTTL.Seconds())}, nil
+}
+
+// totpStep шаг, которому соответствует код, с допуском в один шаг на расхождение часов
+func totpStep(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != int(otp.DigitsSix) {
+		return 0, false
+	}
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, totpOpts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
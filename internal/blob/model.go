@@ -0,0 +1,46 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gomodlag/internal/config"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+var ErrInvalidKey = errors.New("invalid blob key")
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	Mime    string
+	ModTime time.Time
+}
+
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, mime string) error
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// validKey ключ должен быть относительным и не выходить за пределы хранилища
+func validKey(key string) bool {
+	return key != "" && filepath.IsLocal(key)
+}
+
+// NewStore выбирает реализацию хранилища по config.BlobBackend
+func NewStore(c config.Config) (BlobStore, error) {
+	switch c.BlobBackend {
+	case "", "local":
+		return NewLocalStore(c.UploadDir)
+	case "s3":
+		return NewS3Store(c.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", c.BlobBackend)
+	}
+}
@@ -0,0 +1,112 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"gomodlag/internal/config"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Store работает с любым S3-совместимым хранилищем (AWS, MinIO и т.п.)
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Store(c config.S3Config) (*S3Store, error) {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, errors.New("S3ENDPOINT and S3BUCKET are required")
+	}
+	client, err := minio.New(c.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.AccessKey, c.SecretKey, ""),
+		Secure: c.UseSSL,
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, c.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, c.Bucket, minio.MakeBucketOptions{Region: c.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3Store{client: client, bucket: c.Bucket}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, mime string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: mime})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	if !validKey(key) {
+		return nil, ObjectInfo{}, ErrInvalidKey
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, mapS3Err(err)
+	}
+	// GetObject ленивый: ошибка отсутствия объекта приходит только на Stat/Read
+	st, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, mapS3Err(err)
+	}
+	return obj, s3Info(st), nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if !validKey(key) {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+	st, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, mapS3Err(err)
+	}
+	return s3Info(st), nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	return mapS3Err(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var result []ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		result = append(result, s3Info(obj))
+	}
+	return result, nil
+}
+
+func s3Info(st minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{Key: st.Key, Size: st.Size, Mime: st.ContentType, ModTime: st.LastModified}
+}
+
+func mapS3Err(err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"encoding/json"
+	"strings"
 	"sync"
 	"time"
 )
@@ -9,9 +10,23 @@ import (
 const ttl = 60 * time.Minute
 const Key = "doc_%s_%d"
 
+// DockPrefix общий префикс ключей одного документа для всех пользователей
+const DockPrefix = "doc_%s_"
+
+// Kind различает json и файловые записи под одним ключом документа
+type Kind int
+
+const (
+	KindJSON Kind = iota
+	KindFile
+)
+
 type CacheItem struct {
 	Data      []byte
+	Kind      Kind
 	Mime      string
+	ETag      string
+	ModTime   time.Time
 	ExpiresAt time.Time
 }
 
@@ -37,6 +52,7 @@ func (c *MemoryCache) SetJSON(key string, value interface{}) error {
 	defer c.mu.Unlock()
 	c.items[key] = CacheItem{
 		Data:      data,
+		Kind:      KindJSON,
 		Mime:      "application/json",
 		ExpiresAt: time.Now().Add(ttl),
 	}
@@ -47,7 +63,7 @@ func (c *MemoryCache) GetJSON(key string, dest interface{}) (bool, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	item, exists := c.items[key]
-	if !exists || time.Now().After(item.ExpiresAt) {
+	if !exists || time.Now().After(item.ExpiresAt) || item.Kind != KindJSON {
 		return false, nil
 	}
 	err := json.Unmarshal(item.Data, dest)
@@ -56,24 +72,28 @@ func (c *MemoryCache) GetJSON(key string, dest interface{}) (bool, error) {
 	}
 	return true, nil
 }
-func (c *MemoryCache) SetFile(key string, data []byte, mime string) {
+
+func (c *MemoryCache) SetFile(key string, data []byte, mime string, etag string, modTime time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.items[key] = CacheItem{
 		Data:      data,
+		Kind:      KindFile,
 		Mime:      mime,
+		ETag:      etag,
+		ModTime:   modTime,
 		ExpiresAt: time.Now().Add(ttl),
 	}
 }
 
-func (c *MemoryCache) GetFile(key string) ([]byte, string, bool) {
+func (c *MemoryCache) GetFile(key string) (CacheItem, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	item, exists := c.items[key]
-	if !exists || time.Now().After(item.ExpiresAt) {
-		return nil, "", false
+	if !exists || time.Now().After(item.ExpiresAt) || item.Kind != KindFile {
+		return CacheItem{}, false
 	}
-	return item.Data, item.Mime, true
+	return item, true
 }
 
 func (c *MemoryCache) Delete(key string) {
@@ -82,6 +102,16 @@ func (c *MemoryCache) Delete(key string) {
 	delete(c.items, key)
 }
 
+func (c *MemoryCache) DeleteByPrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.items, key)
+		}
+	}
+}
+
 func (c *MemoryCache) cleanup(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -0,0 +1,343 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gomodlag/internal/auth"
+	"gomodlag/internal/blob"
+	cfg "gomodlag/internal/config"
+	"gomodlag/internal/docks"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/server"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// errUsage неверные аргументы: печатается справка по команде, код выхода 2
+var errUsage = errors.New("invalid arguments")
+
+const usage = `usage: gomodlag <command> [arguments]
+
+commands:
+  serve                                  запустить сервер (по умолчанию)
+  migrate up | down [n] | status         миграции схемы
+  user create [-role user|admin] <login> создать пользователя, пароль - первая строка stdin
+  user disable | enable <login>          заблокировать или разблокировать
+  user reset-password <login>            выдать токен сброса пароля
+  docs gc [-orphans] [-dry-run]          удалить файлы из очереди и (с -orphans) файлы без документов
+  sessions purge                         удалить истекшие сессии и одноразовые токены
+  config check                           проверить конфигурацию
+`
+
+// env окружение команды: потоки и конфигурация
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	config *cfg.Config
+	logger logger.Logger
+}
+
+type command func(ctx context.Context, e *env, args []string) error
+
+var commands = map[string]command{
+	"serve":    serveCmd,
+	"migrate":  migrateCmd,
+	"user":     userCmd,
+	"docs":     docsCmd,
+	"sessions": sessionsCmd,
+	"config":   configCmd,
+}
+
+// Run выполняет команду из args (без имени программы) и возвращает код выхода
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		if name != "help" && name != "-h" && name != "--help" {
+			fmt.Fprintf(stderr, "unknown command: %s\n", name)
+		}
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	// вывод команды идет в stdout, лог - в stderr
+	logg := logger.Logger{Logger: slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))}
+	e := &env{stdin: stdin, stdout: stdout, stderr: stderr, logger: logg}
+	if err := cmd(context.Background(), e, args); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// loadConfig читает конфигурацию из окружения (один раз на команду)
+func (e *env) loadConfig() (*cfg.Config, error) {
+	if e.config != nil {
+		return e.config, nil
+	}
+	config, err := cfg.ItitConfig()
+	if err != nil {
+		return nil, err
+	}
+	e.config = config
+	return config, nil
+}
+
+// connect открывает хранилище из DBURL; close закрывает соединения
+func (e *env) connect() (storage.Store, func(), error) {
+	config, err := e.loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return storage.Open(config.DBURL, e.logger)
+}
+
+// authService сервис аутентификации без OIDC; отозванные токены серверы подтянут из базы сами
+func (e *env) authService(db storage.Store) *auth.ServiceDB {
+	return server.NewAuthService(*e.config, db, auth.DBTokens{TokenValidator: db}, e.logger)
+}
+
+// flags набор флагов подкоманды; ошибка разбора печатается в stderr, справку печатает Run
+func (e *env) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {}
+	return fs
+}
+
+func parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	return nil
+}
+
+func serveCmd(_ context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	config, err := e.loadConfig()
+	if err != nil {
+		return err
+	}
+	return server.Start(*config)
+}
+
+func migrateCmd(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	steps := 1
+	switch {
+	case args[0] == "down" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return errUsage
+		}
+		steps = n
+	case len(args) != 1:
+		return errUsage
+	}
+	store, closeDB, err := e.connect()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	db, ok := store.(storage.Migrator)
+	if !ok {
+		return fmt.Errorf("migrations are not supported for this storage")
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := db.MigrateUp(ctx, e.logger)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "applied %d migrations\n", n)
+	case "down":
+		n, err := db.MigrateDown(ctx, steps, e.logger)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "reverted %d migrations\n", n)
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(e.stdout, "%04d %-24s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func userCmd(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	fs := e.flags("user " + args[0])
+	role := storage.RoleUser
+	if args[0] == "create" {
+		fs.StringVar(&role, "role", storage.RoleUser, "user или admin")
+	}
+	if err := parse(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	login := fs.Arg(0)
+
+	var password string
+	switch args[0] {
+	case "create":
+		// пароль не передается аргументом, чтобы не попасть в историю и список процессов
+		line, err := bufio.NewReader(e.stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+		// те же правила, что у POST /api/admin/users
+		if !pkg.ValidateLogin(login) {
+			return fmt.Errorf("invalid login")
+		}
+		if !pkg.ValidatePassword(password) {
+			return fmt.Errorf("invalid password")
+		}
+	case "disable", "enable", "reset-password":
+	default:
+		return errUsage
+	}
+
+	db, closeDB, err := e.connect()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	service := e.authService(db)
+
+	switch args[0] {
+	case "create":
+		user, err := service.CreateUserLogic(ctx, storage.SystemAdmin, auth.NewUser{Login: login, Password: password, Role: role})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "created user %s (id %d, %s)\n", user.Login, user.Id, user.Role)
+	case "disable", "enable":
+		if err = service.SetDisabledLogic(ctx, storage.SystemAdmin, login, args[0] == "disable"); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "user %s %sd\n", login, args[0])
+	case "reset-password":
+		reset, err := service.IssueResetTokenLogic(ctx, storage.SystemAdmin, login, e.config.ResetTTL)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(e.stdout, reset.Token)
+	}
+	return nil
+}
+
+func docsCmd(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 || args[0] != "gc" {
+		return errUsage
+	}
+	fs := e.flags("docs gc")
+	orphans := fs.Bool("orphans", false, "искать файлы без документов")
+	dryRun := fs.Bool("dry-run", false, "только отчет о файлах без документов")
+	if err := parse(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	db, closeDB, err := e.connect()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	store, err := blob.NewStore(*e.config)
+	if err != nil {
+		return err
+	}
+	gc := &docks.BlobGC{BlobGCModel: db, Blob: store, Logger: e.logger, Grace: e.config.BlobGC.Grace}
+
+	if !*dryRun {
+		n, err := gc.ProcessDeletions(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "deleted %d queued files\n", n)
+	}
+	if *orphans || *dryRun {
+		report, err := gc.CollectOrphans(ctx, *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "scanned %d files, %d orphans, %d deleted\n", report.Scanned, len(report.Orphans), report.Deleted)
+		for _, o := range report.Orphans {
+			fmt.Fprintf(e.stdout, "%s\t%d\t%s\n", o.Key, o.Size, o.ModTime.Format("2006-01-02 15:04:05"))
+		}
+	}
+	return nil
+}
+
+func sessionsCmd(ctx context.Context, e *env, args []string) error {
+	if len(args) != 1 || args[0] != "purge" {
+		return errUsage
+	}
+	db, closeDB, err := e.connect()
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+	n, err := e.authService(db).PurgeExpiredLogic(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout, "purged %d expired sessions\n", n)
+	return nil
+}
+
+// configCmd проверяет конфигурацию без подключения к базе: переменные окружения, ключи JWT и доступ к хранилищу
+func configCmd(_ context.Context, e *env, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errUsage
+	}
+	config, err := e.loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.TokenMode == "jwt" {
+		if _, err = auth.NewJWTTokens(config.JWT.Keys, config.JWT.KeyId, nil); err != nil {
+			return fmt.Errorf("JWTKEYS: %w", err)
+		}
+	}
+	if _, err = blob.NewStore(*config); err != nil {
+		return fmt.Errorf("BLOBBACKEND: %w", err)
+	}
+	fmt.Fprintln(e.stdout, "config ok")
+	return nil
+}
@@ -3,17 +3,111 @@ package config
 import (
 	"fmt"
 	"github.com/joho/godotenv"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
+	// AdminToken устаревший общий токен для /api/register; пусто - регистрация только через администратора
 	AdminToken string
-	DBURL      string
-	DockTTL    time.Duration
+	// BootstrapAdmin первый администратор, создается при старте, если администраторов нет
+	BootstrapAdmin BootstrapAdmin
+	DBURL          string
+	// AutoMigrate применять миграции схемы при старте сервера
+	AutoMigrate bool
+	DockTTL     time.Duration
+	// ResetTTL время жизни токена сброса пароля
+	ResetTTL time.Duration
+	// RefreshTTL время жизни refresh токена (и сессии устройства), DockTTL - access токена
+	RefreshTTL time.Duration
 	ServerPort string
 	CacheTTL   time.Duration
+	// CacheFileMax файлы больше этого размера (в байтах) не кешируются и отдаются потоком
+	CacheFileMax int64
+	// SessionCookie дублировать токен сессии в HttpOnly cookie
+	SessionCookie bool
+	// TrustedProxies адреса прокси, которым верим X-Forwarded-For; пусто - ip клиента берется из соединения
+	TrustedProxies []*net.IPNet
+
+	// TokenMode "db" - access токен проверяется в базе, "jwt" - подписанный токен проверяется локально
+	TokenMode string
+	JWT       JWTConfig
+
+	Password PasswordConfig
+	// TOTPIssuer имя сервиса в приложении-аутентификаторе
+	TOTPIssuer string
+	Login      LoginConfig
+	// OIDC вход через провайдера; пустой Issuer - выключен
+	OIDC OIDCConfig
+
+	BlobBackend string
+	UploadDir   string
+	S3          S3Config
+	BlobGC      BlobGCConfig
+}
+
+// BlobGCConfig фоновая чистка хранилища
+type BlobGCConfig struct {
+	// Interval как часто удалять файлы удаленных документов
+	Interval time.Duration
+	// OrphanInterval как часто искать файлы без документов; 0 - не искать
+	OrphanInterval time.Duration
+	// Grace возраст, после которого файл без документа удаляется
+	Grace time.Duration
+}
+
+type BootstrapAdmin struct {
+	Login    string
+	Password string
+}
+
+type JWTConfig struct {
+	// Keys ключи через запятую: "kid:hs256:base64" или "kid:ed25519:base64(seed)"
+	Keys string
+	// KeyId ключ, которым подписываются новые токены
+	KeyId string
+	// RevocationSync как часто подтягивать отозванные токены из базы. JWT проверяется без базы, поэтому
+	// выход, блокировка и удаление пользователя на других инстансах действуют с задержкой до RevocationSync:
+	// их сессии попадают в revoked_tokens, флаг disabled в ValidateToken не проверяется
+	RevocationSync time.Duration
+}
+
+// PasswordConfig алгоритм и параметры хеширования паролей; нули - значения по умолчанию
+type PasswordConfig struct {
+	Algorithm    string
+	BcryptCost   int
+	ArgonTime    int
+	ArgonMemory  int
+	ArgonThreads int
+}
+
+// LoginConfig защита от подбора пароля
+type LoginConfig struct {
+	UserAttempts int
+	IPAttempts   int
+	LockMax      time.Duration
+}
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// RedirectURL адрес /api/auth/oidc/callback, зарегистрированный у провайдера
+	RedirectURL string
+	// Provision создавать пользователя при первом входе
+	Provision bool
+}
+
+type S3Config struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
 }
 
 func InitEnv() error {
@@ -27,6 +121,10 @@ func InitEnv() error {
 func ItitConfig() (*Config, error) {
 	c := &Config{}
 	c.AdminToken = os.Getenv("ADMINTOKEN")
+	c.BootstrapAdmin = BootstrapAdmin{Login: os.Getenv("ADMINLOGIN"), Password: os.Getenv("ADMINPASSWORD")}
+	if c.BootstrapAdmin.Login != "" && c.BootstrapAdmin.Password == "" {
+		return nil, fmt.Errorf("ADMINPASSWORD is required with ADMINLOGIN")
+	}
 	c.ServerPort = os.Getenv("SERVERPORT")
 	ttlStr := os.Getenv("TTLSESION")
 	if ttlStr == "" {
@@ -46,27 +144,169 @@ func ItitConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid TTLSESION: %v", err)
 	}
 	c.CacheTTL = time.Second * time.Duration(ttl)
-	username := os.Getenv("USER")
-	password := os.Getenv("PASSWORD")
-	host := os.Getenv("HOST")
-	port := os.Getenv("PORT")
-	dbname := os.Getenv("DBNAME")
+	c.CacheFileMax = 1 << 20
+	if maxStr := os.Getenv("CACHEFILEMAX"); maxStr != "" {
+		c.CacheFileMax, err = strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CACHEFILEMAX: %v", err)
+		}
+	}
+	c.RefreshTTL = time.Hour * 24 * 30
+	if ttlStr = os.Getenv("TTLREFRESH"); ttlStr != "" {
+		ttl, err = strconv.Atoi(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTLREFRESH: %v", err)
+		}
+		c.RefreshTTL = time.Second * time.Duration(ttl)
+	}
+	c.ResetTTL = time.Hour
+	if ttlStr = os.Getenv("TTLRESET"); ttlStr != "" {
+		ttl, err = strconv.Atoi(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTLRESET: %v", err)
+		}
+		c.ResetTTL = time.Second * time.Duration(ttl)
+	}
+	c.SessionCookie = os.Getenv("SESSIONCOOKIE") == "true"
+	if proxies := os.Getenv("TRUSTEDPROXIES"); proxies != "" {
+		for _, cidr := range strings.Split(proxies, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTEDPROXIES: %v", err)
+			}
+			c.TrustedProxies = append(c.TrustedProxies, ipNet)
+		}
+	}
+	c.Password.Algorithm = os.Getenv("PASSWORDALGO")
+	for _, v := range []struct {
+		dst  *int
+		name string
+	}{
+		{&c.Password.BcryptCost, "BCRYPTCOST"},
+		{&c.Password.ArgonTime, "ARGON2TIME"},
+		{&c.Password.ArgonMemory, "ARGON2MEMORY"},
+		{&c.Password.ArgonThreads, "ARGON2THREADS"},
+	} {
+		if str := os.Getenv(v.name); str != "" {
+			*v.dst, err = strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", v.name, err)
+			}
+		}
+	}
+	c.Login = LoginConfig{UserAttempts: 5, IPAttempts: 20, LockMax: 15 * time.Minute}
+	lockMax := int(c.Login.LockMax.Seconds())
+	for _, v := range []struct {
+		dst  *int
+		name string
+	}{
+		{&c.Login.UserAttempts, "LOGINATTEMPTS"},
+		{&c.Login.IPAttempts, "LOGINIPATTEMPTS"},
+		{&lockMax, "LOGINLOCKMAX"},
+	} {
+		if str := os.Getenv(v.name); str != "" {
+			*v.dst, err = strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", v.name, err)
+			}
+		}
+	}
+	c.Login.LockMax = time.Second * time.Duration(lockMax)
+	c.TOTPIssuer = os.Getenv("TOTPISSUER")
+	if c.TOTPIssuer == "" {
+		c.TOTPIssuer = "gomodlag"
+	}
+	c.OIDC.Issuer = os.Getenv("OIDCISSUER")
+	if c.OIDC.Issuer != "" {
+		c.OIDC.ClientId = os.Getenv("OIDCCLIENTID")
+		c.OIDC.ClientSecret = os.Getenv("OIDCCLIENTSECRET")
+		c.OIDC.RedirectURL = os.Getenv("OIDCREDIRECT")
+		c.OIDC.Provision = os.Getenv("OIDCPROVISION") == "true"
+		if c.OIDC.ClientId == "" || c.OIDC.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDCCLIENTID and OIDCREDIRECT are required with OIDCISSUER")
+		}
+	}
+	c.TokenMode = os.Getenv("TOKENMODE")
+	if c.TokenMode == "jwt" {
+		c.JWT = JWTConfig{
+			Keys:           os.Getenv("JWTKEYS"),
+			KeyId:          os.Getenv("JWTKID"),
+			RevocationSync: 10 * time.Second,
+		}
+		if c.JWT.Keys == "" {
+			return nil, fmt.Errorf("JWTKEYS is required")
+		}
+		if syncStr := os.Getenv("JWTREVOCATIONSYNC"); syncStr != "" {
+			ttl, err = strconv.Atoi(syncStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid JWTREVOCATIONSYNC: %v", err)
+			}
+			c.JWT.RevocationSync = time.Second * time.Duration(ttl)
+		}
+	}
+	// DBURL целиком задает хранилище (postgres://..., memory://); иначе URL собирается из частей
+	c.DBURL = os.Getenv("DBURL")
+	if c.DBURL == "" {
+		username := os.Getenv("USER")
+		password := os.Getenv("PASSWORD")
+		host := os.Getenv("HOST")
+		port := os.Getenv("PORT")
+		dbname := os.Getenv("DBNAME")
+
+		for _, v := range []struct {
+			val, name string
+		}{
+			{username, "USERNAME"},
+			{password, "PASSWORD"},
+			{host, "HOST"},
+			{port, "PORT"},
+			{dbname, "DBNAME"},
+		} {
+			if v.val == "" {
+				return nil, fmt.Errorf("%s is required", v.name)
+			}
+		}
 
+		c.DBURL = fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, port, dbname)
+	}
+	c.AutoMigrate = os.Getenv("DBMIGRATE") != "false"
+
+	c.BlobGC = BlobGCConfig{Interval: time.Minute, OrphanInterval: time.Hour, Grace: 24 * time.Hour}
 	for _, v := range []struct {
-		val, name string
+		dst  *time.Duration
+		name string
 	}{
-		{username, "USERNAME"},
-		{password, "PASSWORD"},
-		{host, "HOST"},
-		{port, "PORT"},
-		{dbname, "DBNAME"},
+		{&c.BlobGC.Interval, "BLOBGCINTERVAL"},
+		{&c.BlobGC.OrphanInterval, "BLOBORPHANINTERVAL"},
+		{&c.BlobGC.Grace, "BLOBORPHANGRACE"},
 	} {
-		if v.val == "" {
-			return nil, fmt.Errorf("%s is required", v.name)
+		if str := os.Getenv(v.name); str != "" {
+			ttl, err = strconv.Atoi(str)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", v.name, err)
+			}
+			*v.dst = time.Second * time.Duration(ttl)
 		}
 	}
+	if c.BlobGC.Interval <= 0 {
+		return nil, fmt.Errorf("BLOBGCINTERVAL must be positive")
+	}
 
-	c.DBURL = fmt.Sprintf("postgres://%s:%s@%s:%s/%s", username, password, host, port, dbname)
+	c.BlobBackend = os.Getenv("BLOBBACKEND")
+	c.UploadDir = os.Getenv("UPLOADDIR")
+	if c.UploadDir == "" {
+		c.UploadDir = "/app/uploads"
+	}
+	if c.BlobBackend == "s3" {
+		c.S3 = S3Config{
+			Endpoint:  os.Getenv("S3ENDPOINT"),
+			AccessKey: os.Getenv("S3ACCESSKEY"),
+			SecretKey: os.Getenv("S3SECRETKEY"),
+			Bucket:    os.Getenv("S3BUCKET"),
+			Region:    os.Getenv("S3REGION"),
+			UseSSL:    os.Getenv("S3SSL") == "true",
+		}
+	}
 
 	return c, nil
 }
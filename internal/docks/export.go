@@ -0,0 +1,110 @@
+package docks
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"gomodlag/internal/storage"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ExportEntry документ в manifest.json выгрузки; File и Json - пути внутри архива.
+// Error заполняется, если файл документа не удалось прочитать из хранилища
+type ExportEntry struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Mime         string    `json:"mime"`
+	IsFile       bool      `json:"is_file"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	GrantedUsers []string  `json:"granted_users"`
+	File         string    `json:"file,omitempty"`
+	Json         string    `json:"json,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type exportManifest struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Documents  []ExportEntry `json:"documents"`
+}
+
+// ExportDocksLogic документы, которыми владеет пользователь
+func (s *ServiceDocks) ExportDocksLogic(ctx context.Context, idUser int) ([]storage.DocumentWithGrants, error) {
+	return s.ListOwnedDocks(ctx, idUser)
+}
+
+// WriteExport пишет ZIP: documents/<id>/ с файлом и json каждого документа и manifest.json.
+// Файлы читаются из хранилища потоком, архив не собирается в памяти.
+// Недоступный файл пропускается и отмечается в манифесте, поэтому манифест пишется последним
+func (s *ServiceDocks) WriteExport(ctx context.Context, docs []storage.DocumentWithGrants, w io.Writer) error {
+	manifest := exportManifest{ExportedAt: time.Now(), Documents: make([]ExportEntry, len(docs))}
+	zw := zip.NewWriter(w)
+	for i, d := range docs {
+		e := ExportEntry{ID: d.ID.String(), Name: d.Name, Mime: d.Mime, IsFile: d.IsFile, Public: d.Public,
+			CreatedAt: d.CreatedAt, GrantedUsers: d.GrantedUsers}
+		dir := "documents/" + e.ID + "/"
+		if len(d.Json) > 0 && string(d.Json) != "null" {
+			e.Json = dir + "data.json"
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: e.Json, Method: zip.Deflate, Modified: d.CreatedAt})
+			if err != nil {
+				return err
+			}
+			if _, err = f.Write(d.Json); err != nil {
+				return err
+			}
+		}
+		if d.Filepath != "" {
+			e.File = dir + exportFileName(d.Name, d.Filepath)
+			ok, err := s.exportFile(ctx, zw, e.File, d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				e.File = ""
+				e.Error = "file unavailable"
+			}
+		}
+		manifest.Documents[i] = e
+	}
+
+	mf, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mf)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportFile копирует файл документа в архив; false - файл не удалось открыть, в архив ничего не записано
+func (s *ServiceDocks) exportFile(ctx context.Context, zw *zip.Writer, name string, d storage.DocumentWithGrants) (bool, error) {
+	file, _, err := s.Blob.Get(ctx, d.Filepath)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: d.CreatedAt})
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(f, file)
+	return true, err
+}
+
+// exportFileName имя файла в архиве из имени документа без путей; расширение берется из ключа в хранилище
+func exportFileName(name, key string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return path.Base(key)
+	}
+	if path.Ext(name) == "" {
+		name += path.Ext(key)
+	}
+	return name
+}
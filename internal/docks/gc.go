@@ -0,0 +1,113 @@
+package docks
+
+import (
+	"context"
+	"gomodlag/internal/blob"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/storage"
+	"log/slog"
+	"time"
+)
+
+// deletionBatch сколько файлов из очереди удаляется за один проход
+const deletionBatch = 100
+
+// BlobGC убирает из хранилища файлы удаленных документов (очередь blob_deletions)
+// и файлы-сироты, на которые не ссылается ни документ, ни версия
+type BlobGC struct {
+	storage.BlobGCModel
+	Blob blob.BlobStore
+	logger.Logger
+	// Grace сирота удаляется, только если пролежал дольше: файл пишется в хранилище раньше,
+	// чем документ в базу, и свежий файл может принадлежать загрузке, которая еще идет
+	Grace time.Duration
+}
+
+// OrphanReport итог проверки хранилища
+type OrphanReport struct {
+	Scanned int `json:"scanned"`
+	// Orphans все найденные сироты, Deleted - удаленные из них (старше Grace)
+	Orphans []blob.ObjectInfo `json:"orphans"`
+	Deleted int               `json:"deleted"`
+}
+
+// ProcessDeletions удаляет файлы из очереди; неудачные остаются в очереди со счетчиком попыток
+func (g *BlobGC) ProcessDeletions(ctx context.Context) (int, error) {
+	keys, err := g.PendingBlobDeletions(ctx, deletionBatch)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		if err := g.Blob.Delete(ctx, key); err != nil {
+			g.Logger.Error("Blob.Delete", slog.String("key", key), slog.String("error", err.Error()))
+			_ = g.BlobDeleteFailed(ctx, key, err.Error())
+			continue
+		}
+		if err := g.BlobDeleted(ctx, key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// CollectOrphans сверяет хранилище со ссылками в базе. dryRun - только отчет, без удаления
+func (g *BlobGC) CollectOrphans(ctx context.Context, dryRun bool) (OrphanReport, error) {
+	// сначала список файлов, потом ссылки: файл, загруженный между ними, уже будет в ссылках
+	objects, err := g.Blob.List(ctx, "")
+	if err != nil {
+		return OrphanReport{}, err
+	}
+	referenced, err := g.ReferencedBlobs(ctx)
+	if err != nil {
+		return OrphanReport{}, err
+	}
+	report := OrphanReport{Scanned: len(objects), Orphans: []blob.ObjectInfo{}}
+	deadline := time.Now().Add(-g.Grace)
+	for _, obj := range objects {
+		if _, ok := referenced[obj.Key]; ok {
+			continue
+		}
+		report.Orphans = append(report.Orphans, obj)
+		if dryRun || obj.ModTime.After(deadline) {
+			continue
+		}
+		if err := g.Blob.Delete(ctx, obj.Key); err != nil {
+			g.Logger.Error("Blob.Delete", slog.String("key", obj.Key), slog.String("error", err.Error()))
+			continue
+		}
+		report.Deleted++
+	}
+	if len(report.Orphans) > 0 {
+		g.Logger.Info("blob orphans", slog.Int("scanned", report.Scanned),
+			slog.Int("orphans", len(report.Orphans)), slog.Int("deleted", report.Deleted))
+	}
+	return report, nil
+}
+
+// Run обрабатывает очередь каждые interval и ищет сирот каждые orphanInterval (0 - не искать)
+func (g *BlobGC) Run(ctx context.Context, interval, orphanInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var orphans <-chan time.Time
+	if orphanInterval > 0 {
+		orphanTicker := time.NewTicker(orphanInterval)
+		defer orphanTicker.Stop()
+		orphans = orphanTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := g.ProcessDeletions(ctx); err != nil {
+				g.Logger.Error("ProcessDeletions", slog.String("error", err.Error()))
+			}
+		case <-orphans:
+			if _, err := g.CollectOrphans(ctx, false); err != nil {
+				g.Logger.Error("CollectOrphans", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"github.com/google/uuid"
+	"gomodlag/internal/blob"
 	"gomodlag/internal/logger"
 	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"io"
 	"mime/multipart"
 )
 
@@ -30,6 +33,7 @@ type UploadRequest struct {
 type ServiceDocks struct {
 	storage.DockModel
 	logger.Logger
+	Blob blob.BlobStore
 }
 
 type DockById struct {
@@ -37,9 +41,32 @@ type DockById struct {
 	IdDock uuid.UUID
 }
 
+const (
+	MergePatch = "application/merge-patch+json" // RFC 7396
+	JsonPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+type DockPatch struct {
+	Type string
+	Body []byte
+}
+
 type DockLogic interface {
+	Authorize(ctx context.Context, id DockById, perm Permission) error
 	AddNewLogic(ctx context.Context, data UploadRequest) error
 	FindDocksLogic(ctx context.Context, data storage.GetDock) ([]storage.DocumentWithGrants, error)
 	GetDockByIdLogic(ctx context.Context, data DockById) (storage.DocumentWithGrants, error)
 	DeleteDockLogic(ctx context.Context, data DockById) error
+	OpenDockFile(ctx context.Context, doc storage.DocumentWithGrants) (io.ReadSeekCloser, blob.ObjectInfo, error)
+	ReplaceDockLogic(ctx context.Context, id DockById, data UploadRequest) error
+	PatchDockLogic(ctx context.Context, id DockById, patch DockPatch) (json.RawMessage, error)
+	ListVersionsLogic(ctx context.Context, id DockById) ([]storage.DockVersion, error)
+	GetVersionLogic(ctx context.Context, id DockById, version int) (storage.DockVersion, error)
+	RestoreVersionLogic(ctx context.Context, id DockById, version int) (int, error)
+	DiffVersionsLogic(ctx context.Context, id DockById, from, to int) ([]pkg.DiffOp, error)
+	ListGrantsLogic(ctx context.Context, id DockById) ([]storage.Grant, error)
+	AddGrantsLogic(ctx context.Context, id DockById, logins []string, role Role) error
+	RevokeGrantLogic(ctx context.Context, id DockById, login string) (int, error)
+	ExportDocksLogic(ctx context.Context, idUser int) ([]storage.DocumentWithGrants, error)
+	WriteExport(ctx context.Context, docs []storage.DocumentWithGrants, w io.Writer) error
 }
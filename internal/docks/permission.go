@@ -0,0 +1,68 @@
+package docks
+
+import (
+	"context"
+	"gomodlag/internal/storage"
+)
+
+type Role string
+
+const (
+	RoleOwner   Role = "owner"
+	RoleCoOwner Role = "coowner"
+	RoleEditor  Role = "editor"
+	RoleViewer  Role = "viewer"
+	// RolePublic чтение публичного документа без гранта, выдать грантом нельзя
+	RolePublic Role = "public"
+)
+
+type Permission int
+
+const (
+	PermRead Permission = iota
+	PermWrite
+	PermManageGrants
+	PermDelete
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:   {PermRead, PermWrite, PermManageGrants, PermDelete},
+	RoleCoOwner: {PermRead, PermWrite, PermManageGrants, PermDelete},
+	RoleEditor:  {PermRead, PermWrite},
+	RoleViewer:  {PermRead},
+	RolePublic:  {PermRead},
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRole роль, которую можно выдать грантом (owner выдать нельзя)
+func ParseRole(s string) (Role, bool) {
+	switch r := Role(s); r {
+	case RoleCoOwner, RoleEditor, RoleViewer:
+		return r, true
+	case "":
+		return RoleViewer, true
+	default:
+		return "", false
+	}
+}
+
+// Authorize единая проверка прав на документ.
+// Invaliddata - документа нет или он недоступен пользователю, Forbidden - роли не хватает прав
+func (s *ServiceDocks) Authorize(ctx context.Context, id DockById, perm Permission) error {
+	role, err := s.GetDockRole(ctx, id.IdUser, id.IdDock)
+	if err != nil {
+		return err
+	}
+	if !Role(role).Can(perm) {
+		return storage.Forbidden
+	}
+	return nil
+}
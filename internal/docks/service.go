@@ -2,60 +2,67 @@ package docks
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"gomodlag/internal/blob"
 	"gomodlag/internal/storage"
 	"gomodlag/pkg"
+	"io"
 	"sort"
 )
 
 func (s *ServiceDocks) AddNewLogic(ctx context.Context, data UploadRequest) error {
+	var hash, newFile string
 	if data.File != nil {
-		filepath, err := pkg.SaveFile(data.File, "/app/uploads")
+		filepath, fileHash, err := pkg.SaveFile(ctx, data.File, s.Blob)
 		if err != nil {
 			return fmt.Errorf("failed save file")
 		}
 		data.Meta.FilePath = &filepath
+		newFile, hash = filepath, fileHash
 		if !data.Meta.File {
 			data.Meta.File = true
 		}
 	}
 	data.Meta.Id = pkg.GenerateDockId()
 
-	tx, err := s.Begin(ctx)
-	if err != nil {
-		return storage.Internal
-	}
-	committed := false
-	defer func() {
-		if !committed {
-			_ = tx.Rollback(ctx)
-		}
-	}()
-
 	d := storage.Dock{
-		Id:       data.Meta.Id,
-		IsFile:   data.Meta.File,
-		Public:   data.Meta.Public,
-		Name:     data.Meta.Name,
-		Mime:     data.Meta.Mime,
-		Json:     data.Json,
-		Filepath: *data.Meta.FilePath,
-		OwnerId:  data.Meta.OwnerId,
-	}
-	_, err = s.NewDocs(ctx, d, tx)
-	if err != nil {
-		return fmt.Errorf("failed create new doc")
+		Id:      data.Meta.Id,
+		IsFile:  data.Meta.File,
+		Public:  data.Meta.Public,
+		Name:    data.Meta.Name,
+		Mime:    data.Meta.Mime,
+		Json:    data.Json,
+		OwnerId: data.Meta.OwnerId,
 	}
-
-	_, err = s.AddGrant(ctx, data.Meta.Grant, data.Meta.Id, tx)
-	if err != nil {
-		return fmt.Errorf("failed to add grant")
+	if data.Meta.FilePath != nil {
+		d.Filepath = *data.Meta.FilePath
 	}
-	if err = tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit tx: %w", err)
+	if hash == "" {
+		hash = pkg.HashContent(d.Json)
 	}
-	committed = true
-	return nil
+	err := s.WithTx(ctx, func(tx storage.DockTx) error {
+		if _, err := tx.NewDocs(ctx, d); err != nil {
+			return fmt.Errorf("failed create new doc: %w", err)
+		}
+		if _, err := tx.AddVersion(ctx, d, d.OwnerId, hash); err != nil {
+			return fmt.Errorf("failed to add version: %w", err)
+		}
+		_, err := tx.AddGrant(ctx, data.Meta.Grant, string(RoleViewer), data.Meta.Id)
+		if err != nil {
+			if errors.Is(err, storage.UnknownUser) {
+				return err
+			}
+			return fmt.Errorf("failed to add grant: %w", err)
+		}
+		return nil
+	})
+	if err != nil && newFile != "" {
+		_ = s.Blob.Delete(context.WithoutCancel(ctx), newFile)
+	}
+	return err
 }
 
 func (s *ServiceDocks) FindDocksLogic(ctx context.Context, data storage.GetDock) ([]storage.DocumentWithGrants, error) {
@@ -75,24 +82,209 @@ func (s *ServiceDocks) FindDocksLogic(ctx context.Context, data storage.GetDock)
 }
 
 func (s *ServiceDocks) GetDockByIdLogic(ctx context.Context, data DockById) (storage.DocumentWithGrants, error) {
-	dock, err := s.GetDockById(ctx, data.IdUser, data.IdDock)
+	dock, err := s.GetDockById(ctx, data.IdDock)
 	if err != nil {
 		return storage.DocumentWithGrants{}, err
 	}
-	if dock.IsFile {
-		file, err := pkg.GetFile(dock.Filepath)
-		if err != nil {
-			return storage.DocumentWithGrants{}, storage.Internal
-		}
-		dock.File = file
-	}
 	return dock, nil
 }
 
+// OpenDockFile открывает файл документа на чтение без загрузки целиком в память
+func (s *ServiceDocks) OpenDockFile(ctx context.Context, doc storage.DocumentWithGrants) (io.ReadSeekCloser, blob.ObjectInfo, error) {
+	file, info, err := s.Blob.Get(ctx, doc.Filepath)
+	if err != nil {
+		return nil, blob.ObjectInfo{}, storage.Internal
+	}
+	return file, info, nil
+}
+
 func (s *ServiceDocks) DeleteDockLogic(ctx context.Context, data DockById) error {
-	err := s.DeleteDock(ctx, data.IdUser, data.IdDock)
+	err := s.DeleteDock(ctx, data.IdDock)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// ReplaceDockLogic полностью заменяет содержимое и метаданные документа, сохраняя id и гранты
+func (s *ServiceDocks) ReplaceDockLogic(ctx context.Context, id DockById, data UploadRequest) error {
+	if data.File == nil && data.Json == nil {
+		return storage.Invaliddata
+	}
+	var newFile string
+	hash := pkg.HashContent(data.Json)
+	if data.File != nil {
+		filepath, fileHash, err := pkg.SaveFile(ctx, data.File, s.Blob)
+		if err != nil {
+			return storage.Invaliddata
+		}
+		newFile, hash = filepath, fileHash
+	}
+
+	err := s.WithTx(ctx, func(tx storage.DockTx) error {
+		old, err := tx.GetDockForUpdate(ctx, id.IdDock)
+		if err != nil {
+			return err
+		}
+		// открыть или закрыть документ для всех может только тот, кто управляет доступом
+		if data.Meta.Public != old.Public {
+			if err = s.Authorize(ctx, id, PermManageGrants); err != nil {
+				return err
+			}
+		}
+		d := storage.Dock{
+			Id:       old.Id,
+			IsFile:   newFile != "",
+			Public:   data.Meta.Public,
+			Name:     data.Meta.Name,
+			Mime:     data.Meta.Mime,
+			Json:     data.Json,
+			Filepath: newFile,
+			OwnerId:  old.OwnerId,
+		}
+		if err = tx.UpdateDock(ctx, d); err != nil {
+			return err
+		}
+		// старый файл не удаляем: на него ссылается история версий
+		if _, err = tx.AddVersion(ctx, d, id.IdUser, hash); err != nil {
+			return fmt.Errorf("failed to add version: %w", err)
+		}
+		return nil
+	})
+	if err != nil && newFile != "" {
+		_ = s.Blob.Delete(context.WithoutCancel(ctx), newFile)
+	}
+	return err
+}
+
+// PatchDockLogic применяет merge patch или json patch к json_data документа
+func (s *ServiceDocks) PatchDockLogic(ctx context.Context, id DockById, patch DockPatch) (json.RawMessage, error) {
+	var result json.RawMessage
+	err := s.WithTx(ctx, func(tx storage.DockTx) error {
+		d, err := tx.GetDockForUpdate(ctx, id.IdDock)
+		if err != nil {
+			return err
+		}
+		if d.IsFile {
+			return storage.NotJson
+		}
+		original := []byte(d.Json)
+		if len(original) == 0 {
+			original = []byte("{}")
+		}
+
+		var patched []byte
+		switch patch.Type {
+		case MergePatch:
+			patched, err = jsonpatch.MergePatch(original, patch.Body)
+		case JsonPatch:
+			var p jsonpatch.Patch
+			p, err = jsonpatch.DecodePatch(patch.Body)
+			if err == nil {
+				patched, err = p.Apply(original)
+			}
+		default:
+			return storage.InvalidPatch
+		}
+		if err != nil {
+			return storage.InvalidPatch
+		}
+
+		d.Json = patched
+		if err = tx.UpdateDock(ctx, d); err != nil {
+			return err
+		}
+		if _, err = tx.AddVersion(ctx, d, id.IdUser, pkg.HashContent(d.Json)); err != nil {
+			return fmt.Errorf("failed to add version: %w", err)
+		}
+		result = d.Json
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *ServiceDocks) ListVersionsLogic(ctx context.Context, id DockById) ([]storage.DockVersion, error) {
+	return s.ListVersions(ctx, id.IdDock)
+}
+
+func (s *ServiceDocks) GetVersionLogic(ctx context.Context, id DockById, version int) (storage.DockVersion, error) {
+	return s.GetVersion(ctx, id.IdDock, version)
+}
+
+// RestoreVersionLogic делает содержимое старой версии текущим, записывая его новой версией
+func (s *ServiceDocks) RestoreVersionLogic(ctx context.Context, id DockById, version int) (int, error) {
+	v, err := s.GetVersion(ctx, id.IdDock, version)
+	if err != nil {
+		return 0, err
+	}
+
+	var restored int
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		cur, err := tx.GetDockForUpdate(ctx, id.IdDock)
+		if err != nil {
+			return err
+		}
+		d := storage.Dock{
+			Id:       cur.Id,
+			IsFile:   v.IsFile,
+			Public:   v.Public,
+			Name:     v.Name,
+			Mime:     v.Mime,
+			Json:     v.Json,
+			Filepath: v.Filepath,
+			OwnerId:  cur.OwnerId,
+		}
+		if err = tx.UpdateDock(ctx, d); err != nil {
+			return err
+		}
+		restored, err = tx.AddVersion(ctx, d, id.IdUser, v.ContentHash)
+		if err != nil {
+			return fmt.Errorf("failed to add version: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
+
+// DiffVersionsLogic структурный diff json содержимого двух версий
+func (s *ServiceDocks) DiffVersionsLogic(ctx context.Context, id DockById, from, to int) ([]pkg.DiffOp, error) {
+	a, err := s.GetVersion(ctx, id.IdDock, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.GetVersion(ctx, id.IdDock, to)
+	if err != nil {
+		return nil, err
+	}
+	if a.IsFile || b.IsFile {
+		return nil, storage.NotJson
+	}
+	return pkg.JsonDiff(a.Json, b.Json)
+}
+
+func (s *ServiceDocks) ListGrantsLogic(ctx context.Context, id DockById) ([]storage.Grant, error) {
+	return s.ListGrants(ctx, id.IdDock)
+}
+
+func (s *ServiceDocks) AddGrantsLogic(ctx context.Context, id DockById, logins []string, role Role) error {
+	if len(logins) == 0 {
+		return storage.Invaliddata
+	}
+	return s.WithTx(ctx, func(tx storage.DockTx) error {
+		if _, err := tx.GetDockForUpdate(ctx, id.IdDock); err != nil {
+			return err
+		}
+		_, err := tx.AddGrant(ctx, logins, string(role), id.IdDock)
+		return err
+	})
+}
+
+func (s *ServiceDocks) RevokeGrantLogic(ctx context.Context, id DockById, login string) (int, error) {
+	return s.RevokeGrant(ctx, id.IdDock, login)
+}
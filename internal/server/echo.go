@@ -1,34 +1,117 @@
 package server
 
 import (
+	"context"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"gomodlag/internal/api"
 	"gomodlag/internal/auth"
+	"gomodlag/internal/blob"
 	"gomodlag/internal/cache"
 	"gomodlag/internal/config"
 	"gomodlag/internal/docks"
 	"gomodlag/internal/logger"
 	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"log/slog"
+	"net"
+	"time"
 )
 
-func Start(config config.Config) {
+// NewAuthService сервис аутентификации поверх db без OIDC; его же использует командная строка
+func NewAuthService(config config.Config, db storage.Store, tokens auth.AccessTokens, logg logger.Logger) *auth.ServiceDB {
+	hasher := pkg.PasswordHasher{
+		Algorithm:    config.Password.Algorithm,
+		BcryptCost:   config.Password.BcryptCost,
+		ArgonTime:    uint32(config.Password.ArgonTime),
+		ArgonMemory:  uint32(config.Password.ArgonMemory),
+		ArgonThreads: uint8(config.Password.ArgonThreads),
+	}
+	limits := auth.LoginLimits{
+		UserAttempts: config.Login.UserAttempts,
+		IPAttempts:   config.Login.IPAttempts,
+		LockBase:     30 * time.Second,
+		LockMax:      config.Login.LockMax,
+		Window:       time.Hour,
+	}
+	return &auth.ServiceDB{AuthRegDelModel: db, AdminModel: db, APIKeyModel: db, OIDCModel: db, Logger: logg, AccessTokens: tokens, Hasher: hasher, Limits: limits, TOTPIssuer: config.TOTPIssuer}
+}
+
+// Start поднимает сервер и блокируется до его остановки; ошибка запуска возвращается вызывающему
+func Start(config config.Config) error {
 
 	logg := logger.SetupLogger()
-	dbPool := storage.StructPool{} // твоя реализация
-	pool, err := storage.NewPool(config.DBURL, *logg)
+	store, closeStore, err := storage.Open(config.DBURL, *logg)
+	if err != nil {
+		logg.Error("Open-ERR", slog.String("error", err.Error()))
+		return err
+	}
+	defer closeStore()
+	// у хранилища в памяти схемы нет
+	if db, ok := store.(storage.Migrator); ok && config.AutoMigrate {
+		if _, err = db.MigrateUp(context.Background(), *logg); err != nil {
+			logg.Error("MigrateUp-ERR", slog.String("error", err.Error()))
+			return err
+		}
+	}
+	blobStore, err := blob.NewStore(config)
+	if err != nil {
+		logg.Error("NewStore-ERR", slog.String("error", err.Error()))
+		return err
+	}
+	e, err := New(context.Background(), config, store, blobStore, *logg)
 	if err != nil {
-		logg.Error("NewPool-ERR", err)
+		logg.Error("New-ERR", slog.String("error", err.Error()))
+		return err
 	}
-	dbPool.Pool = pool
+	return e.Start(config.ServerPort)
+}
+
+// New собирает сервер поверх store и blobStore; фоновые задачи работают, пока жив ctx
+func New(ctx context.Context, config config.Config, store storage.Store, blobStore blob.BlobStore, logg logger.Logger) (*echo.Echo, error) {
 	MemCache := cache.NewMemoryCache(config.CacheTTL)
-	authService := &auth.ServiceDB{&dbPool, *logg, &dbPool}
-	dockService := &docks.ServiceDocks{&dbPool, *logg}
 
-	authHandler := &api.AuthRegDelHandler{authService, *logg}
-	dockHandler := &api.DockHandler{dockService, MemCache, *logg}
+	var tokens auth.AccessTokens = auth.DBTokens{TokenValidator: store}
+	if config.TokenMode == "jwt" {
+		jwtTokens, err := auth.NewJWTTokens(config.JWT.Keys, config.JWT.KeyId, store)
+		if err != nil {
+			logg.Error("NewJWTTokens-ERR", slog.String("error", err.Error()))
+			return nil, err
+		}
+		if err = jwtTokens.SyncRevoked(ctx); err != nil {
+			logg.Error("SyncRevoked-ERR", slog.String("error", err.Error()))
+		}
+		go jwtTokens.RunRevocationSync(ctx, config.JWT.RevocationSync)
+		tokens = jwtTokens
+	}
+	authService := NewAuthService(config, store, tokens, logg)
+	if config.OIDC.Issuer != "" {
+		var err error
+		authService.OIDC, err = auth.NewOIDCProvider(ctx, config.OIDC.Issuer, config.OIDC.ClientId,
+			config.OIDC.ClientSecret, config.OIDC.RedirectURL, config.OIDC.Provision)
+		if err != nil {
+			// вход по паролю работает и без провайдера
+			logg.Error("NewOIDCProvider-ERR", slog.String("error", err.Error()))
+		}
+	}
+	dockService := &docks.ServiceDocks{DockModel: store, Logger: logg, Blob: blobStore}
+	blobGC := &docks.BlobGC{BlobGCModel: store, Blob: blobStore, Logger: logg, Grace: config.BlobGC.Grace}
+	go blobGC.Run(ctx, config.BlobGC.Interval, config.BlobGC.OrphanInterval)
+
+	if config.BootstrapAdmin.Login != "" {
+		if _, err := authService.BootstrapAdmin(ctx, config.BootstrapAdmin.Login, config.BootstrapAdmin.Password); err != nil {
+			logg.Error("BootstrapAdmin-ERR", slog.String("error", err.Error()))
+		}
+	}
+
+	authHandler := &api.AuthRegDelHandler{AuthRegDelLogic: authService, Cache: MemCache, Logger: logg, SessionCookie: config.SessionCookie}
+	dockHandler := &api.DockHandler{DockLogic: dockService, Cache: MemCache, Logger: logg, CacheFileMax: config.CacheFileMax}
+
+	// токен сессии или API ключ
+	authRequired := api.AuthTokenRequired(tokens, authService)
 
 	e := echo.New()
+	e.IPExtractor = ipExtractor(config.TrustedProxies)
 
 	e.Use(middleware.Logger(), middleware.Recover())
 
@@ -38,23 +121,107 @@ func Start(config config.Config) {
 	API.POST("/register", func(c echo.Context) error {
 		return authHandler.RegisterHandler(c, config.AdminToken)
 	})
+	tokenTTL := auth.TokenTTL{Access: config.DockTTL, Refresh: config.RefreshTTL}
 	API.POST("/auth", func(c echo.Context) error {
-		return authHandler.AuthHandler(c, config.DockTTL)
+		return authHandler.AuthHandler(c, tokenTTL)
+	})
+	API.POST("/auth/2fa", func(c echo.Context) error {
+		return authHandler.TwoFactorHandler(c, tokenTTL)
+	})
+	API.POST("/auth/refresh", func(c echo.Context) error {
+		return authHandler.RefreshHandler(c, tokenTTL)
 	})
 	API.POST("/auth/:token", authHandler.LogOutHandler)
+	API.GET("/auth/oidc/login", authHandler.OIDCLoginHandler)
+	API.GET("/auth/oidc/callback", func(c echo.Context) error {
+		return authHandler.OIDCCallbackHandler(c, tokenTTL)
+	})
+
+	// сессии пользователя
+	sessions := API.Group("/sessions", authRequired, api.SessionRequired())
+	sessions.GET("", authHandler.ListSessionsHandler)
+	sessions.DELETE("", authHandler.LogoutAllHandler)
+	sessions.DELETE("/:id", authHandler.DeleteSessionHandler)
+
+	// сброс пароля по токену от администратора
+	API.POST("/auth/reset", authHandler.ResetPasswordHandler)
+
+	// аккаунт
+	account := API.Group("/account", authRequired, api.SessionRequired())
+	account.POST("/password", authHandler.ChangePasswordHandler)
+	account.POST("/2fa/enroll", authHandler.EnrollTOTPHandler)
+	account.POST("/2fa/confirm", authHandler.ConfirmTOTPHandler)
+	account.POST("/oidc/link", authHandler.OIDCLinkHandler)
+	account.GET("/export", dockHandler.ExportHandler)
+	account.DELETE("", authHandler.DeleteAccountHandler)
+
+	// администрирование
+	adminHandler := &api.AdminHandler{AdminLogic: authService, GC: blobGC, Cache: MemCache, Logger: logg}
+	admin := API.Group("/admin", authRequired, api.SessionRequired(), api.AdminRequired(store))
+	admin.GET("/users", adminHandler.ListUsersHandler)
+	admin.POST("/users", adminHandler.CreateUserHandler)
+	admin.DELETE("/users/:login", adminHandler.DeleteUserHandler)
+	admin.POST("/users/:login/disable", func(c echo.Context) error {
+		return adminHandler.SetDisabledHandler(c, true)
+	})
+	admin.POST("/users/:login/enable", func(c echo.Context) error {
+		return adminHandler.SetDisabledHandler(c, false)
+	})
+	admin.POST("/users/:login/reset", func(c echo.Context) error {
+		return adminHandler.ResetHandler(c, config.ResetTTL)
+	})
+	admin.POST("/users/:login/unlock", adminHandler.UnlockHandler)
+	admin.GET("/audit", adminHandler.AuditHandler)
+	admin.GET("/blobs/orphans", adminHandler.OrphansHandler)
+
+	// API ключи
+	keysHandler := &api.KeysHandler{APIKeyLogic: authService, Logger: logg}
+	keys := API.Group("/keys", authRequired, api.SessionRequired())
+	keys.GET("", keysHandler.ListKeysHandler)
+	keys.POST("", keysHandler.CreateKeyHandler)
+	keys.DELETE("/:id", keysHandler.DeleteKeyHandler)
 
 	// маршруты для docs
 	docs := API.Group("/docs")
 
-	docs.POST("", func(c echo.Context) error {
-		return dockHandler.UploadDocHandler(c, &dbPool)
-	})
+	docs.POST("", dockHandler.UploadDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsWrite))
+
+	docs.GET("", dockHandler.ListDocsHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.HEAD("", dockHandler.ListDocsHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.GET("/:id", dockHandler.GetDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.HEAD("/:id", dockHandler.GetDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.DELETE("/:id", dockHandler.DeleteDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsWrite))
+	docs.PUT("/:id", dockHandler.ReplaceDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsWrite))
+	docs.PATCH("/:id", dockHandler.PatchDocHandler, authRequired, api.ScopeRequired(auth.ScopeDocsWrite))
+
+	// публичные документы без токена
+	API.GET("/public/docs/:id", dockHandler.PublicDocHandler)
+	API.HEAD("/public/docs/:id", dockHandler.PublicDocHandler)
+
+	// история версий
+	docs.GET("/:id/versions", dockHandler.ListVersionsHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.GET("/:id/versions/:n", dockHandler.GetVersionHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.POST("/:id/versions/:n/restore", dockHandler.RestoreVersionHandler, authRequired, api.ScopeRequired(auth.ScopeDocsWrite))
+	docs.GET("/:id/diff", dockHandler.DiffVersionsHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
 
-	docs.GET("", dockHandler.ListDocsHandler, api.AuthTokenRequired(&dbPool))
-	docs.HEAD("", dockHandler.ListDocsHandler, api.AuthTokenRequired(&dbPool))
-	docs.GET("/:id", dockHandler.GetDocHandler, api.AuthTokenRequired(&dbPool))
-	docs.HEAD("/:id", dockHandler.GetDocHandler, api.AuthTokenRequired(&dbPool))
-	docs.DELETE("/:id", dockHandler.DeleteDocHandler, api.AuthTokenRequired(&dbPool))
+	// гранты
+	docs.GET("/:id/grants", dockHandler.ListGrantsHandler, authRequired, api.ScopeRequired(auth.ScopeDocsRead))
+	docs.POST("/:id/grants", dockHandler.AddGrantsHandler, authRequired, api.ScopeRequired(auth.ScopeGrantsManage))
+	docs.DELETE("/:id/grants/:login", dockHandler.RevokeGrantHandler, authRequired, api.ScopeRequired(auth.ScopeGrantsManage))
 
-	e.Logger.Fatal(e.Start(config.ServerPort))
+	return e, nil
+}
+
+// ipExtractor ip клиента для блокировок входа и sessions.ip. X-Forwarded-For подделывает кто угодно,
+// поэтому он читается только за прокси из trusted, иначе берется адрес соединения
+func ipExtractor(trusted []*net.IPNet) echo.IPExtractor {
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	// по умолчанию echo доверяет еще loopback и частным сетям
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipNet := range trusted {
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
 }
@@ -0,0 +1,1370 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Memory хранилище в памяти с той же семантикой, что StructPool: для тестов и демо без базы.
+// Читатели работают со снимком под RWMutex. Писатели (и транзакции WithTx) идут по одному:
+// писатель работает с копией данных и подменяет ими снимок, если не вернул ошибку
+type Memory struct {
+	// writer занят писателем
+	writer chan struct{}
+	readMu sync.RWMutex
+	data   *memData
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		writer: make(chan struct{}, 1),
+		data:   newMemData(),
+	}
+}
+
+type memUser struct {
+	User
+	PassHash string
+}
+
+type memSession struct {
+	Id             int
+	UserId         int
+	Token          string
+	CreatedAt      time.Time
+	AccessExpireAt time.Time
+	ExpireAt       time.Time
+	UserAgent      string
+	IP             string
+}
+
+type memRefresh struct {
+	SessionId int
+	CreatedAt time.Time
+	ExpireAt  time.Time
+	UsedAt    *time.Time
+}
+
+type memReset struct {
+	UserId   int
+	ExpireAt time.Time
+	UsedAt   *time.Time
+}
+
+type memAttempt struct {
+	Failures    int
+	UpdatedAt   time.Time
+	LockedUntil time.Time
+}
+
+type memRecovery struct {
+	UserId int
+	Hash   string
+}
+
+type memChallenge struct {
+	UserId   int
+	Attempts int
+	ExpireAt time.Time
+}
+
+type memAPIKey struct {
+	APIKey
+	Hash string
+}
+
+type memIdentity struct {
+	Issuer  string
+	Subject string
+}
+
+type memBlobDeletion struct {
+	CreatedAt time.Time
+	Attempts  int
+	LastError string
+}
+
+type memDock struct {
+	Dock
+	CreatedAt time.Time
+}
+
+type memGrantKey struct {
+	Dock uuid.UUID
+	User int
+}
+
+type memGrant struct {
+	Role      string
+	CreatedAt time.Time
+}
+
+type memVersion struct {
+	Dock
+	Version   int
+	AuthorId  int
+	Hash      string
+	CreatedAt time.Time
+}
+
+// memData все таблицы; значения хранятся копиями, срезы внутри не меняются на месте
+type memData struct {
+	users      map[int]memUser
+	sessions   map[int]memSession
+	refresh    map[string]memRefresh
+	resets     map[string]memReset
+	attempts   map[string]memAttempt
+	totp       map[int]TOTP
+	recovery   map[memRecovery]bool
+	challenges map[string]memChallenge
+	audit      []AuditEntry
+	revoked    map[string]time.Time
+	apiKeys    map[int]memAPIKey
+	identities map[memIdentity]int
+	oidc       map[string]OIDCLogin
+	blobs      map[string]memBlobDeletion
+	docs       map[uuid.UUID]memDock
+	grants     map[memGrantKey]memGrant
+	versions   map[uuid.UUID][]memVersion
+	// последние выданные id (SERIAL)
+	lastUser, lastSession, lastKey, lastAudit int
+}
+
+func newMemData() *memData {
+	return &memData{
+		users:      map[int]memUser{},
+		sessions:   map[int]memSession{},
+		refresh:    map[string]memRefresh{},
+		resets:     map[string]memReset{},
+		attempts:   map[string]memAttempt{},
+		totp:       map[int]TOTP{},
+		recovery:   map[memRecovery]bool{},
+		challenges: map[string]memChallenge{},
+		revoked:    map[string]time.Time{},
+		apiKeys:    map[int]memAPIKey{},
+		identities: map[memIdentity]int{},
+		oidc:       map[string]OIDCLogin{},
+		blobs:      map[string]memBlobDeletion{},
+		docs:       map[uuid.UUID]memDock{},
+		grants:     map[memGrantKey]memGrant{},
+		versions:   map[uuid.UUID][]memVersion{},
+	}
+}
+
+func (d *memData) clone() *memData {
+	c := *d
+	c.users = maps.Clone(d.users)
+	c.sessions = maps.Clone(d.sessions)
+	c.refresh = maps.Clone(d.refresh)
+	c.resets = maps.Clone(d.resets)
+	c.attempts = maps.Clone(d.attempts)
+	c.totp = maps.Clone(d.totp)
+	c.recovery = maps.Clone(d.recovery)
+	c.challenges = maps.Clone(d.challenges)
+	c.audit = slices.Clone(d.audit)
+	c.revoked = maps.Clone(d.revoked)
+	c.apiKeys = maps.Clone(d.apiKeys)
+	c.identities = maps.Clone(d.identities)
+	c.oidc = maps.Clone(d.oidc)
+	c.blobs = maps.Clone(d.blobs)
+	c.docs = maps.Clone(d.docs)
+	c.grants = maps.Clone(d.grants)
+	c.versions = make(map[uuid.UUID][]memVersion, len(d.versions))
+	for id, v := range d.versions {
+		c.versions[id] = slices.Clone(v)
+	}
+	return &c
+}
+
+// lock занимает писателя; ждет не дольше ctx
+func (m *Memory) lock(ctx context.Context) error {
+	select {
+	case m.writer <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Memory) unlock() { <-m.writer }
+
+// read выполняет fn над текущим снимком
+func (m *Memory) read(fn func(d *memData) error) error {
+	m.readMu.RLock()
+	defer m.readMu.RUnlock()
+	return fn(m.data)
+}
+
+// write выполняет fn над копией снимка и публикует ее, если fn не вернула ошибку
+func (m *Memory) write(ctx context.Context, fn func(d *memData) error) error {
+	if err := m.lock(ctx); err != nil {
+		return SomeWrong
+	}
+	defer m.unlock()
+	d := m.snapshot().clone()
+	if err := fn(d); err != nil {
+		return err
+	}
+	m.publish(d)
+	return nil
+}
+
+func (m *Memory) snapshot() *memData {
+	m.readMu.RLock()
+	defer m.readMu.RUnlock()
+	return m.data
+}
+
+func (m *Memory) publish(d *memData) {
+	m.readMu.Lock()
+	m.data = d
+	m.readMu.Unlock()
+}
+
+// memDockTx операции WithTx над копией данных писателя
+type memDockTx struct {
+	d *memData
+}
+
+// WithTx выполняет fn как писатель: изменения публикуются, только если fn не вернула ошибку.
+// Писатели идут по одному, конфликтов и повторов нет
+func (m *Memory) WithTx(ctx context.Context, fn func(tx DockTx) error) error {
+	return m.write(ctx, func(d *memData) error { return fn(memDockTx{d: d}) })
+}
+
+func (d *memData) userByLogin(username string) (memUser, bool) {
+	for _, u := range d.users {
+		if u.Login == username {
+			return u, true
+		}
+	}
+	return memUser{}, false
+}
+
+// revokeSessions удаляет сессии match вместе с refresh токенами; еще не истекшие access токены
+// попадают в revoked
+func (d *memData) revokeSessions(match func(s memSession) bool) int {
+	now := time.Now()
+	n := 0
+	for id, s := range d.sessions {
+		if !match(s) {
+			continue
+		}
+		delete(d.sessions, id)
+		maps.DeleteFunc(d.refresh, func(_ string, r memRefresh) bool { return r.SessionId == id })
+		if _, ok := d.revoked[s.Token]; !ok && s.AccessExpireAt.After(now) {
+			d.revoked[s.Token] = s.AccessExpireAt
+		}
+		n++
+	}
+	return n
+}
+
+// deleteDocks удаляет документы match с грантами и версиями и ставит их файлы в очередь на удаление
+func (d *memData) deleteDocks(match func(doc memDock) bool) ([]uuid.UUID, []string) {
+	now := time.Now()
+	var ids []uuid.UUID
+	var files []string
+	queue := func(key string) {
+		if key == "" || slices.Contains(files, key) {
+			return
+		}
+		files = append(files, key)
+		if _, ok := d.blobs[key]; !ok {
+			d.blobs[key] = memBlobDeletion{CreatedAt: now}
+		}
+	}
+	for id, doc := range d.docs {
+		if !match(doc) {
+			continue
+		}
+		ids = append(ids, id)
+		queue(doc.Filepath)
+		for _, v := range d.versions[id] {
+			queue(v.Filepath)
+		}
+		delete(d.docs, id)
+		delete(d.versions, id)
+		maps.DeleteFunc(d.grants, func(k memGrantKey, _ memGrant) bool { return k.Dock == id })
+	}
+	return ids, files
+}
+
+// deleteUser удаляет пользователя со всем, что ссылается на него (как ON DELETE CASCADE / SET NULL)
+func (d *memData) deleteUser(id int) DeletedUser {
+	var deleted DeletedUser
+	deleted.Documents, deleted.Files = d.deleteDocks(func(doc memDock) bool { return doc.OwnerId == id })
+	d.revokeSessions(func(s memSession) bool { return s.UserId == id })
+	delete(d.users, id)
+	delete(d.totp, id)
+	maps.DeleteFunc(d.resets, func(_ string, r memReset) bool { return r.UserId == id })
+	maps.DeleteFunc(d.recovery, func(k memRecovery, _ bool) bool { return k.UserId == id })
+	maps.DeleteFunc(d.challenges, func(_ string, c memChallenge) bool { return c.UserId == id })
+	maps.DeleteFunc(d.apiKeys, func(_ int, k memAPIKey) bool { return k.UserId == id })
+	maps.DeleteFunc(d.identities, func(_ memIdentity, u int) bool { return u == id })
+	maps.DeleteFunc(d.oidc, func(_ string, l OIDCLogin) bool { return l.LinkUserId == id })
+	maps.DeleteFunc(d.grants, func(k memGrantKey, _ memGrant) bool { return k.User == id })
+	for doc, versions := range d.versions {
+		for i := range versions {
+			if versions[i].AuthorId == id {
+				versions[i].AuthorId = 0
+			}
+		}
+		d.versions[doc] = versions
+	}
+	return deleted
+}
+
+func (m *Memory) Register(ctx context.Context, password, username string) (string, error) {
+	err := m.write(ctx, func(d *memData) error {
+		if _, ok := d.userByLogin(username); ok {
+			return Invaliddata
+		}
+		d.lastUser++
+		d.users[d.lastUser] = memUser{User: User{Id: d.lastUser, Login: username, Role: RoleUser, CreatedAt: time.Now()}, PassHash: password}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+func (m *Memory) GetCredentials(_ context.Context, username string) (int, string, error) {
+	var id int
+	var hash string
+	err := m.read(func(d *memData) error {
+		u, ok := d.userByLogin(username)
+		if !ok || u.Disabled {
+			return Invaliddata
+		}
+		id, hash = u.Id, u.PassHash
+		return nil
+	})
+	return id, hash, err
+}
+
+func (m *Memory) UpdatePasswordHash(ctx context.Context, idUser int, hash string) error {
+	return m.write(ctx, func(d *memData) error {
+		if u, ok := d.users[idUser]; ok {
+			u.PassHash = hash
+			d.users[idUser] = u
+		}
+		return nil
+	})
+}
+
+func (m *Memory) GetPasswordHash(_ context.Context, idUser int) (string, error) {
+	var hash string
+	err := m.read(func(d *memData) error {
+		u, ok := d.users[idUser]
+		if !ok {
+			return Invaliddata
+		}
+		hash = u.PassHash
+		return nil
+	})
+	return hash, err
+}
+
+func (m *Memory) ChangePassword(ctx context.Context, idUser int, hash string, keepToken string) error {
+	return m.write(ctx, func(d *memData) error {
+		if u, ok := d.users[idUser]; ok {
+			u.PassHash = hash
+			d.users[idUser] = u
+		}
+		d.revokeSessions(func(s memSession) bool { return s.UserId == idUser && s.Token != keepToken })
+		return nil
+	})
+}
+
+func (m *Memory) CreateResetToken(ctx context.Context, username string, token Token) error {
+	return m.write(ctx, func(d *memData) error {
+		u, ok := d.userByLogin(username)
+		if !ok {
+			return UnknownUser
+		}
+		if _, ok = d.resets[token.Token]; ok {
+			return SomeWrong
+		}
+		d.resets[token.Token] = memReset{UserId: u.Id, ExpireAt: token.TimeExpired}
+		return nil
+	})
+}
+
+func (m *Memory) UseResetToken(ctx context.Context, tokenHash string, passHash string) (int, error) {
+	var userId int
+	err := m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		r, ok := d.resets[tokenHash]
+		if !ok || r.UsedAt != nil || !r.ExpireAt.After(now) {
+			return Invalidtoken
+		}
+		r.UsedAt = &now
+		d.resets[tokenHash] = r
+		userId = r.UserId
+		if u, ok := d.users[userId]; ok {
+			u.PassHash = passHash
+			d.users[userId] = u
+		}
+		d.revokeSessions(func(s memSession) bool { return s.UserId == userId })
+		return nil
+	})
+	return userId, err
+}
+
+func (m *Memory) GetLoginLocks(_ context.Context, subjects ...string) (map[string]time.Time, error) {
+	locks := map[string]time.Time{}
+	err := m.read(func(d *memData) error {
+		now := time.Now()
+		for _, subject := range subjects {
+			if a, ok := d.attempts[subject]; ok && a.LockedUntil.After(now) {
+				locks[subject] = a.LockedUntil
+			}
+		}
+		return nil
+	})
+	return locks, err
+}
+
+func (m *Memory) AddLoginFailure(ctx context.Context, subject string, window time.Duration) (int, error) {
+	var failures int
+	err := m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		a, ok := d.attempts[subject]
+		if !ok || a.UpdatedAt.Before(now.Add(-window)) {
+			a.Failures = 0
+		}
+		a.Failures++
+		a.UpdatedAt = now
+		d.attempts[subject] = a
+		failures = a.Failures
+		return nil
+	})
+	return failures, err
+}
+
+func (m *Memory) LockLogin(ctx context.Context, subject string, until time.Time) error {
+	return m.write(ctx, func(d *memData) error {
+		if a, ok := d.attempts[subject]; ok {
+			a.LockedUntil = until
+			d.attempts[subject] = a
+		}
+		return nil
+	})
+}
+
+func (m *Memory) ResetLoginFailures(ctx context.Context, subject string) error {
+	return m.write(ctx, func(d *memData) error {
+		delete(d.attempts, subject)
+		return nil
+	})
+}
+
+func (m *Memory) GetLogin(_ context.Context, idUser int) (string, error) {
+	var login string
+	err := m.read(func(d *memData) error {
+		u, ok := d.users[idUser]
+		if !ok {
+			return Invaliddata
+		}
+		login = u.Login
+		return nil
+	})
+	return login, err
+}
+
+func (m *Memory) GetTOTP(_ context.Context, idUser int) (TOTP, error) {
+	var t TOTP
+	err := m.read(func(d *memData) error {
+		var ok bool
+		if t, ok = d.totp[idUser]; !ok {
+			return Invaliddata
+		}
+		return nil
+	})
+	return t, err
+}
+
+func (m *Memory) SaveTOTPSecret(ctx context.Context, idUser int, secret string) error {
+	return m.write(ctx, func(d *memData) error {
+		if _, ok := d.users[idUser]; !ok {
+			return SomeWrong
+		}
+		if t, ok := d.totp[idUser]; ok && t.Confirmed {
+			return Forbidden
+		}
+		d.totp[idUser] = TOTP{Secret: secret}
+		return nil
+	})
+}
+
+func (m *Memory) ConfirmTOTP(ctx context.Context, idUser int, step int64, recoveryHashes []string) error {
+	return m.write(ctx, func(d *memData) error {
+		t, ok := d.totp[idUser]
+		if !ok || t.Confirmed {
+			return Invaliddata
+		}
+		t.Confirmed, t.LastStep = true, step
+		d.totp[idUser] = t
+		maps.DeleteFunc(d.recovery, func(k memRecovery, _ bool) bool { return k.UserId == idUser })
+		for _, hash := range recoveryHashes {
+			d.recovery[memRecovery{UserId: idUser, Hash: hash}] = false
+		}
+		return nil
+	})
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, idUser int, step int64) error {
+	return m.write(ctx, func(d *memData) error {
+		t, ok := d.totp[idUser]
+		if !ok || t.LastStep >= step {
+			return Invalidtoken
+		}
+		t.LastStep = step
+		d.totp[idUser] = t
+		return nil
+	})
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, idUser int, codeHash string) error {
+	return m.write(ctx, func(d *memData) error {
+		key := memRecovery{UserId: idUser, Hash: codeHash}
+		if used, ok := d.recovery[key]; !ok || used {
+			return Invalidtoken
+		}
+		d.recovery[key] = true
+		return nil
+	})
+}
+
+func (m *Memory) CreateChallenge(ctx context.Context, idUser int, token Token) error {
+	return m.write(ctx, func(d *memData) error {
+		if _, ok := d.challenges[token.Token]; ok {
+			return SomeWrong
+		}
+		d.challenges[token.Token] = memChallenge{UserId: idUser, ExpireAt: token.TimeExpired}
+		return nil
+	})
+}
+
+func (m *Memory) UseChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	var userId int
+	err := m.write(ctx, func(d *memData) error {
+		c, ok := d.challenges[tokenHash]
+		if !ok || !c.ExpireAt.After(time.Now()) || c.Attempts >= maxAttempts {
+			return Invalidtoken
+		}
+		c.Attempts++
+		d.challenges[tokenHash] = c
+		userId = c.UserId
+		return nil
+	})
+	return userId, err
+}
+
+func (m *Memory) DeleteChallenge(ctx context.Context, tokenHash string) error {
+	return m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		maps.DeleteFunc(d.challenges, func(hash string, c memChallenge) bool {
+			return hash == tokenHash || c.ExpireAt.Before(now)
+		})
+		return nil
+	})
+}
+
+func (m *Memory) CreateSession(ctx context.Context, idUser int, access Token, refresh Token, meta SessionMeta) error {
+	return m.write(ctx, func(d *memData) error {
+		if _, ok := d.users[idUser]; !ok {
+			return SomeWrong
+		}
+		for _, s := range d.sessions {
+			if s.Token == access.Token {
+				return SomeWrong
+			}
+		}
+		if _, ok := d.refresh[refresh.Token]; ok {
+			return SomeWrong
+		}
+		d.lastSession++
+		d.sessions[d.lastSession] = memSession{
+			Id:             d.lastSession,
+			UserId:         idUser,
+			Token:          access.Token,
+			CreatedAt:      access.TimeCreated,
+			AccessExpireAt: access.TimeExpired,
+			ExpireAt:       refresh.TimeExpired,
+			UserAgent:      meta.UserAgent,
+			IP:             meta.IP,
+		}
+		d.refresh[refresh.Token] = memRefresh{SessionId: d.lastSession, CreatedAt: refresh.TimeCreated, ExpireAt: refresh.TimeExpired}
+		return nil
+	})
+}
+
+func (m *Memory) RotateRefreshToken(ctx context.Context, refreshHash string, access Token, refresh Token) (int, error) {
+	var userId int
+	reused := false
+	err := m.write(ctx, func(d *memData) error {
+		r, ok := d.refresh[refreshHash]
+		if !ok {
+			return Invalidtoken
+		}
+		s, ok := d.sessions[r.SessionId]
+		if !ok {
+			return Invalidtoken
+		}
+		if r.UsedAt != nil {
+			// токен уже обменивали: завершаем сессию целиком, изменения сохраняются
+			d.revokeSessions(func(o memSession) bool { return o.Id == s.Id })
+			reused = true
+			return nil
+		}
+		if time.Since(r.ExpireAt) > 0 {
+			return Invalidtoken
+		}
+		usedAt := refresh.TimeCreated
+		r.UsedAt = &usedAt
+		d.refresh[refreshHash] = r
+		d.refresh[refresh.Token] = memRefresh{SessionId: s.Id, CreatedAt: refresh.TimeCreated, ExpireAt: refresh.TimeExpired}
+		s.Token, s.AccessExpireAt, s.ExpireAt = access.Token, access.TimeExpired, refresh.TimeExpired
+		d.sessions[s.Id] = s
+		userId = s.UserId
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if reused {
+		return 0, TokenReused
+	}
+	return userId, nil
+}
+
+func (m *Memory) ValidateToken(_ context.Context, token string) (int, error) {
+	var userId int
+	err := m.read(func(d *memData) error {
+		for _, s := range d.sessions {
+			if s.Token != token {
+				continue
+			}
+			if u, ok := d.users[s.UserId]; !ok || u.Disabled {
+				return Invalidtoken
+			}
+			// истекшие сессии удаляет PurgeExpired
+			if time.Since(s.AccessExpireAt) > 0 {
+				return Invalidtoken
+			}
+			userId = s.UserId
+			return nil
+		}
+		return Invalidtoken
+	})
+	return userId, err
+}
+
+func (m *Memory) DeleteToken(ctx context.Context, token string) error {
+	return m.write(ctx, func(d *memData) error {
+		d.revokeSessions(func(s memSession) bool { return s.Token == token })
+		return nil
+	})
+}
+
+func (m *Memory) ListRevoked(ctx context.Context) ([]string, error) {
+	results := []string{}
+	err := m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		maps.DeleteFunc(d.revoked, func(_ string, expire time.Time) bool { return !expire.After(now) })
+		for token := range d.revoked {
+			results = append(results, token)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (m *Memory) ListSessions(_ context.Context, idUser int, currentToken string) ([]Session, error) {
+	results := []Session{}
+	err := m.read(func(d *memData) error {
+		now := time.Now()
+		for _, s := range d.sessions {
+			if s.UserId != idUser || !s.ExpireAt.After(now) {
+				continue
+			}
+			results = append(results, Session{Id: s.Id, CreatedAt: s.CreatedAt, ExpireAt: s.ExpireAt,
+				UserAgent: s.UserAgent, IP: s.IP, Current: s.Token == currentToken})
+		}
+		return nil
+	})
+	slices.SortFunc(results, func(a, b Session) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return results, err
+}
+
+func (m *Memory) DeleteSessionById(ctx context.Context, idUser int, idSession int) error {
+	return m.write(ctx, func(d *memData) error {
+		if d.revokeSessions(func(s memSession) bool { return s.Id == idSession && s.UserId == idUser }) == 0 {
+			return Invaliddata
+		}
+		return nil
+	})
+}
+
+func (m *Memory) DeleteUserSessions(ctx context.Context, idUser int) error {
+	return m.write(ctx, func(d *memData) error {
+		d.revokeSessions(func(s memSession) bool { return s.UserId == idUser })
+		return nil
+	})
+}
+
+func (m *Memory) PurgeExpired(ctx context.Context) (int, error) {
+	var n int
+	err := m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		for id, s := range d.sessions {
+			if !s.ExpireAt.After(now) {
+				delete(d.sessions, id)
+				maps.DeleteFunc(d.refresh, func(_ string, r memRefresh) bool { return r.SessionId == id })
+				n++
+			}
+		}
+		maps.DeleteFunc(d.resets, func(_ string, r memReset) bool { return !r.ExpireAt.After(now) })
+		maps.DeleteFunc(d.challenges, func(_ string, c memChallenge) bool { return !c.ExpireAt.After(now) })
+		maps.DeleteFunc(d.oidc, func(_ string, l OIDCLogin) bool { return !l.ExpireAt.After(now) })
+		maps.DeleteFunc(d.revoked, func(_ string, expire time.Time) bool { return !expire.After(now) })
+		return nil
+	})
+	return n, err
+}
+
+func (m *Memory) DeleteAccount(ctx context.Context, idUser int) (DeletedUser, error) {
+	var deleted DeletedUser
+	err := m.write(ctx, func(d *memData) error {
+		if _, ok := d.users[idUser]; !ok {
+			return UnknownUser
+		}
+		deleted = d.deleteUser(idUser)
+		return nil
+	})
+	return deleted, err
+}
+
+func (m *Memory) GetUser(_ context.Context, idUser int) (User, error) {
+	var u User
+	err := m.read(func(d *memData) error {
+		mu, ok := d.users[idUser]
+		if !ok {
+			return UnknownUser
+		}
+		u = mu.User
+		return nil
+	})
+	return u, err
+}
+
+func (m *Memory) GetUserByLogin(_ context.Context, username string) (User, error) {
+	var u User
+	err := m.read(func(d *memData) error {
+		mu, ok := d.userByLogin(username)
+		if !ok {
+			return UnknownUser
+		}
+		u = mu.User
+		return nil
+	})
+	return u, err
+}
+
+func (m *Memory) ListUsers(_ context.Context) ([]User, error) {
+	results := []User{}
+	err := m.read(func(d *memData) error {
+		for _, u := range d.users {
+			results = append(results, u.User)
+		}
+		return nil
+	})
+	slices.SortFunc(results, func(a, b User) int { return a.Id - b.Id })
+	return results, err
+}
+
+func (m *Memory) CreateUser(ctx context.Context, username, passHash, role string) (User, error) {
+	var u User
+	err := m.write(ctx, func(d *memData) error {
+		if _, ok := d.userByLogin(username); ok {
+			return Invaliddata
+		}
+		d.lastUser++
+		u = User{Id: d.lastUser, Login: username, Role: role, CreatedAt: time.Now()}
+		d.users[u.Id] = memUser{User: u, PassHash: passHash}
+		return nil
+	})
+	return u, err
+}
+
+func (m *Memory) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	return m.write(ctx, func(d *memData) error {
+		u, ok := d.userByLogin(username)
+		if !ok {
+			return UnknownUser
+		}
+		u.Disabled = disabled
+		d.users[u.Id] = u
+		if disabled {
+			d.revokeSessions(func(s memSession) bool { return s.UserId == u.Id })
+		}
+		return nil
+	})
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, username string) (DeletedUser, error) {
+	var deleted DeletedUser
+	err := m.write(ctx, func(d *memData) error {
+		u, ok := d.userByLogin(username)
+		if !ok {
+			return UnknownUser
+		}
+		deleted = d.deleteUser(u.Id)
+		return nil
+	})
+	return deleted, err
+}
+
+func (m *Memory) HasAdmin(_ context.Context) (bool, error) {
+	exists := false
+	err := m.read(func(d *memData) error {
+		for _, u := range d.users {
+			if u.Role == RoleAdmin {
+				exists = true
+			}
+		}
+		return nil
+	})
+	return exists, err
+}
+
+func (m *Memory) AddAudit(ctx context.Context, idAdmin int, action, target string) error {
+	return m.write(ctx, func(d *memData) error {
+		login := SystemLogin
+		if idAdmin != SystemAdmin {
+			u, ok := d.users[idAdmin]
+			if !ok {
+				return nil
+			}
+			login = u.Login
+		}
+		d.lastAudit++
+		d.audit = append(d.audit, AuditEntry{Id: d.lastAudit, Admin: login, Action: action, Target: target, CreatedAt: time.Now()})
+		return nil
+	})
+}
+
+func (m *Memory) ListAudit(_ context.Context, limit int) ([]AuditEntry, error) {
+	results := []AuditEntry{}
+	err := m.read(func(d *memData) error {
+		for i := len(d.audit) - 1; i >= 0 && len(results) < limit; i-- {
+			results = append(results, d.audit[i])
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (t memDockTx) NewDocs(_ context.Context, dock Dock) (bool, error) {
+	d := t.d
+	if _, ok := d.docs[dock.Id]; ok {
+		return false, fmt.Errorf("document %s already exists", dock.Id)
+	}
+	if _, ok := d.users[dock.OwnerId]; !ok {
+		return false, fmt.Errorf("unknown owner %d", dock.OwnerId)
+	}
+	d.docs[dock.Id] = memDock{Dock: dock, CreatedAt: time.Now()}
+	return true, nil
+}
+
+func (t memDockTx) AddGrant(_ context.Context, grants []string, role string, docid uuid.UUID) (bool, error) {
+	d := t.d
+	ids := make([]int, 0, len(grants))
+	unknown := []string{}
+	for _, grant := range grants {
+		u, ok := d.userByLogin(grant)
+		if !ok {
+			unknown = append(unknown, grant)
+			continue
+		}
+		ids = append(ids, u.Id)
+	}
+	if len(unknown) > 0 {
+		return false, fmt.Errorf("%w: %s", UnknownUser, strings.Join(unknown, ", "))
+	}
+	if len(ids) == 0 {
+		return true, nil
+	}
+	if _, ok := d.docs[docid]; !ok {
+		return false, fmt.Errorf("unknown document %s", docid)
+	}
+	for _, id := range ids {
+		key := memGrantKey{Dock: docid, User: id}
+		g, ok := d.grants[key]
+		if !ok {
+			g.CreatedAt = time.Now()
+		}
+		g.Role = role
+		d.grants[key] = g
+	}
+	return true, nil
+}
+
+func (m *Memory) ListGrants(_ context.Context, idDock uuid.UUID) ([]Grant, error) {
+	results := []Grant{}
+	err := m.read(func(d *memData) error {
+		for k, g := range d.grants {
+			if k.Dock == idDock {
+				results = append(results, Grant{Login: d.users[k.User].Login, Role: g.Role, CreatedAt: g.CreatedAt})
+			}
+		}
+		return nil
+	})
+	slices.SortFunc(results, func(a, b Grant) int { return strings.Compare(a.Login, b.Login) })
+	return results, err
+}
+
+func (m *Memory) RevokeGrant(ctx context.Context, idDock uuid.UUID, login string) (int, error) {
+	var revoked int
+	err := m.write(ctx, func(d *memData) error {
+		u, ok := d.userByLogin(login)
+		if !ok {
+			return Invaliddata
+		}
+		key := memGrantKey{Dock: idDock, User: u.Id}
+		if _, ok = d.grants[key]; !ok {
+			return Invaliddata
+		}
+		delete(d.grants, key)
+		revoked = u.Id
+		return nil
+	})
+	return revoked, err
+}
+
+// withGrants документ с логинами пользователей, которым он выдан (как array_agg в StructPool)
+func (d *memData) withGrants(doc memDock) DocumentWithGrants {
+	granted := []string{}
+	for k := range d.grants {
+		if k.Dock == doc.Id {
+			granted = append(granted, d.users[k.User].Login)
+		}
+	}
+	slices.Sort(granted)
+	return DocumentWithGrants{
+		ID:           doc.Id,
+		Name:         doc.Name,
+		Mime:         doc.Mime,
+		IsFile:       doc.IsFile,
+		Public:       doc.Public,
+		CreatedAt:    doc.CreatedAt,
+		GrantedUsers: granted,
+		Json:         doc.Json,
+		Filepath:     doc.Filepath,
+	}
+}
+
+// memFilter условие d.<key> = value из GetDock
+func memFilter(key, value string) (func(doc memDock) bool, error) {
+	arg, err := filterValue(key, value)
+	if err != nil {
+		return nil, err
+	}
+	switch key {
+	case "name":
+		return func(doc memDock) bool { return doc.Name == arg }, nil
+	case "mime":
+		return func(doc memDock) bool { return doc.Mime == arg }, nil
+	case "is_file":
+		return func(doc memDock) bool { return doc.IsFile == arg }, nil
+	case "public":
+		return func(doc memDock) bool { return doc.Public == arg }, nil
+	default:
+		return func(doc memDock) bool { return doc.CreatedAt.Equal(arg.(time.Time)) }, nil
+	}
+}
+
+func (m *Memory) GetDock(_ context.Context, filter GetDock) ([]DocumentWithGrants, error) {
+	match, err := memFilter(filter.Key, filter.Value)
+	if err != nil {
+		return []DocumentWithGrants{}, err
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("LIMIT must not be negative")
+	}
+	var results []DocumentWithGrants
+	err = m.read(func(d *memData) error {
+		owner := filter.Id
+		if filter.Login != "" {
+			u, ok := d.userByLogin(filter.Login)
+			if !ok {
+				return nil
+			}
+			owner = u.Id
+		}
+		for _, doc := range d.docs {
+			if len(results) == filter.Limit {
+				break
+			}
+			if doc.OwnerId != owner || !match(doc) {
+				continue
+			}
+			if filter.Login != "" {
+				if _, granted := d.grants[memGrantKey{Dock: doc.Id, User: filter.Id}]; !doc.Public && !granted {
+					continue
+				}
+			}
+			results = append(results, d.withGrants(doc))
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (m *Memory) ListOwnedDocks(_ context.Context, idUser int) ([]DocumentWithGrants, error) {
+	results := []DocumentWithGrants{}
+	err := m.read(func(d *memData) error {
+		for _, doc := range d.docs {
+			if doc.OwnerId == idUser {
+				results = append(results, d.withGrants(doc))
+			}
+		}
+		return nil
+	})
+	slices.SortFunc(results, func(a, b DocumentWithGrants) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return results, err
+}
+
+func (m *Memory) GetDockById(_ context.Context, idDock uuid.UUID) (DocumentWithGrants, error) {
+	var result DocumentWithGrants
+	err := m.read(func(d *memData) error {
+		doc, ok := d.docs[idDock]
+		if !ok {
+			return Invaliddata
+		}
+		result = d.withGrants(doc)
+		return nil
+	})
+	return result, err
+}
+
+func (m *Memory) DeleteDock(ctx context.Context, idDock uuid.UUID) error {
+	return m.write(ctx, func(d *memData) error {
+		ids, _ := d.deleteDocks(func(doc memDock) bool { return doc.Id == idDock })
+		if len(ids) == 0 {
+			return Invaliddata
+		}
+		return nil
+	})
+}
+
+func (m *Memory) PendingBlobDeletions(ctx context.Context, limit int) ([]string, error) {
+	var keys []string
+	err := m.write(ctx, func(d *memData) error {
+		referenced := d.referencedFiles()
+		maps.DeleteFunc(d.blobs, func(key string, _ memBlobDeletion) bool {
+			_, ok := referenced[key]
+			return ok
+		})
+		keys = slices.SortedFunc(maps.Keys(d.blobs), func(a, b string) int {
+			x, y := d.blobs[a], d.blobs[b]
+			if x.Attempts != y.Attempts {
+				return x.Attempts - y.Attempts
+			}
+			return x.CreatedAt.Compare(y.CreatedAt)
+		})
+		return nil
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, err
+}
+
+func (m *Memory) BlobDeleted(ctx context.Context, key string) error {
+	return m.write(ctx, func(d *memData) error {
+		delete(d.blobs, key)
+		return nil
+	})
+}
+
+func (m *Memory) BlobDeleteFailed(ctx context.Context, key string, reason string) error {
+	return m.write(ctx, func(d *memData) error {
+		if b, ok := d.blobs[key]; ok {
+			b.Attempts++
+			b.LastError = reason
+			d.blobs[key] = b
+		}
+		return nil
+	})
+}
+
+// referencedFiles файлы документов и версий
+func (d *memData) referencedFiles() map[string]struct{} {
+	keys := map[string]struct{}{}
+	for id, doc := range d.docs {
+		if doc.Filepath != "" {
+			keys[doc.Filepath] = struct{}{}
+		}
+		for _, v := range d.versions[id] {
+			if v.Filepath != "" {
+				keys[v.Filepath] = struct{}{}
+			}
+		}
+	}
+	return keys
+}
+
+func (m *Memory) ReferencedBlobs(_ context.Context) (map[string]struct{}, error) {
+	var keys map[string]struct{}
+	err := m.read(func(d *memData) error {
+		keys = d.referencedFiles()
+		for key := range d.blobs {
+			keys[key] = struct{}{}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// GetDockForUpdate документ в транзакции; писатели Memory и так идут по одному
+func (t memDockTx) GetDockForUpdate(_ context.Context, idDock uuid.UUID) (Dock, error) {
+	d := t.d
+	doc, ok := d.docs[idDock]
+	if !ok {
+		return Dock{}, Invaliddata
+	}
+	return doc.Dock, nil
+}
+
+func (t memDockTx) UpdateDock(_ context.Context, dock Dock) error {
+	d := t.d
+	doc, ok := d.docs[dock.Id]
+	if !ok {
+		return Invaliddata
+	}
+	// владелец не меняется
+	dock.OwnerId = doc.OwnerId
+	doc.Dock = dock
+	d.docs[dock.Id] = doc
+	return nil
+}
+
+func (t memDockTx) AddVersion(_ context.Context, dock Dock, authorId int, hash string) (int, error) {
+	d := t.d
+	if _, ok := d.docs[dock.Id]; !ok {
+		return 0, fmt.Errorf("unknown document %s", dock.Id)
+	}
+	versions := d.versions[dock.Id]
+	v := memVersion{Dock: dock, Version: len(versions) + 1, AuthorId: authorId, Hash: hash, CreatedAt: time.Now()}
+	if _, ok := d.users[authorId]; !ok {
+		v.AuthorId = 0
+	}
+	d.versions[dock.Id] = append(versions, v)
+	return v.Version, nil
+}
+
+func (d *memData) version(v memVersion) DockVersion {
+	return DockVersion{
+		DocumentWithGrants: DocumentWithGrants{
+			ID:        v.Id,
+			Name:      v.Name,
+			Mime:      v.Mime,
+			IsFile:    v.IsFile,
+			Public:    v.Public,
+			CreatedAt: v.CreatedAt,
+			Json:      v.Json,
+			Filepath:  v.Filepath,
+		},
+		Version:     v.Version,
+		AuthorId:    v.AuthorId,
+		Author:      d.users[v.AuthorId].Login,
+		ContentHash: v.Hash,
+	}
+}
+
+func (m *Memory) ListVersions(_ context.Context, idDock uuid.UUID) ([]DockVersion, error) {
+	var results []DockVersion
+	err := m.read(func(d *memData) error {
+		for _, v := range d.versions[idDock] {
+			results = append(results, d.version(v))
+		}
+		if len(results) == 0 {
+			return Invaliddata
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (m *Memory) GetVersion(_ context.Context, idDock uuid.UUID, version int) (DockVersion, error) {
+	var result DockVersion
+	err := m.read(func(d *memData) error {
+		versions := d.versions[idDock]
+		if version < 1 || version > len(versions) {
+			return Invaliddata
+		}
+		result = d.version(versions[version-1])
+		return nil
+	})
+	return result, err
+}
+
+func (m *Memory) GetDockRole(_ context.Context, idUser int, idDock uuid.UUID) (string, error) {
+	var role string
+	err := m.read(func(d *memData) error {
+		doc, ok := d.docs[idDock]
+		if !ok {
+			return Invaliddata
+		}
+		g, granted := d.grants[memGrantKey{Dock: idDock, User: idUser}]
+		switch {
+		case doc.OwnerId == idUser:
+			role = "owner"
+		case granted:
+			role = g.Role
+		case doc.Public:
+			role = "public"
+		default:
+			return Invaliddata
+		}
+		return nil
+	})
+	return role, err
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, idUser int, keyHash string, key APIKey) (APIKey, error) {
+	err := m.write(ctx, func(d *memData) error {
+		if _, ok := d.users[idUser]; !ok {
+			return SomeWrong
+		}
+		for _, k := range d.apiKeys {
+			if k.Hash == keyHash {
+				return SomeWrong
+			}
+		}
+		d.lastKey++
+		key.Id, key.UserId, key.LastUsedAt = d.lastKey, idUser, nil
+		if key.Scopes == nil {
+			key.Scopes = []string{}
+		}
+		d.apiKeys[key.Id] = memAPIKey{APIKey: key, Hash: keyHash}
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+func (m *Memory) ListAPIKeys(_ context.Context, idUser int) ([]APIKey, error) {
+	results := []APIKey{}
+	err := m.read(func(d *memData) error {
+		for _, k := range d.apiKeys {
+			if k.UserId == idUser {
+				results = append(results, k.APIKey)
+			}
+		}
+		return nil
+	})
+	slices.SortFunc(results, func(a, b APIKey) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return results, err
+}
+
+func (m *Memory) DeleteAPIKey(ctx context.Context, idUser int, idKey int) error {
+	return m.write(ctx, func(d *memData) error {
+		if k, ok := d.apiKeys[idKey]; !ok || k.UserId != idUser {
+			return Invaliddata
+		}
+		delete(d.apiKeys, idKey)
+		return nil
+	})
+}
+
+func (m *Memory) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	var key APIKey
+	err := m.write(ctx, func(d *memData) error {
+		now := time.Now()
+		for id, k := range d.apiKeys {
+			if k.Hash != keyHash {
+				continue
+			}
+			if u, ok := d.users[k.UserId]; !ok || u.Disabled {
+				return Invalidtoken
+			}
+			if k.ExpireAt != nil && !k.ExpireAt.After(now) {
+				return Invalidtoken
+			}
+			k.LastUsedAt = &now
+			d.apiKeys[id] = k
+			key = k.APIKey
+			return nil
+		}
+		return Invalidtoken
+	})
+	return key, err
+}
+
+func (m *Memory) CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error {
+	return m.write(ctx, func(d *memData) error {
+		if _, ok := d.oidc[stateHash]; ok {
+			return SomeWrong
+		}
+		d.oidc[stateHash] = login
+		return nil
+	})
+}
+
+func (m *Memory) UseOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error) {
+	var login OIDCLogin
+	err := m.write(ctx, func(d *memData) error {
+		var ok bool
+		if login, ok = d.oidc[stateHash]; !ok {
+			return Invalidtoken
+		}
+		delete(d.oidc, stateHash)
+		return nil
+	})
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	if time.Now().After(login.ExpireAt) {
+		return OIDCLogin{}, Invalidtoken
+	}
+	return login, nil
+}
+
+func (m *Memory) FindIdentity(_ context.Context, issuer, subject string) (int, error) {
+	var userId int
+	err := m.read(func(d *memData) error {
+		var ok bool
+		if userId, ok = d.identities[memIdentity{Issuer: issuer, Subject: subject}]; !ok {
+			return Invaliddata
+		}
+		return nil
+	})
+	return userId, err
+}
+
+func (m *Memory) LinkIdentity(ctx context.Context, issuer, subject string, idUser int) error {
+	return m.write(ctx, func(d *memData) error {
+		if _, ok := d.users[idUser]; !ok {
+			return SomeWrong
+		}
+		key := memIdentity{Issuer: issuer, Subject: subject}
+		if _, ok := d.identities[key]; !ok {
+			d.identities[key] = idUser
+		}
+		return nil
+	})
+}
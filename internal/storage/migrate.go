@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gomodlag/internal/logger"
+	"io/fs"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLock ключ pg_advisory_lock: миграции одновременно применяет только один процесс
+const migrationLock int64 = 0x6d6967726174
+
+var migrationName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration версия схемы: Up применяет изменения, Down откатывает их
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState миграция и время ее применения (nil - не применена)
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator хранилище со схемой в базе (PostgreSQL, SQLite)
+type Migrator interface {
+	MigrateUp(ctx context.Context, logger logger.Logger) (int, error)
+	MigrateDown(ctx context.Context, steps int, logger logger.Logger) (int, error)
+	MigrationStatus(ctx context.Context) ([]MigrationState, error)
+}
+
+// Migrations встроенные в бинарник миграции по возрастанию версии
+func Migrations() ([]Migration, error) {
+	dir, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(dir)
+}
+
+// LoadMigrations читает файлы NNNN_name.up.sql и NNNN_name.down.sql;
+// у каждой версии должны быть оба файла
+func LoadMigrations(dir fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", e.Name())
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", e.Name())
+		}
+		body, err := fs.ReadFile(dir, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// MigrateUp применяет все непримененные миграции, каждую в своей транзакции
+func (s *StructPool) MigrateUp(ctx context.Context, logger logger.Logger) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	err = s.withMigrationLock(ctx, func(conn *pgxpool.Conn, done map[int]time.Time) error {
+		for v := range done {
+			if !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == v }) {
+				// база новее бинарника: старую версию приложения запускать можно, но схему она не трогает
+				logger.Warn("Unknown migration in database", slog.Int("version", v))
+			}
+		}
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+					m.Version, m.Name, time.Now())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			logger.Info("Migration applied", slog.Int("version", m.Version), slog.String("name", m.Name))
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown откатывает steps последних примененных миграций
+func (s *StructPool) MigrateDown(ctx context.Context, steps int, logger logger.Logger) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	reverted := 0
+	err = s.withMigrationLock(ctx, func(conn *pgxpool.Conn, done map[int]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			logger.Info("Migration reverted", slog.Int("version", m.Version), slog.String("name", m.Name))
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// MigrationStatus все встроенные миграции с отметкой о применении
+func (s *StructPool) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	err = s.withMigrationLock(ctx, func(_ *pgxpool.Conn, done map[int]time.Time) error {
+		for _, m := range migrations {
+			state := MigrationState{Migration: m}
+			if at, ok := done[m.Version]; ok {
+				state.AppliedAt = &at
+			}
+			states = append(states, state)
+		}
+		return nil
+	})
+	return states, err
+}
+
+// withMigrationLock держит advisory lock на отдельном соединении и передает fn примененные версии
+func (s *StructPool) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn, done map[int]time.Time) error) error {
+	conn, err := s.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	// блокировка сессионная, снимается на том же соединении даже после отмены ctx
+	defer func() { _, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock) }()
+
+	const schema = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		name text not null,
+		applied_at timestamp not null
+		)`
+	if _, err = conn.Exec(ctx, schema); err != nil {
+		return err
+	}
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	done := map[int]time.Time{}
+	var version int
+	var at time.Time
+	_, err = pgx.ForEachRow(rows, []any{&version, &at}, func() error {
+		done[version] = at
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fn(conn, done)
+}
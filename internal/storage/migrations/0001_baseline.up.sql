@@ -1,5 +1,3 @@
-\c test;
-
 CREATE TABLE IF NOT EXISTS users (
 id SERIAL PRIMARY KEY,
 username text not null unique,
@@ -35,6 +33,3 @@ CREATE TABLE IF NOT EXISTS sessions (
     user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     UNIQUE(user_id)
     );
-
-
-
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS document_versions;
+DROP FUNCTION IF EXISTS forbid_version_update();
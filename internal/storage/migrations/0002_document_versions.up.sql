@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS document_versions (
+ id SERIAL PRIMARY KEY,
+ document_id uuid NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+ version INT NOT NULL,
+ author_id INT REFERENCES users(id) ON DELETE SET NULL,
+ created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+ content_hash text not null,
+ name text not null,
+ public bool not null,
+ is_file bool not null,
+ mime text not null,
+ json_data JSONB,
+ file_path text,
+ UNIQUE(document_id, version)
+);
+
+-- версии неизменяемы: разрешены только вставка, каскадное удаление вместе с документом
+-- и обнуление автора при его удалении (ON DELETE SET NULL - это UPDATE author_id)
+CREATE OR REPLACE FUNCTION forbid_version_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'document versions are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER document_versions_immutable
+    BEFORE UPDATE OF document_id, version, created_at, content_hash, name, public, is_file, mime, json_data, file_path
+    ON document_versions
+    FOR EACH ROW EXECUTE FUNCTION forbid_version_update();
+
+-- у документов, созданных до истории версий, текущее содержимое становится версией 1.
+-- Хеш файла без чтения хранилища не посчитать: вместо него хеш ключа файла (ключи не переиспользуются)
+INSERT INTO document_versions
+    (document_id, version, author_id, created_at, content_hash, name, public, is_file, mime, json_data, file_path)
+SELECT d.id, 1, d.own_id, COALESCE(d.created_at, NOW()),
+       encode(sha256(convert_to(CASE WHEN d.is_file THEN COALESCE(d.file_path, '') ELSE COALESCE(d.json_data::text, '') END, 'UTF8')), 'hex'),
+       d.name, d.public, d.is_file, d.mime, d.json_data, d.file_path
+FROM documents d
+WHERE NOT EXISTS (SELECT 1 FROM document_versions v WHERE v.document_id = d.id);
@@ -0,0 +1,2 @@
+ALTER TABLE document_grants
+    ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'viewer' CHECK (role IN ('viewer', 'editor', 'coowner'));
@@ -0,0 +1,7 @@
+-- остается только последняя сессия каждого пользователя
+DELETE FROM sessions s USING sessions n WHERE s.user_id = n.user_id AND s.token_id < n.token_id;
+
+DROP INDEX IF EXISTS sessions_user_id_idx;
+ALTER TABLE sessions DROP COLUMN IF EXISTS ip;
+ALTER TABLE sessions DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE sessions ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
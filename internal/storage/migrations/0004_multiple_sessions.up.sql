@@ -0,0 +1,6 @@
+-- несколько сессий на пользователя (по одной на устройство)
+ALTER TABLE sessions DROP CONSTRAINT IF EXISTS sessions_user_id_key;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent text not null default '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS ip text not null default '';
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
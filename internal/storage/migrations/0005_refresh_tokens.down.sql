@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS refresh_tokens;
+ALTER TABLE sessions DROP COLUMN IF EXISTS access_expire_at;
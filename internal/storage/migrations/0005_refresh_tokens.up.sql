@@ -0,0 +1,16 @@
+-- срок access токена отдельно от срока сессии; у старых сессий они совпадают
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS access_expire_at timestamp;
+UPDATE sessions SET access_expire_at = expire_at WHERE access_expire_at IS NULL;
+ALTER TABLE sessions ALTER COLUMN access_expire_at SET NOT NULL;
+
+-- refresh токены хранятся только в виде sha256; все токены одной сессии - одно семейство
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    session_id INT NOT NULL REFERENCES sessions(token_id) ON DELETE CASCADE,
+    token_hash text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    used_at timestamp
+    );
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens(session_id);
@@ -0,0 +1,7 @@
+-- неудачные попытки входа: subject - "user:<login>" или "ip:<адрес>"
+CREATE TABLE IF NOT EXISTS login_attempts (
+    subject text PRIMARY KEY,
+    failures int not null default 0,
+    updated_at timestamp not null,
+    locked_until timestamp
+    );
@@ -0,0 +1,26 @@
+-- TOTP (RFC 6238); last_step - шаг последнего принятого кода, чтобы код нельзя было использовать дважды
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret text not null,
+    confirmed boolean not null default false,
+    last_step bigint not null default 0,
+    created_at timestamp not null
+    );
+
+-- одноразовые коды восстановления 2fa (sha256)
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash text not null,
+    used_at timestamp,
+    UNIQUE (user_id, code_hash)
+    );
+
+-- токены второго шага входа (после пароля, до кода 2fa)
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash text PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts int not null default 0,
+    created_at timestamp not null,
+    expire_at timestamp not null
+    );
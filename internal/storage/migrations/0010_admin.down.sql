@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS admin_audit;
+ALTER TABLE users DROP COLUMN IF EXISTS disabled;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
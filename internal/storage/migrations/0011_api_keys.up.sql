@@ -0,0 +1,12 @@
+-- персональные API ключи; хранится sha256 ключа, prefix - начало ключа для списка
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name text not null,
+    key_hash text not null UNIQUE,
+    prefix text not null,
+    scopes text[] not null default '{}',
+    created_at timestamp not null,
+    expire_at timestamp,
+    last_used_at timestamp
+    );
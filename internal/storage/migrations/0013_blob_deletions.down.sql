@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS document_versions_file_path_idx;
+DROP INDEX IF EXISTS documents_file_path_idx;
+DROP TABLE IF EXISTS blob_deletions;
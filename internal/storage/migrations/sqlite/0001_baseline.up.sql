@@ -0,0 +1,35 @@
+-- время хранится целым числом наносекунд (unix_nano), см. OpenSQLite
+CREATE TABLE IF NOT EXISTS users (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+username text not null unique,
+pass_hash text not null,
+created_at timestamp default (CAST(unixepoch('subsec') * 1000000000 AS INTEGER))
+);
+
+CREATE TABLE IF NOT EXISTS documents(
+id text PRIMARY KEY,
+name text not null,
+public bool not null,
+is_file bool not null,
+mime text not null,
+json_data text,
+file_path text,
+created_at timestamp default (CAST(unixepoch('subsec') * 1000000000 AS INTEGER)),
+own_id INT REFERENCES users(id) ON DELETE CASCADE
+    );
+
+CREATE TABLE IF NOT EXISTS document_grants (
+ id INTEGER PRIMARY KEY AUTOINCREMENT,
+ document_id text NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+ granted_user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+ created_at timestamp default (CAST(unixepoch('subsec') * 1000000000 AS INTEGER)),
+ UNIQUE(document_id, granted_user_id)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    user_id INT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE
+    );
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS document_versions_immutable;
+DROP TABLE IF EXISTS document_versions;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS document_versions (
+ id INTEGER PRIMARY KEY AUTOINCREMENT,
+ document_id text NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+ version INT NOT NULL,
+ author_id INT REFERENCES users(id) ON DELETE SET NULL,
+ created_at timestamp NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000000000 AS INTEGER)),
+ content_hash text not null,
+ name text not null,
+ public bool not null,
+ is_file bool not null,
+ mime text not null,
+ json_data text,
+ file_path text,
+ UNIQUE(document_id, version)
+);
+
+-- версии неизменяемы: разрешены только вставка, каскадное удаление вместе с документом
+-- и обнуление автора при его удалении
+CREATE TRIGGER IF NOT EXISTS document_versions_immutable
+    BEFORE UPDATE OF document_id, version, created_at, content_hash, name, public, is_file, mime, json_data, file_path
+    ON document_versions
+BEGIN
+    SELECT RAISE(ABORT, 'document versions are immutable');
+END;
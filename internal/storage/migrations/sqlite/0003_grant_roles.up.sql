@@ -0,0 +1,2 @@
+ALTER TABLE document_grants
+    ADD COLUMN role text NOT NULL DEFAULT 'viewer' CHECK (role IN ('viewer', 'editor', 'coowner'));
@@ -0,0 +1,15 @@
+-- остается только последняя сессия каждого пользователя
+DELETE FROM sessions WHERE EXISTS (
+    SELECT 1 FROM sessions n WHERE n.user_id = sessions.user_id AND n.token_id > sessions.token_id);
+
+CREATE TABLE sessions_old (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    user_id INT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE
+    );
+INSERT INTO sessions_old (token_id, token, created_at, expire_at, user_id)
+    SELECT token_id, token, created_at, expire_at, user_id FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_old RENAME TO sessions;
@@ -0,0 +1,17 @@
+-- несколько сессий на пользователя (по одной на устройство);
+-- ограничение UNIQUE в SQLite не удаляется, таблица пересоздается
+CREATE TABLE sessions_new (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent text not null default '',
+    ip text not null default ''
+    );
+INSERT INTO sessions_new (token_id, token, created_at, expire_at, user_id)
+    SELECT token_id, token, created_at, expire_at, user_id FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
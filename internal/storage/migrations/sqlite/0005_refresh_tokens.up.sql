@@ -0,0 +1,29 @@
+-- срок access токена отдельно от срока сессии; у старых сессий они совпадают.
+-- NOT NULL без значения по умолчанию в SQLite добавляется только пересозданием таблицы
+CREATE TABLE sessions_new (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent text not null default '',
+    ip text not null default '',
+    access_expire_at timestamp not null
+    );
+INSERT INTO sessions_new (token_id, token, created_at, expire_at, user_id, user_agent, ip, access_expire_at)
+    SELECT token_id, token, created_at, expire_at, user_id, user_agent, ip, expire_at FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
+
+-- refresh токены хранятся только в виде sha256; все токены одной сессии - одно семейство
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    session_id INT NOT NULL REFERENCES sessions(token_id) ON DELETE CASCADE,
+    token_hash text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    used_at timestamp
+    );
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens(session_id);
@@ -0,0 +1,5 @@
+-- токены удаленных сессий до истечения их срока (для подписанных access токенов)
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    token text PRIMARY KEY,
+    expire_at timestamp not null
+    );
@@ -0,0 +1,9 @@
+-- одноразовые токены сброса пароля, выданные администратором (хранится только sha256)
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash text not null unique,
+    created_at timestamp not null,
+    expire_at timestamp not null,
+    used_at timestamp
+    );
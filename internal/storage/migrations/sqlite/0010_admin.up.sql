@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN role text not null default 'user' CHECK (role IN ('admin', 'user'));
+ALTER TABLE users ADD COLUMN disabled bool not null default false;
+
+-- журнал действий администраторов; логин копируется, чтобы запись пережила удаление администратора
+CREATE TABLE IF NOT EXISTS admin_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    admin_id INT REFERENCES users(id) ON DELETE SET NULL,
+    admin_login text not null,
+    action text not null,
+    target text not null,
+    created_at timestamp not null
+    );
@@ -0,0 +1,17 @@
+-- внешние учетные записи OIDC: пара issuer + sub привязана к пользователю
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer text not null,
+    subject text not null,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp not null,
+    PRIMARY KEY (issuer, subject)
+    );
+
+-- незавершенные входы через OIDC (state хранится хешем)
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash text PRIMARY KEY,
+    verifier text not null,
+    nonce text not null,
+    created_at timestamp not null,
+    expire_at timestamp not null
+    );
@@ -0,0 +1,11 @@
+-- очередь удаления файлов: пишется в одной транзакции с удалением документа,
+-- файлы из хранилища удаляет фоновый BlobGC
+CREATE TABLE IF NOT EXISTS blob_deletions (
+    key text PRIMARY KEY,
+    created_at timestamp not null,
+    attempts int not null default 0,
+    last_error text
+    );
+
+CREATE INDEX IF NOT EXISTS documents_file_path_idx ON documents (file_path);
+CREATE INDEX IF NOT EXISTS document_versions_file_path_idx ON document_versions (file_path);
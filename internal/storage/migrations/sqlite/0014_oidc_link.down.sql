@@ -0,0 +1,9 @@
+-- колонку с внешним ключом SQLite удалить не может; незавершенные входы не жалко
+DROP TABLE IF EXISTS oidc_logins;
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash text PRIMARY KEY,
+    verifier text not null,
+    nonce text not null,
+    created_at timestamp not null,
+    expire_at timestamp not null
+    );
@@ -0,0 +1,2 @@
+-- привязка учетной записи OIDC к пользователю, начавшему вход из своей сессии
+ALTER TABLE oidc_logins ADD COLUMN link_user_id INT REFERENCES users(id) ON DELETE CASCADE;
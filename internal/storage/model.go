@@ -4,8 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
+	"strconv"
 	"time"
 )
 
@@ -13,13 +14,96 @@ var Invalidtoken = errors.New("invalid token")
 var Invaliddata = errors.New("invalid data")
 var SomeWrong = errors.New("something went wrong")
 var Internal = errors.New("internal server error")
-var Forbidden = errors.New("you cannot delete this document")
+var Forbidden = errors.New("access denied")
+var NotJson = errors.New("document is not json")
+var InvalidPatch = errors.New("invalid patch")
+var UnknownUser = errors.New("unknown user")
+var TokenReused = errors.New("refresh token reused")
 
 type Token struct {
 	Token       string
 	TimeCreated time.Time
 	TimeExpired time.Time
 }
+
+// SessionMeta данные устройства, с которого выполнен вход
+type SessionMeta struct {
+	UserAgent string
+	IP        string
+}
+
+type Session struct {
+	Id        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpireAt  time.Time `json:"expire_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"`
+}
+
+// TOTP второй фактор пользователя; LastStep - последний принятый 30-секундный шаг (защита от повтора кода)
+type TOTP struct {
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// SystemAdmin idAdmin действий из командной строки, в журнале они пишутся от SystemLogin
+const (
+	SystemAdmin = 0
+	SystemLogin = "cli"
+)
+
+type User struct {
+	Id        int       `json:"id"`
+	Login     string    `json:"login"`
+	Role      string    `json:"role"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeletedUser что удалилось вместе с пользователем: его документы и ключи файлов, поставленные в очередь на удаление
+type DeletedUser struct {
+	Documents []uuid.UUID
+	Files     []string
+}
+
+// AuditEntry запись журнала действий администраторов
+type AuditEntry struct {
+	Id        int       `json:"id"`
+	Admin     string    `json:"admin"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey персональный ключ пользователя; сам ключ не хранится, Prefix - его начало для списка
+type APIKey struct {
+	Id         int        `json:"id"`
+	UserId     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpireAt   *time.Time `json:"expire_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// OIDCLogin незавершенный вход через OIDC провайдера
+type OIDCLogin struct {
+	Verifier  string
+	Nonce     string
+	CreatedAt time.Time
+	ExpireAt  time.Time
+	// LinkUserId вход начат из сессии этого пользователя для привязки учетной записи; 0 - обычный вход
+	LinkUserId int
+}
+
 type Dock struct {
 	Id       uuid.UUID
 	IsFile   bool
@@ -52,21 +136,174 @@ type DocumentWithGrants struct {
 	Filepath     string          `json:"-"`
 }
 
+type Grant struct {
+	Login     string    `json:"login"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DockVersion неизменяемый снимок документа; CreatedAt - время создания версии
+type DockVersion struct {
+	DocumentWithGrants
+	Version     int    `json:"version"`
+	AuthorId    int    `json:"-"`
+	Author      string `json:"author"`
+	ContentHash string `json:"content_hash"`
+}
+
 type TokenValidator interface {
 	ValidateToken(ctx context.Context, token string) (int, error)
 }
 
+type UserGetter interface {
+	GetUser(ctx context.Context, idUser int) (User, error)
+}
+
+type AdminModel interface {
+	UserGetter
+	GetUserByLogin(ctx context.Context, username string) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	CreateUser(ctx context.Context, username, passHash, role string) (User, error)
+	SetUserDisabled(ctx context.Context, username string, disabled bool) error
+	DeleteUser(ctx context.Context, username string) (DeletedUser, error)
+	HasAdmin(ctx context.Context) (bool, error)
+	AddAudit(ctx context.Context, idAdmin int, action, target string) error
+	ListAudit(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+type APIKeyModel interface {
+	CreateAPIKey(ctx context.Context, idUser int, keyHash string, key APIKey) (APIKey, error)
+	ListAPIKeys(ctx context.Context, idUser int) ([]APIKey, error)
+	DeleteAPIKey(ctx context.Context, idUser int, idKey int) error
+	UseAPIKey(ctx context.Context, keyHash string) (APIKey, error)
+}
+
+// OIDCModel внешние учетные записи (issuer + sub) пользователей
+type OIDCModel interface {
+	CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error
+	UseOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error)
+	FindIdentity(ctx context.Context, issuer, subject string) (int, error)
+	LinkIdentity(ctx context.Context, issuer, subject string, idUser int) error
+}
+
+// BlobGCModel очередь удаления файлов и ссылки на файлы для сборки сирот
+type BlobGCModel interface {
+	PendingBlobDeletions(ctx context.Context, limit int) ([]string, error)
+	BlobDeleted(ctx context.Context, key string) error
+	BlobDeleteFailed(ctx context.Context, key string, reason string) error
+	ReferencedBlobs(ctx context.Context) (map[string]struct{}, error)
+}
+
+// RevocationStore access токены удаленных сессий, которые еще не истекли
+type RevocationStore interface {
+	ListRevoked(ctx context.Context) ([]string, error)
+}
+
 type AuthRegDelModel interface {
 	Register(ctx context.Context, password, username string) (string, error)
-	Login(ctx context.Context, password, username string, token string, ttl time.Duration) error
-	DeleteToken(ctx context.Context, idUser int) error
+	GetCredentials(ctx context.Context, username string) (int, string, error)
+	UpdatePasswordHash(ctx context.Context, idUser int, hash string) error
+	GetPasswordHash(ctx context.Context, idUser int) (string, error)
+	ChangePassword(ctx context.Context, idUser int, hash string, keepToken string) error
+	CreateResetToken(ctx context.Context, username string, token Token) error
+	GetLogin(ctx context.Context, idUser int) (string, error)
+	GetTOTP(ctx context.Context, idUser int) (TOTP, error)
+	SaveTOTPSecret(ctx context.Context, idUser int, secret string) error
+	ConfirmTOTP(ctx context.Context, idUser int, step int64, recoveryHashes []string) error
+	UseTOTPStep(ctx context.Context, idUser int, step int64) error
+	UseRecoveryCode(ctx context.Context, idUser int, codeHash string) error
+	CreateChallenge(ctx context.Context, idUser int, token Token) error
+	UseChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error)
+	DeleteChallenge(ctx context.Context, tokenHash string) error
+	GetLoginLocks(ctx context.Context, subjects ...string) (map[string]time.Time, error)
+	AddLoginFailure(ctx context.Context, subject string, window time.Duration) (int, error)
+	LockLogin(ctx context.Context, subject string, until time.Time) error
+	ResetLoginFailures(ctx context.Context, subject string) error
+	UseResetToken(ctx context.Context, tokenHash string, passHash string) (int, error)
+	CreateSession(ctx context.Context, idUser int, access Token, refresh Token, meta SessionMeta) error
+	RotateRefreshToken(ctx context.Context, refreshHash string, access Token, refresh Token) (int, error)
+	DeleteToken(ctx context.Context, token string) error
+	ListSessions(ctx context.Context, idUser int, currentToken string) ([]Session, error)
+	DeleteSessionById(ctx context.Context, idUser int, idSession int) error
+	DeleteUserSessions(ctx context.Context, idUser int) error
+	DeleteAccount(ctx context.Context, idUser int) (DeletedUser, error)
+	PurgeExpired(ctx context.Context) (int, error)
+}
+
+// DockTx изменения документов внутри WithTx: фиксируются или откатываются вместе
+type DockTx interface {
+	NewDocs(ctx context.Context, dock Dock) (bool, error)
+	AddGrant(ctx context.Context, grants []string, role string, docid uuid.UUID) (bool, error)
+	// GetDockForUpdate документ, который не изменится до конца транзакции
+	GetDockForUpdate(ctx context.Context, idDock uuid.UUID) (Dock, error)
+	UpdateDock(ctx context.Context, dock Dock) error
+	AddVersion(ctx context.Context, dock Dock, authorId int, hash string) (int, error)
 }
 
 type DockModel interface {
-	GetDockById(ctx context.Context, idUser int, idDock uuid.UUID) (DocumentWithGrants, error)
-	DeleteDock(ctx context.Context, idUser int, idDock uuid.UUID) error
+	GetDockById(ctx context.Context, idDock uuid.UUID) (DocumentWithGrants, error)
+	GetDockRole(ctx context.Context, idUser int, idDock uuid.UUID) (string, error)
+	DeleteDock(ctx context.Context, idDock uuid.UUID) error
 	GetDock(ctx context.Context, filter GetDock) ([]DocumentWithGrants, error)
-	AddGrant(ctx context.Context, grants []string, docid uuid.UUID, tx pgx.Tx) (bool, error)
-	NewDocs(ctx context.Context, dock Dock, tx pgx.Tx) (bool, error)
-	Begin(ctx context.Context) (pgx.Tx, error)
+	ListOwnedDocks(ctx context.Context, idUser int) ([]DocumentWithGrants, error)
+	ListGrants(ctx context.Context, idDock uuid.UUID) ([]Grant, error)
+	RevokeGrant(ctx context.Context, idDock uuid.UUID, login string) (int, error)
+	ListVersions(ctx context.Context, idDock uuid.UUID) ([]DockVersion, error)
+	GetVersion(ctx context.Context, idDock uuid.UUID, version int) (DockVersion, error)
+	// WithTx выполняет fn в одной транзакции: ошибка fn откатывает ее (и возвращается как есть), иначе транзакция
+	// фиксируется. Прерванную конфликтом транзакцию WithTx повторяет, поэтому fn может выполниться несколько раз
+	// и не должна делать ничего, кроме работы с tx
+	WithTx(ctx context.Context, fn func(tx DockTx) error) error
+}
+
+// Store все модели хранилища; реализуют StructPool (PostgreSQL), SQLite и Memory
+type Store interface {
+	TokenValidator
+	RevocationStore
+	AdminModel
+	APIKeyModel
+	OIDCModel
+	BlobGCModel
+	AuthRegDelModel
+	DockModel
+}
+
+// filterValue значение фильтра GetDock, приведенное к типу колонки key (как это делает PostgreSQL)
+func filterValue(key, value string) (any, error) {
+	switch key {
+	case "name", "mime":
+		return value, nil
+	case "is_file", "public":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", value)
+		}
+		return b, nil
+	case "created_at":
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999", "2006-01-02"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return nil, fmt.Errorf("invalid filter key")
+}
+
+// txAttempts сколько раз WithTx выполняет транзакцию, прерванную конфликтом
+const txAttempts = 5
+
+// retryTx выполняет run, пока ошибка retryable и попытки не кончились; пауза между попытками растет
+func retryTx(ctx context.Context, retryable func(err error) bool, run func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := run()
+		if err == nil || attempt == txAttempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
 }
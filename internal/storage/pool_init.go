@@ -8,9 +8,40 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"gomodlag/internal/logger"
 	"log/slog"
+	"strings"
 	"time"
 )
 
+var (
+	_ Store = (*StructPool)(nil)
+	_ Store = (*Memory)(nil)
+	_ Store = (*SQLite)(nil)
+
+	_ Migrator = (*StructPool)(nil)
+	_ Migrator = (*SQLite)(nil)
+)
+
+// Open хранилище по схеме DBURL: memory:// - в памяти процесса, sqlite://<путь к файлу> - SQLite,
+// иначе PostgreSQL; close освобождает соединения
+func Open(DBURL string, logger logger.Logger) (Store, func(), error) {
+	if strings.HasPrefix(DBURL, "memory://") {
+		logger.Warn("Using in-memory storage, data is lost on exit")
+		return NewMemory(), func() {}, nil
+	}
+	if path, ok := strings.CutPrefix(DBURL, "sqlite://"); ok {
+		db, err := OpenSQLite(path, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() { _ = db.DB.Close() }, nil
+	}
+	pool, err := NewPool(DBURL, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &StructPool{Pool: pool}, pool.Close, nil
+}
+
 type StructPool struct {
 	Pool *pgxpool.Pool
 }
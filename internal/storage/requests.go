@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"strings"
 	"time"
 )
@@ -23,82 +24,754 @@ func (s *StructPool) Register(ctx context.Context, password, username string) (s
 	}
 	return login, nil
 }
-func (s *StructPool) Login(ctx context.Context, password, username string, token string, ttl time.Duration) error {
-	const query1 = `SELECT id FROM users 
-				WHERE username = $1 AND pass_hash = $2`
+
+// GetCredentials id пользователя и хеш пароля для проверки при входе
+func (s *StructPool) GetCredentials(ctx context.Context, username string) (int, string, error) {
+	const query = `SELECT id, pass_hash FROM users WHERE username = $1 AND disabled = false`
 	var id int
-	err := s.Pool.QueryRow(ctx, query1, username, password).Scan(&id)
+	var hash string
+	err := s.Pool.QueryRow(ctx, query, username).Scan(&id, &hash)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return Invaliddata
+			return 0, "", Invaliddata
 		}
+		return 0, "", SomeWrong
+	}
+	return id, hash, nil
+}
+
+// UpdatePasswordHash сохраняет новый хеш пароля (пересчитанный с текущими параметрами)
+func (s *StructPool) UpdatePasswordHash(ctx context.Context, idUser int, hash string) error {
+	const query = `UPDATE users SET pass_hash = $2 WHERE id = $1`
+	_, err := s.Pool.Exec(ctx, query, idUser, hash)
+	if err != nil {
 		return SomeWrong
 	}
+	return nil
+}
 
-	t := Token{Token: token, TimeCreated: time.Now(), TimeExpired: time.Now().Add(ttl)}
-	const query2 = `INSERT INTO sessions (token, created_at, expire_at, user_id)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (user_id) DO UPDATE
-		SET token = EXCLUDED.token,
-		    created_at = EXCLUDED.created_at,
-		    expire_at = EXCLUDED.expire_at`
+// GetPasswordHash текущий хеш пароля пользователя
+func (s *StructPool) GetPasswordHash(ctx context.Context, idUser int) (string, error) {
+	const query = `SELECT pass_hash FROM users WHERE id = $1`
+	var hash string
+	err := s.Pool.QueryRow(ctx, query, idUser).Scan(&hash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", SomeWrong
+	}
+	return hash, nil
+}
+
+// ChangePassword ставит новый хеш пароля и в той же транзакции завершает все сессии пользователя,
+// кроме сессии с токеном keepToken
+func (s *StructPool) ChangePassword(ctx context.Context, idUser int, hash string, keepToken string) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err = tx.Exec(ctx, `UPDATE users SET pass_hash = $2 WHERE id = $1`, idUser, hash); err != nil {
+		return SomeWrong
+	}
+	if _, err = revokeSessions(ctx, tx, "user_id = $2 AND token <> $3", idUser, keepToken); err != nil {
+		return SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
 
-	commandtag, err := s.Pool.Exec(ctx, query2, t.Token, t.TimeCreated, t.TimeExpired, id)
+// CreateResetToken сохраняет хеш одноразового токена сброса пароля для пользователя username
+func (s *StructPool) CreateResetToken(ctx context.Context, username string, token Token) error {
+	const query = `INSERT INTO password_resets (user_id, token_hash, created_at, expire_at)
+		SELECT id, $2, $3, $4 FROM users WHERE username = $1`
+	commandtag, err := s.Pool.Exec(ctx, query, username, token.Token, token.TimeCreated, token.TimeExpired)
 	if err != nil {
 		return SomeWrong
 	}
 	if commandtag.RowsAffected() == 0 {
+		return UnknownUser
+	}
+	return nil
+}
+
+// UseResetToken гасит токен сброса, ставит новый хеш пароля и завершает все сессии пользователя
+func (s *StructPool) UseResetToken(ctx context.Context, tokenHash string, passHash string) (int, error) {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	now := time.Now()
+	const query1 = `UPDATE password_resets SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expire_at > $2
+		RETURNING user_id`
+	var userId int
+	err = tx.QueryRow(ctx, query1, tokenHash, now).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+	if _, err = tx.Exec(ctx, `UPDATE users SET pass_hash = $2 WHERE id = $1`, userId, passHash); err != nil {
+		return 0, SomeWrong
+	}
+	if _, err = revokeSessions(ctx, tx, "user_id = $2", userId); err != nil {
+		return 0, SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+// GetLoginLocks до какого времени заблокирован вход для каждого из subjects (логин или ip);
+// незаблокированных в ответе нет
+func (s *StructPool) GetLoginLocks(ctx context.Context, subjects ...string) (map[string]time.Time, error) {
+	const query = `SELECT subject, locked_until FROM login_attempts
+		WHERE subject = ANY($1) AND locked_until > $2`
+	rows, err := s.Pool.Query(ctx, query, subjects, time.Now())
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	locks := map[string]time.Time{}
+	for rows.Next() {
+		var subject string
+		var until time.Time
+		if err := rows.Scan(&subject, &until); err != nil {
+			return nil, SomeWrong
+		}
+		locks[subject] = until
+	}
+	return locks, rows.Err()
+}
+
+// AddLoginFailure увеличивает счетчик неудачных входов; счетчик, не обновлявшийся дольше window, начинается заново
+func (s *StructPool) AddLoginFailure(ctx context.Context, subject string, window time.Duration) (int, error) {
+	const query = `INSERT INTO login_attempts (subject, failures, updated_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = CASE WHEN login_attempts.updated_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			updated_at = $2
+		RETURNING failures`
+	now := time.Now()
+	var failures int
+	err := s.Pool.QueryRow(ctx, query, subject, now, now.Add(-window)).Scan(&failures)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	return failures, nil
+}
+
+func (s *StructPool) LockLogin(ctx context.Context, subject string, until time.Time) error {
+	const query = `UPDATE login_attempts SET locked_until = $2 WHERE subject = $1`
+	_, err := s.Pool.Exec(ctx, query, subject, until)
+	if err != nil {
 		return SomeWrong
 	}
 	return nil
 }
+
+// ResetLoginFailures сбрасывает счетчик и блокировку (успешный вход или разблокировка администратором)
+func (s *StructPool) ResetLoginFailures(ctx context.Context, subject string) error {
+	const query = `DELETE FROM login_attempts WHERE subject = $1`
+	_, err := s.Pool.Exec(ctx, query, subject)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *StructPool) GetLogin(ctx context.Context, idUser int) (string, error) {
+	const query = `SELECT username FROM users WHERE id = $1`
+	var login string
+	err := s.Pool.QueryRow(ctx, query, idUser).Scan(&login)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", SomeWrong
+	}
+	return login, nil
+}
+
+// GetTOTP второй фактор пользователя; Invaliddata - 2fa не настраивалась
+func (s *StructPool) GetTOTP(ctx context.Context, idUser int) (TOTP, error) {
+	const query = `SELECT secret, confirmed, last_step FROM user_totp WHERE user_id = $1`
+	var t TOTP
+	err := s.Pool.QueryRow(ctx, query, idUser).Scan(&t.Secret, &t.Confirmed, &t.LastStep)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TOTP{}, Invaliddata
+		}
+		return TOTP{}, SomeWrong
+	}
+	return t, nil
+}
+
+// SaveTOTPSecret сохраняет новый неподтвержденный секрет; подтвержденный секрет не перезаписывается
+func (s *StructPool) SaveTOTPSecret(ctx context.Context, idUser int, secret string) error {
+	const query = `INSERT INTO user_totp (user_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, created_at = $3
+		WHERE user_totp.confirmed = false`
+	commandtag, err := s.Pool.Exec(ctx, query, idUser, secret, time.Now())
+	if err != nil {
+		return SomeWrong
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Forbidden
+	}
+	return nil
+}
+
+// ConfirmTOTP включает 2fa и заменяет коды восстановления
+func (s *StructPool) ConfirmTOTP(ctx context.Context, idUser int, step int64, recoveryHashes []string) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	const query1 = `UPDATE user_totp SET confirmed = true, last_step = $2
+		WHERE user_id = $1 AND confirmed = false`
+	commandtag, err := tx.Exec(ctx, query1, idUser, step)
+	if err != nil {
+		return SomeWrong
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Invaliddata
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, idUser); err != nil {
+		return SomeWrong
+	}
+	const query2 = `INSERT INTO totp_recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::text[])`
+	if _, err = tx.Exec(ctx, query2, idUser, recoveryHashes); err != nil {
+		return SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// UseTOTPStep запоминает шаг принятого кода; код того же или более раннего шага повторно не принимается
+func (s *StructPool) UseTOTPStep(ctx context.Context, idUser int, step int64) error {
+	const query = `UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2`
+	commandtag, err := s.Pool.Exec(ctx, query, idUser, step)
+	if err != nil {
+		return SomeWrong
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Invalidtoken
+	}
+	return nil
+}
+
+// UseRecoveryCode гасит одноразовый код восстановления
+func (s *StructPool) UseRecoveryCode(ctx context.Context, idUser int, codeHash string) error {
+	const query = `UPDATE totp_recovery_codes SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	commandtag, err := s.Pool.Exec(ctx, query, idUser, codeHash, time.Now())
+	if err != nil {
+		return SomeWrong
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Invalidtoken
+	}
+	return nil
+}
+
+// CreateChallenge сохраняет хеш токена второго шага входа
+func (s *StructPool) CreateChallenge(ctx context.Context, idUser int, token Token) error {
+	const query = `INSERT INTO login_challenges (token_hash, user_id, created_at, expire_at)
+		VALUES ($1, $2, $3, $4)`
+	_, err := s.Pool.Exec(ctx, query, token.Token, idUser, token.TimeCreated, token.TimeExpired)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// UseChallenge засчитывает попытку по токену второго шага и возвращает пользователя;
+// после maxAttempts попыток или по истечении срока токен не принимается
+func (s *StructPool) UseChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	const query = `UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expire_at > $2 AND attempts < $3
+		RETURNING user_id`
+	var userId int
+	err := s.Pool.QueryRow(ctx, query, tokenHash, time.Now(), maxAttempts).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+func (s *StructPool) DeleteChallenge(ctx context.Context, tokenHash string) error {
+	const query = `DELETE FROM login_challenges WHERE token_hash = $1 OR expire_at < $2`
+	_, err := s.Pool.Exec(ctx, query, tokenHash, time.Now())
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// CreateSession создает сессию устройства: access токен хранится в sessions, refresh токен (только хеш) в refresh_tokens.
+// Срок жизни сессии равен сроку жизни refresh токена
+func (s *StructPool) CreateSession(ctx context.Context, idUser int, access Token, refresh Token, meta SessionMeta) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	const query1 = `INSERT INTO sessions (token, created_at, access_expire_at, expire_at, user_id, user_agent, ip)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING token_id`
+	var sessionId int
+	err = tx.QueryRow(ctx, query1, access.Token, access.TimeCreated, access.TimeExpired, refresh.TimeExpired, idUser, meta.UserAgent, meta.IP).Scan(&sessionId)
+	if err != nil {
+		return SomeWrong
+	}
+	const query2 = `INSERT INTO refresh_tokens (session_id, token_hash, created_at, expire_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err = tx.Exec(ctx, query2, sessionId, refresh.Token, refresh.TimeCreated, refresh.TimeExpired); err != nil {
+		return SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// RotateRefreshToken меняет refresh токен на новую пару токенов той же сессии.
+// Повторное использование уже обменянного токена отзывает всё семейство (сессию и все её refresh токены)
+func (s *StructPool) RotateRefreshToken(ctx context.Context, refreshHash string, access Token, refresh Token) (int, error) {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	const query1 = `SELECT r.id, r.session_id, r.used_at, r.expire_at, s.user_id
+		FROM refresh_tokens r
+		JOIN sessions s ON s.token_id = r.session_id
+		WHERE r.token_hash = $1
+		FOR UPDATE OF r, s`
+	var (
+		refreshId, sessionId, userId int
+		usedAt                       *time.Time
+		expireAt                     time.Time
+	)
+	err = tx.QueryRow(ctx, query1, refreshHash).Scan(&refreshId, &sessionId, &usedAt, &expireAt, &userId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+
+	if usedAt != nil {
+		// токен уже обменивали: его украли или клиент ошибся, завершаем сессию целиком
+		if _, err = revokeSessions(ctx, tx, "token_id = $2", sessionId); err != nil {
+			return 0, SomeWrong
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return 0, SomeWrong
+		}
+		return 0, TokenReused
+	}
+	if time.Since(expireAt) > 0 {
+		return 0, Invalidtoken
+	}
+
+	const query2 = `UPDATE refresh_tokens SET used_at = $2 WHERE id = $1`
+	if _, err = tx.Exec(ctx, query2, refreshId, refresh.TimeCreated); err != nil {
+		return 0, SomeWrong
+	}
+	const query3 = `INSERT INTO refresh_tokens (session_id, token_hash, created_at, expire_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err = tx.Exec(ctx, query3, sessionId, refresh.Token, refresh.TimeCreated, refresh.TimeExpired); err != nil {
+		return 0, SomeWrong
+	}
+	const query4 = `UPDATE sessions SET token = $2, access_expire_at = $3, expire_at = $4 WHERE token_id = $1`
+	if _, err = tx.Exec(ctx, query4, sessionId, access.Token, access.TimeExpired, refresh.TimeExpired); err != nil {
+		return 0, SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
 func (s *StructPool) ValidateToken(ctx context.Context, token string) (int, error) {
-	const query = `SELECT expire_at, token_id, user_id From sessions WHERE token = $1 `
+	const query = `SELECT s.access_expire_at, s.expire_at, s.token_id, s.user_id, u.disabled
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token = $1 `
 	data := struct {
-		ExpireAt time.Time
-		id       int
-		userid   int
+		AccessExpireAt time.Time
+		ExpireAt       time.Time
+		id             int
+		userid         int
+		disabled       bool
 	}{}
 
-	err := s.Pool.QueryRow(ctx, query, token).Scan(&data.ExpireAt, &data.id, &data.userid)
+	err := s.Pool.QueryRow(ctx, query, token).Scan(&data.AccessExpireAt, &data.ExpireAt, &data.id, &data.userid, &data.disabled)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return 0, Invalidtoken
 		}
 		return 0, SomeWrong
 	}
+	if data.disabled {
+		return 0, Invalidtoken
+	}
 
-	if time.Since(data.ExpireAt).Seconds() > 0 {
-		go func() {
-			deletecontext, cancel := context.WithTimeout(context.Background(), time.Second*3)
-			defer cancel()
-			_ = s.DeleteToken(deletecontext, data.id)
-		}()
+	if time.Since(data.AccessExpireAt).Seconds() > 0 {
+		// сессию удаляем только когда истек и refresh токен
+		if time.Since(data.ExpireAt).Seconds() > 0 {
+			go func() {
+				deletecontext, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_ = s.DeleteSessionById(deletecontext, data.userid, data.id)
+			}()
+		}
 		return 0, Invalidtoken
 	}
 	return data.userid, nil
 
 }
-func (s *StructPool) DeleteToken(ctx context.Context, idUser int) error {
-	const query = `DELETE FROM sessions WHERE user_id = $1`
-	_, err := s.Pool.Exec(ctx, query, idUser)
+
+// revokeSessions удаляет сессии по условию where (аргументы с $2) и запоминает их ещё не истекшие
+// access токены в revoked_tokens, чтобы подписанные токены этих сессий перестали приниматься
+func revokeSessions(ctx context.Context, q interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}, where string, args ...any) (int, error) {
+	query := `WITH deleted AS (
+			DELETE FROM sessions WHERE ` + where + ` RETURNING token, access_expire_at
+		), revoked AS (
+			INSERT INTO revoked_tokens (token, expire_at)
+			SELECT token, access_expire_at FROM deleted WHERE access_expire_at > $1
+			ON CONFLICT DO NOTHING
+		)
+		SELECT count(*) FROM deleted`
+	var n int
+	err := q.QueryRow(ctx, query, append([]any{time.Now()}, args...)...).Scan(&n)
+	return n, err
+}
+
+// DeleteToken удаляет одну сессию (выход с текущего устройства)
+func (s *StructPool) DeleteToken(ctx context.Context, token string) error {
+	_, err := revokeSessions(ctx, s.Pool, "token = $2", token)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// ListRevoked access токены удаленных сессий, срок которых еще не истек; истекшие записи чистятся
+func (s *StructPool) ListRevoked(ctx context.Context) ([]string, error) {
+	now := time.Now()
+	if _, err := s.Pool.Exec(ctx, `DELETE FROM revoked_tokens WHERE expire_at <= $1`, now); err != nil {
+		return nil, SomeWrong
+	}
+	rows, err := s.Pool.Query(ctx, `SELECT token FROM revoked_tokens`)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, token)
+	}
+	return results, rows.Err()
+}
+
+func (s *StructPool) ListSessions(ctx context.Context, idUser int, currentToken string) ([]Session, error) {
+	const query = `SELECT token_id, created_at, expire_at, user_agent, ip, token = $2
+		FROM sessions
+		WHERE user_id = $1 AND expire_at > $3
+		ORDER BY created_at DESC`
+
+	rows, err := s.Pool.Query(ctx, query, idUser, currentToken, time.Now())
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.Id, &sess.CreatedAt, &sess.ExpireAt, &sess.UserAgent, &sess.IP, &sess.Current); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, sess)
+	}
+	return results, rows.Err()
+}
+
+func (s *StructPool) DeleteSessionById(ctx context.Context, idUser int, idSession int) error {
+	n, err := revokeSessions(ctx, s.Pool, "token_id = $2 AND user_id = $3", idSession, idUser)
+	if err != nil {
+		return SomeWrong
+	}
+	if n == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+// DeleteUserSessions выход со всех устройств
+func (s *StructPool) DeleteUserSessions(ctx context.Context, idUser int) error {
+	_, err := revokeSessions(ctx, s.Pool, "user_id = $2", idUser)
 	if err != nil {
 		return SomeWrong
 	}
 	return nil
 }
 
+// PurgeExpired удаляет истекшие сессии (вместе с refresh токенами), токены сброса пароля,
+// challenge 2fa и незавершенные входы OIDC; возвращает число удаленных сессий
+func (s *StructPool) PurgeExpired(ctx context.Context) (int, error) {
+	now := time.Now()
+	tag, err := s.Pool.Exec(ctx, `DELETE FROM sessions WHERE expire_at <= $1`, now)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	for _, table := range []string{"password_resets", "login_challenges", "oidc_logins", "revoked_tokens"} {
+		if _, err = s.Pool.Exec(ctx, `DELETE FROM `+table+` WHERE expire_at <= $1`, now); err != nil {
+			return 0, SomeWrong
+		}
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (s *StructPool) GetUser(ctx context.Context, idUser int) (User, error) {
+	const query = `SELECT id, username, role, disabled, created_at FROM users WHERE id = $1`
+	var u User
+	err := s.Pool.QueryRow(ctx, query, idUser).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, UnknownUser
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+// GetUserByLogin пользователь по логину, в том числе заблокированный; UnknownUser, если его нет
+func (s *StructPool) GetUserByLogin(ctx context.Context, username string) (User, error) {
+	const query = `SELECT id, username, role, disabled, created_at FROM users WHERE username = $1`
+	var u User
+	err := s.Pool.QueryRow(ctx, query, username).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, UnknownUser
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+func (s *StructPool) ListUsers(ctx context.Context) ([]User, error) {
+	const query = `SELECT id, username, role, disabled, created_at FROM users ORDER BY id`
+	rows, err := s.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, u)
+	}
+	return results, rows.Err()
+}
+
+// CreateUser создает пользователя с ролью; Invaliddata - логин занят
+func (s *StructPool) CreateUser(ctx context.Context, username, passHash, role string) (User, error) {
+	const query = `INSERT INTO users (username, pass_hash, role, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+		RETURNING id, username, role, disabled, created_at`
+	var u User
+	err := s.Pool.QueryRow(ctx, query, username, passHash, role, time.Now()).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, Invaliddata
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+// SetUserDisabled блокирует или разблокирует пользователя; при блокировке все его сессии завершаются
+func (s *StructPool) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	const query = `UPDATE users SET disabled = $2 WHERE username = $1 RETURNING id`
+	var id int
+	err = tx.QueryRow(ctx, query, username, disabled).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return UnknownUser
+		}
+		return SomeWrong
+	}
+	if disabled {
+		if _, err = revokeSessions(ctx, tx, "user_id = $2", id); err != nil {
+			return SomeWrong
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// DeleteUser удаляет пользователя вместе с его документами, грантами и сессиями.
+// Файлы документов (всех версий) ставятся в очередь на удаление из хранилища в той же транзакции
+func (s *StructPool) DeleteUser(ctx context.Context, username string) (DeletedUser, error) {
+	return s.deleteUser(ctx, `SELECT id FROM users WHERE username = $1 FOR UPDATE`, username)
+}
+
+// DeleteAccount то же, что DeleteUser, по id пользователя (удаление своего аккаунта)
+func (s *StructPool) DeleteAccount(ctx context.Context, idUser int) (DeletedUser, error) {
+	return s.deleteUser(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, idUser)
+}
+
+func (s *StructPool) deleteUser(ctx context.Context, lockQuery string, arg any) (DeletedUser, error) {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var id int
+	err = tx.QueryRow(ctx, lockQuery, arg).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DeletedUser{}, UnknownUser
+		}
+		return DeletedUser{}, SomeWrong
+	}
+	var deleted DeletedUser
+	rows, err := tx.Query(ctx, `SELECT id FROM documents WHERE own_id = $1`, id)
+	if err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	if deleted.Documents, err = pgx.CollectRows(rows, pgx.RowTo[uuid.UUID]); err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	if deleted.Files, err = queueDockFiles(ctx, tx, "d.own_id = $1", id); err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	if _, err = revokeSessions(ctx, tx, "user_id = $2", id); err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return DeletedUser{}, SomeWrong
+	}
+	return deleted, nil
+}
+
+func (s *StructPool) HasAdmin(ctx context.Context) (bool, error) {
+	const query = `SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)`
+	var exists bool
+	if err := s.Pool.QueryRow(ctx, query, RoleAdmin).Scan(&exists); err != nil {
+		return false, SomeWrong
+	}
+	return exists, nil
+}
+
+func (s *StructPool) AddAudit(ctx context.Context, idAdmin int, action, target string) error {
+	query := `INSERT INTO admin_audit (admin_id, admin_login, action, target, created_at)
+		SELECT id, username, $2, $3, $4 FROM users WHERE id = $1`
+	args := []any{idAdmin, action, target, time.Now()}
+	if idAdmin == SystemAdmin {
+		query = `INSERT INTO admin_audit (admin_id, admin_login, action, target, created_at)
+			VALUES (NULL, $1, $2, $3, $4)`
+		args[0] = SystemLogin
+	}
+	_, err := s.Pool.Exec(ctx, query, args...)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *StructPool) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	const query = `SELECT id, admin_login, action, target, created_at FROM admin_audit
+		ORDER BY id DESC
+		LIMIT $1`
+	rows, err := s.Pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Id, &e.Admin, &e.Action, &e.Target, &e.CreatedAt); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
+
 // //////////////////////////////////////////////////////////////////////////////////////////////////////////
-func (s *StructPool) Begin(ctx context.Context) (pgx.Tx, error) {
-	return s.Pool.BeginTx(ctx, pgx.TxOptions{})
+// pgDockTx операции WithTx в транзакции PostgreSQL
+type pgDockTx struct {
+	tx pgx.Tx
+}
+
+// WithTx выполняет fn в транзакции SERIALIZABLE и повторяет ее при конфликте сериализации
+// или взаимной блокировке; на READ COMMITTED PostgreSQL конфликты сериализации не сообщает
+func (s *StructPool) WithTx(ctx context.Context, fn func(tx DockTx) error) error {
+	opts := pgx.TxOptions{IsoLevel: pgx.Serializable}
+	return retryTx(ctx, isSerializationFailure, func() error {
+		return pgx.BeginTxFunc(ctx, s.Pool, opts, func(tx pgx.Tx) error { return fn(pgDockTx{tx: tx}) })
+	})
+}
+
+// isSerializationFailure транзакцию откатил сам PostgreSQL, ее можно повторить целиком
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
 }
 
-func (s *StructPool) NewDocs(ctx context.Context, dock Dock, tx pgx.Tx) (bool, error) {
+func (t pgDockTx) NewDocs(ctx context.Context, dock Dock) (bool, error) {
 	const query = `INSERT INTO documents 
     (id, name, public,is_file,mime,json_data,file_path, own_id)
     VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
 
-	_, err := tx.Exec(ctx, query, dock.Id, dock.Name, dock.Public,
+	_, err := t.tx.Exec(ctx, query, dock.Id, dock.Name, dock.Public,
 		dock.IsFile, dock.Mime, dock.Json, dock.Filepath, dock.OwnerId)
 	if err != nil {
 		return false, err
@@ -106,35 +779,86 @@ func (s *StructPool) NewDocs(ctx context.Context, dock Dock, tx pgx.Tx) (bool, e
 	return true, nil
 
 }
-func (s *StructPool) AddGrant(ctx context.Context, grants []string, docid uuid.UUID, tx pgx.Tx) (bool, error) {
+func (t pgDockTx) AddGrant(ctx context.Context, grants []string, role string, docid uuid.UUID) (bool, error) {
 	values := []interface{}{}
 	placeholders := []string{}
+	unknown := []string{}
 	argIdx := 1
 
 	for _, grant := range grants {
 		var userID int
-		err := tx.QueryRow(ctx, "SELECT id FROM users WHERE username=$1", grant).Scan(&userID)
+		err := t.tx.QueryRow(ctx, "SELECT id FROM users WHERE username=$1", grant).Scan(&userID)
 		if err != nil {
 			if err == pgx.ErrNoRows {
+				unknown = append(unknown, grant)
 				continue
 			}
 			return false, err
 		}
-		placeholders = append(placeholders, fmt.Sprintf("($%d, $%d)", argIdx, argIdx+1))
-		values = append(values, docid, userID)
-		argIdx += 2
+		placeholders = append(placeholders, fmt.Sprintf("($%d, $%d, $%d)", argIdx, argIdx+1, argIdx+2))
+		values = append(values, docid, userID, role)
+		argIdx += 3
+	}
+	if len(unknown) > 0 {
+		return false, fmt.Errorf("%w: %s", UnknownUser, strings.Join(unknown, ", "))
+	}
+	if len(placeholders) == 0 {
+		return true, nil
 	}
 	query := fmt.Sprintf(`
-        INSERT INTO document_grants(document_id, granted_user_id) 
+        INSERT INTO document_grants(document_id, granted_user_id, role) 
         VALUES %s 
-        ON CONFLICT DO NOTHING`, strings.Join(placeholders, ","))
+        ON CONFLICT (document_id, granted_user_id) DO UPDATE SET role = EXCLUDED.role`, strings.Join(placeholders, ","))
 
-	_, err := tx.Exec(ctx, query, values...)
+	_, err := t.tx.Exec(ctx, query, values...)
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
+
+func (s *StructPool) ListGrants(ctx context.Context, idDock uuid.UUID) ([]Grant, error) {
+	const query = `SELECT u.username, g.role, g.created_at
+		FROM document_grants g
+		JOIN users u ON u.id = g.granted_user_id
+		WHERE g.document_id = $1
+		ORDER BY u.username`
+
+	rows, err := s.Pool.Query(ctx, query, idDock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Login, &g.Role, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, g)
+	}
+	return results, rows.Err()
+}
+
+// RevokeGrant удаляет грант и возвращает id пользователя, у которого он был отозван
+func (s *StructPool) RevokeGrant(ctx context.Context, idDock uuid.UUID, login string) (int, error) {
+	const query = `DELETE FROM document_grants g
+		USING users u
+		WHERE g.granted_user_id = u.id
+		  AND g.document_id = $1 AND u.username = $2
+		RETURNING g.granted_user_id`
+
+	var revoked int
+	err := s.Pool.QueryRow(ctx, query, idDock, login).Scan(&revoked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, Invaliddata
+		}
+		return 0, err
+	}
+	return revoked, nil
+}
+
 func (s *StructPool) GetDock(ctx context.Context, filter GetDock) ([]DocumentWithGrants, error) {
 	allowedColumns := map[string]bool{
 		"name":       true,
@@ -190,22 +914,22 @@ func (s *StructPool) GetDock(ctx context.Context, filter GetDock) ([]DocumentWit
             COALESCE(d.file_path, '') as file_path,
 			COALESCE(array_agg(u.username) FILTER (WHERE u.username IS NOT NULL), '{}') as granted_users
         FROM documents d
-        JOIN users u ON d.own_id = u.id
+        JOIN users o ON d.own_id = o.id
         LEFT JOIN document_grants g ON d.id = g.document_id
-        LEFT JOIN users u2 ON g.granted_user_id = u2.id
+        LEFT JOIN users u ON g.granted_user_id = u.id
         WHERE 
             (
-                (d.public = TRUE AND d.own_id = u.id)
+                d.public = TRUE
                 OR
-                (g.granted_user_id = u.id)
+                EXISTS (SELECT 1 FROM document_grants mg WHERE mg.document_id = d.id AND mg.granted_user_id = $4)
             )
             AND d.%s = $1
-            AND u.username = $2
+            AND o.username = $2
         GROUP BY d.id
         LIMIT $3
     `, filter.Key)
 
-		rows, err = s.Pool.Query(ctx, query, filter.Value, filter.Login, filter.Limit)
+		rows, err = s.Pool.Query(ctx, query, filter.Value, filter.Login, filter.Limit, filter.Id)
 		if err != nil {
 			return nil, err
 		}
@@ -223,7 +947,35 @@ func (s *StructPool) GetDock(ctx context.Context, filter GetDock) ([]DocumentWit
 	return results, nil
 }
 
-func (s *StructPool) GetDockById(ctx context.Context, idUser int, idDock uuid.UUID) (DocumentWithGrants, error) {
+// ListOwnedDocks все документы владельца с содержимым (для выгрузки аккаунта)
+func (s *StructPool) ListOwnedDocks(ctx context.Context, idUser int) ([]DocumentWithGrants, error) {
+	const query = `SELECT d.id, d.name, d.mime, d.is_file, d.public, d.created_at, d.json_data,
+			COALESCE(d.file_path, '') as file_path,
+			COALESCE(array_agg(u.username) FILTER (WHERE u.username IS NOT NULL), '{}') as granted_users
+		FROM documents d
+		LEFT JOIN document_grants g ON d.id = g.document_id
+		LEFT JOIN users u ON g.granted_user_id = u.id
+		WHERE d.own_id = $1
+		GROUP BY d.id
+		ORDER BY d.created_at`
+
+	rows, err := s.Pool.Query(ctx, query, idUser)
+	if err != nil {
+		return nil, Internal
+	}
+	defer rows.Close()
+	results := []DocumentWithGrants{}
+	for rows.Next() {
+		var d DocumentWithGrants
+		if err := rows.Scan(&d.ID, &d.Name, &d.Mime, &d.IsFile, &d.Public, &d.CreatedAt, &d.Json, &d.Filepath, &d.GrantedUsers); err != nil {
+			return nil, Internal
+		}
+		results = append(results, d)
+	}
+	return results, rows.Err()
+}
+
+func (s *StructPool) GetDockById(ctx context.Context, idDock uuid.UUID) (DocumentWithGrants, error) {
 	data := DocumentWithGrants{}
 	const query = `SELECT d.id,
             d.name,
@@ -237,11 +989,11 @@ func (s *StructPool) GetDockById(ctx context.Context, idUser int, idDock uuid.UU
 FROM documents d 
 LEFT JOIN document_grants g ON d.id = g.document_id
 LEFT JOIN users u ON g.granted_user_id = u.id
-WHERE d.id = $1 and d.own_id = $2
+WHERE d.id = $1
 GROUP BY d.id
 `
 
-	err := s.Pool.QueryRow(ctx, query, idDock, idUser).Scan(&data.ID, &data.Name,
+	err := s.Pool.QueryRow(ctx, query, idDock).Scan(&data.ID, &data.Name,
 		&data.Mime, &data.IsFile, &data.Public, &data.CreatedAt, &data.Json, &data.Filepath, &data.GrantedUsers)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -252,15 +1004,363 @@ GROUP BY d.id
 	return data, nil
 }
 
-func (s *StructPool) DeleteDock(ctx context.Context, idUser int, idDock uuid.UUID) error {
-	const query = `DELETE FROM documents WHERE id = $1 AND own_id = $2`
+// DeleteDock удаляет документ; его файлы (всех версий) в той же транзакции ставятся
+// в очередь blob_deletions, из хранилища их убирает BlobGC
+func (s *StructPool) DeleteDock(ctx context.Context, idDock uuid.UUID) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return Internal
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
 
-	commandtag, err := s.Pool.Exec(ctx, query, idDock, idUser)
+	if _, err = queueDockFiles(ctx, tx, "d.id = $1", idDock); err != nil {
+		return Internal
+	}
+	commandtag, err := tx.Exec(ctx, `DELETE FROM documents WHERE id = $1`, idDock)
 	if err != nil {
 		return Internal
 	}
 	if commandtag.RowsAffected() == 0 {
-		return Forbidden
+		return Invaliddata
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return Internal
+	}
+	return nil
+}
+
+// queueDockFiles ставит в очередь на удаление файлы документов d (и всех их версий), выбранных условием where с $1
+func queueDockFiles(ctx context.Context, tx pgx.Tx, where string, arg any) ([]string, error) {
+	query := fmt.Sprintf(`SELECT d.file_path FROM documents d WHERE %[1]s AND COALESCE(d.file_path, '') <> ''
+		UNION
+		SELECT v.file_path FROM document_versions v JOIN documents d ON d.id = v.document_id
+		WHERE %[1]s AND COALESCE(v.file_path, '') <> ''`, where)
+	rows, err := tx.Query(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	files, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil || len(files) == 0 {
+		return files, err
+	}
+	const insert = `INSERT INTO blob_deletions (key, created_at) SELECT unnest($1::text[]), $2
+		ON CONFLICT (key) DO NOTHING`
+	if _, err = tx.Exec(ctx, insert, files, time.Now()); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// PendingBlobDeletions ключи из очереди на удаление. Ключ, на который снова ссылается документ
+// или версия, из очереди просто убирается
+func (s *StructPool) PendingBlobDeletions(ctx context.Context, limit int) ([]string, error) {
+	const cleanup = `DELETE FROM blob_deletions b
+		WHERE EXISTS (SELECT 1 FROM documents d WHERE d.file_path = b.key)
+			OR EXISTS (SELECT 1 FROM document_versions v WHERE v.file_path = b.key)`
+	if _, err := s.Pool.Exec(ctx, cleanup); err != nil {
+		return nil, SomeWrong
+	}
+	const query = `SELECT key FROM blob_deletions ORDER BY attempts, created_at LIMIT $1`
+	rows, err := s.Pool.Query(ctx, query, limit)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, SomeWrong
+	}
+	return keys, nil
+}
+
+func (s *StructPool) BlobDeleted(ctx context.Context, key string) error {
+	if _, err := s.Pool.Exec(ctx, `DELETE FROM blob_deletions WHERE key = $1`, key); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *StructPool) BlobDeleteFailed(ctx context.Context, key string, reason string) error {
+	const query = `UPDATE blob_deletions SET attempts = attempts + 1, last_error = $2 WHERE key = $1`
+	if _, err := s.Pool.Exec(ctx, query, key, reason); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// ReferencedBlobs ключи, которые нельзя считать сиротами: файлы документов, версий и очереди на удаление
+func (s *StructPool) ReferencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	const query = `SELECT file_path FROM documents WHERE COALESCE(file_path, '') <> ''
+		UNION SELECT file_path FROM document_versions WHERE COALESCE(file_path, '') <> ''
+		UNION SELECT key FROM blob_deletions`
+	rows, err := s.Pool.Query(ctx, query)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	keys := map[string]struct{}{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, SomeWrong
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, rows.Err()
+}
+
+// GetDockForUpdate блокирует строку документа до конца транзакции
+func (t pgDockTx) GetDockForUpdate(ctx context.Context, idDock uuid.UUID) (Dock, error) {
+	const query = `SELECT id, is_file, public, name, mime, json_data, COALESCE(file_path, ''), own_id
+		FROM documents WHERE id = $1
+		FOR UPDATE`
+	var d Dock
+	err := t.tx.QueryRow(ctx, query, idDock).Scan(&d.Id, &d.IsFile, &d.Public,
+		&d.Name, &d.Mime, &d.Json, &d.Filepath, &d.OwnerId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Dock{}, Invaliddata
+		}
+		return Dock{}, err
+	}
+	return d, nil
+}
+
+func (t pgDockTx) UpdateDock(ctx context.Context, dock Dock) error {
+	const query = `UPDATE documents
+		SET name = $2, public = $3, is_file = $4, mime = $5, json_data = $6, file_path = $7
+		WHERE id = $1`
+
+	commandtag, err := t.tx.Exec(ctx, query, dock.Id, dock.Name, dock.Public,
+		dock.IsFile, dock.Mime, dock.Json, dock.Filepath)
+	if err != nil {
+		return err
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+// AddVersion сохраняет снимок документа следующим номером версии
+func (t pgDockTx) AddVersion(ctx context.Context, dock Dock, authorId int, hash string) (int, error) {
+	const query = `INSERT INTO document_versions
+    (document_id, version, author_id, content_hash, name, public, is_file, mime, json_data, file_path)
+    SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9
+    FROM document_versions WHERE document_id = $1
+    RETURNING version`
+	var version int
+	err := t.tx.QueryRow(ctx, query, dock.Id, authorId, hash, dock.Name, dock.Public,
+		dock.IsFile, dock.Mime, dock.Json, dock.Filepath).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+const versionColumns = `v.document_id,
+            v.name,
+            v.mime,
+            v.is_file,
+            v.public,
+            v.created_at,
+            v.json_data,
+            COALESCE(v.file_path, '') as file_path,
+            v.version,
+            COALESCE(v.author_id, 0),
+            COALESCE(u.username, '') as author,
+            v.content_hash`
+
+func scanVersion(row pgx.Row) (DockVersion, error) {
+	var v DockVersion
+	err := row.Scan(&v.ID, &v.Name, &v.Mime, &v.IsFile, &v.Public, &v.CreatedAt, &v.Json,
+		&v.Filepath, &v.Version, &v.AuthorId, &v.Author, &v.ContentHash)
+	return v, err
+}
+
+func (s *StructPool) ListVersions(ctx context.Context, idDock uuid.UUID) ([]DockVersion, error) {
+	query := `SELECT ` + versionColumns + `
+        FROM document_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.document_id = $1
+        ORDER BY v.version`
+
+	rows, err := s.Pool.Query(ctx, query, idDock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DockVersion
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, Invaliddata
+	}
+	return results, nil
+}
+
+func (s *StructPool) GetVersion(ctx context.Context, idDock uuid.UUID, version int) (DockVersion, error) {
+	query := `SELECT ` + versionColumns + `
+        FROM document_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.document_id = $1 AND v.version = $2`
+
+	v, err := scanVersion(s.Pool.QueryRow(ctx, query, idDock, version))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DockVersion{}, Invaliddata
+		}
+		return DockVersion{}, err
+	}
+	return v, nil
+}
+
+// GetDockRole роль пользователя в документе: owner, роль из гранта, public для публичных
+// документов (в том числе для анонимного idUser = 0) или Invaliddata, если доступа нет
+func (s *StructPool) GetDockRole(ctx context.Context, idUser int, idDock uuid.UUID) (string, error) {
+	const query = `SELECT CASE
+			WHEN d.own_id = $2 THEN 'owner'
+			WHEN g.role IS NOT NULL THEN g.role
+			WHEN d.public THEN 'public'
+			ELSE '' END
+		FROM documents d
+		LEFT JOIN document_grants g ON g.document_id = d.id AND g.granted_user_id = $2
+		WHERE d.id = $1`
+
+	var role string
+	err := s.Pool.QueryRow(ctx, query, idDock, idUser).Scan(&role)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", err
+	}
+	if role == "" {
+		return "", Invaliddata
+	}
+	return role, nil
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, created_at, expire_at, last_used_at`
+
+func scanAPIKey(row pgx.Row) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.Id, &k.UserId, &k.Name, &k.Prefix, &k.Scopes, &k.CreatedAt, &k.ExpireAt, &k.LastUsedAt)
+	return k, err
+}
+
+func (s *StructPool) CreateAPIKey(ctx context.Context, idUser int, keyHash string, key APIKey) (APIKey, error) {
+	query := `INSERT INTO api_keys (user_id, name, key_hash, prefix, scopes, created_at, expire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + apiKeyColumns
+	created, err := scanAPIKey(s.Pool.QueryRow(ctx, query, idUser, key.Name, keyHash, key.Prefix, key.Scopes, key.CreatedAt, key.ExpireAt))
+	if err != nil {
+		return APIKey{}, SomeWrong
+	}
+	return created, nil
+}
+
+func (s *StructPool) ListAPIKeys(ctx context.Context, idUser int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := s.Pool.Query(ctx, query, idUser)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, k)
+	}
+	return results, rows.Err()
+}
+
+func (s *StructPool) DeleteAPIKey(ctx context.Context, idUser int, idKey int) error {
+	const query = `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+	commandtag, err := s.Pool.Exec(ctx, query, idKey, idUser)
+	if err != nil {
+		return SomeWrong
+	}
+	if commandtag.RowsAffected() == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+// UseAPIKey действующий ключ по хешу; заодно обновляет last_used_at
+func (s *StructPool) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	const query = `UPDATE api_keys k SET last_used_at = $2
+		FROM users u
+		WHERE k.key_hash = $1 AND u.id = k.user_id AND NOT u.disabled
+			AND (k.expire_at IS NULL OR k.expire_at > $2)
+		RETURNING k.id, k.user_id, k.name, k.prefix, k.scopes, k.created_at, k.expire_at, k.last_used_at`
+	k, err := scanAPIKey(s.Pool.QueryRow(ctx, query, keyHash, time.Now()))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return APIKey{}, Invalidtoken
+		}
+		return APIKey{}, SomeWrong
+	}
+	return k, nil
+}
+
+func (s *StructPool) CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error {
+	const query = `INSERT INTO oidc_logins (state_hash, verifier, nonce, created_at, expire_at, link_user_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))`
+	_, err := s.Pool.Exec(ctx, query, stateHash, login.Verifier, login.Nonce, login.CreatedAt, login.ExpireAt, login.LinkUserId)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+// UseOIDCLogin удаляет незавершенный вход и возвращает его, если он не истек
+func (s *StructPool) UseOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error) {
+	const query = `DELETE FROM oidc_logins WHERE state_hash = $1
+		RETURNING verifier, nonce, created_at, expire_at, COALESCE(link_user_id, 0)`
+	var l OIDCLogin
+	err := s.Pool.QueryRow(ctx, query, stateHash).Scan(&l.Verifier, &l.Nonce, &l.CreatedAt, &l.ExpireAt, &l.LinkUserId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return OIDCLogin{}, Invalidtoken
+		}
+		return OIDCLogin{}, SomeWrong
+	}
+	if time.Now().After(l.ExpireAt) {
+		return OIDCLogin{}, Invalidtoken
+	}
+	return l, nil
+}
+
+func (s *StructPool) FindIdentity(ctx context.Context, issuer, subject string) (int, error) {
+	const query = `SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2`
+	var userId int
+	err := s.Pool.QueryRow(ctx, query, issuer, subject).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, Invaliddata
+		}
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+func (s *StructPool) LinkIdentity(ctx context.Context, issuer, subject string, idUser int) error {
+	const query = `INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO NOTHING`
+	_, err := s.Pool.Exec(ctx, query, issuer, subject, idUser, time.Now())
+	if err != nil {
+		return SomeWrong
 	}
 	return nil
 }
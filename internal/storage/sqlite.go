@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gomodlag/internal/logger"
+	"io/fs"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteOptions параметры соединения: время пишется целым числом наносекунд и читается обратно как time.Time,
+// транзакции сразу берут блокировку записи (писатель в SQLite один, ждет его до busy_timeout)
+const sqliteOptions = "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)" +
+	"&_txlock=immediate&_time_integer_format=unix_nano&_inttotime=true"
+
+// SQLite хранилище в одном файле для развертывания на одном узле; семантика та же, что у StructPool
+type SQLite struct {
+	DB *sql.DB
+}
+
+// OpenSQLite открывает (или создает) базу в файле path
+func OpenSQLite(path string, logger logger.Logger) (*SQLite, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sql.Open("sqlite", path+sep+sqliteOptions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB config: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("connection db error: %w", err)
+	}
+	logger.Info("Successfully connected to sqlite", slog.String("path", path))
+	return &SQLite{DB: db}, nil
+}
+
+// sqliteDockTx операции WithTx в транзакции SQLite
+type sqliteDockTx struct {
+	tx *sql.Tx
+}
+
+// WithTx выполняет fn в транзакции; транзакция, не дождавшаяся блокировки записи, повторяется
+func (s *SQLite) WithTx(ctx context.Context, fn func(tx DockTx) error) error {
+	return retryTx(ctx, isSQLiteBusy, func() error {
+		return s.inTx(ctx, func(tx *sql.Tx) error { return fn(sqliteDockTx{tx: tx}) })
+	})
+}
+
+// isSQLiteBusy база занята другим писателем дольше busy_timeout
+func isSQLiteBusy(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && e.Code()&0xff == sqlite3.SQLITE_BUSY
+}
+
+// inTx выполняет fn в транзакции и фиксирует ее, если fn не вернула ошибку
+func (s *SQLite) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLiteMigrations встроенные миграции схемы SQLite; версии и имена совпадают с миграциями PostgreSQL
+func SQLiteMigrations() ([]Migration, error) {
+	dir, err := fs.Sub(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(dir)
+}
+
+// MigrateUp применяет все непримененные миграции, каждую в своей транзакции
+func (s *SQLite) MigrateUp(ctx context.Context, logger logger.Logger) (int, error) {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		return 0, err
+	}
+	done, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for v := range done {
+		if !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == v }) {
+			logger.Warn("Unknown migration in database", slog.Int("version", v))
+		}
+	}
+	applied := 0
+	for _, m := range migrations {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		changed, err := s.migrate(ctx, m, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if changed {
+			logger.Info("Migration applied", slog.Int("version", m.Version), slog.String("name", m.Name))
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown откатывает steps последних примененных миграций
+func (s *SQLite) MigrateDown(ctx context.Context, steps int, logger logger.Logger) (int, error) {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		return 0, err
+	}
+	done, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reverted := 0
+	for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+		m := migrations[i]
+		if _, ok := done[m.Version]; !ok {
+			continue
+		}
+		changed, err := s.migrate(ctx, m, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if changed {
+			logger.Info("Migration reverted", slog.Int("version", m.Version), slog.String("name", m.Name))
+			reverted++
+		}
+	}
+	return reverted, nil
+}
+
+// MigrationStatus все встроенные миграции с отметкой о применении
+func (s *SQLite) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := SQLiteMigrations()
+	if err != nil {
+		return nil, err
+	}
+	done, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if at, ok := done[m.Version]; ok {
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// migrate применяет (up) или откатывает миграцию. Advisory lock в SQLite нет: транзакция берет блокировку
+// записи и заново проверяет schema_migrations, поэтому второй процесс ту же миграцию пропустит
+func (s *SQLite) migrate(ctx context.Context, m Migration, up bool) (bool, error) {
+	changed := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT count(*) FROM schema_migrations WHERE version = $1`, m.Version).Scan(&n); err != nil {
+			return err
+		}
+		if (n > 0) == up {
+			return nil
+		}
+		if !up {
+			if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+			changed = err == nil
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			m.Version, m.Name, time.Now())
+		changed = err == nil
+		return err
+	})
+	return changed, err
+}
+
+// appliedMigrations примененные версии; таблица schema_migrations создается при первом обращении
+func (s *SQLite) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	const schema = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version int PRIMARY KEY,
+		name text not null,
+		applied_at timestamp not null
+		)`
+	if _, err := s.DB.ExecContext(ctx, schema); err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		done[version] = at
+	}
+	return done, rows.Err()
+}
@@ -0,0 +1,1281 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Запросы SQLite повторяют запросы StructPool; отличия - там, где у SQLite нет нужной конструкции:
+// массивы (= ANY, unnest, array_agg) заменены циклами и json, FOR UPDATE не нужен - транзакция
+// сразу берет блокировку записи
+
+// scanner *sql.Row или *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// jsonArg json документа как текст; nil остается NULL
+func jsonArg(data json.RawMessage) any {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+// placeholders $from, $from+1, ... для n значений
+func placeholders(from, n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", from+i)
+	}
+	return strings.Join(list, ", ")
+}
+
+func (s *SQLite) Register(ctx context.Context, password, username string) (string, error) {
+	const query = `INSERT INTO users (username, pass_hash)
+					VALUES ($1, $2)
+					ON CONFLICT DO NOTHING
+					RETURNING username`
+	var login string
+	err := s.DB.QueryRowContext(ctx, query, username, password).Scan(&login)
+	if err != nil {
+		return "", err
+	}
+	return login, nil
+}
+
+func (s *SQLite) GetCredentials(ctx context.Context, username string) (int, string, error) {
+	const query = `SELECT id, pass_hash FROM users WHERE username = $1 AND disabled = false`
+	var id int
+	var hash string
+	err := s.DB.QueryRowContext(ctx, query, username).Scan(&id, &hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", Invaliddata
+		}
+		return 0, "", SomeWrong
+	}
+	return id, hash, nil
+}
+
+func (s *SQLite) UpdatePasswordHash(ctx context.Context, idUser int, hash string) error {
+	const query = `UPDATE users SET pass_hash = $2 WHERE id = $1`
+	if _, err := s.DB.ExecContext(ctx, query, idUser, hash); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) GetPasswordHash(ctx context.Context, idUser int) (string, error) {
+	const query = `SELECT pass_hash FROM users WHERE id = $1`
+	var hash string
+	err := s.DB.QueryRowContext(ctx, query, idUser).Scan(&hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", SomeWrong
+	}
+	return hash, nil
+}
+
+func (s *SQLite) ChangePassword(ctx context.Context, idUser int, hash string, keepToken string) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET pass_hash = $2 WHERE id = $1`, idUser, hash); err != nil {
+			return err
+		}
+		_, err := revokeSQLiteSessions(ctx, tx, "user_id = $2 AND token <> $3", idUser, keepToken)
+		return err
+	})
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) CreateResetToken(ctx context.Context, username string, token Token) error {
+	const query = `INSERT INTO password_resets (user_id, token_hash, created_at, expire_at)
+		SELECT id, $2, $3, $4 FROM users WHERE username = $1`
+	result, err := s.DB.ExecContext(ctx, query, username, token.Token, token.TimeCreated, token.TimeExpired)
+	if err != nil {
+		return SomeWrong
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return UnknownUser
+	}
+	return nil
+}
+
+func (s *SQLite) UseResetToken(ctx context.Context, tokenHash string, passHash string) (int, error) {
+	var userId int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		const query1 = `UPDATE password_resets SET used_at = $2
+			WHERE token_hash = $1 AND used_at IS NULL AND expire_at > $2
+			RETURNING user_id`
+		if err := tx.QueryRowContext(ctx, query1, tokenHash, now).Scan(&userId); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Invalidtoken
+			}
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET pass_hash = $2 WHERE id = $1`, userId, passHash); err != nil {
+			return err
+		}
+		_, err := revokeSQLiteSessions(ctx, tx, "user_id = $2", userId)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, Invalidtoken) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+func (s *SQLite) GetLoginLocks(ctx context.Context, subjects ...string) (map[string]time.Time, error) {
+	locks := map[string]time.Time{}
+	if len(subjects) == 0 {
+		return locks, nil
+	}
+	query := `SELECT subject, locked_until FROM login_attempts
+		WHERE locked_until > $1 AND subject IN (` + placeholders(2, len(subjects)) + `)`
+	args := []any{time.Now()}
+	for _, subject := range subjects {
+		args = append(args, subject)
+	}
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var subject string
+		var until time.Time
+		if err := rows.Scan(&subject, &until); err != nil {
+			return nil, SomeWrong
+		}
+		locks[subject] = until
+	}
+	return locks, rows.Err()
+}
+
+func (s *SQLite) AddLoginFailure(ctx context.Context, subject string, window time.Duration) (int, error) {
+	const query = `INSERT INTO login_attempts (subject, failures, updated_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = CASE WHEN login_attempts.updated_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			updated_at = $2
+		RETURNING failures`
+	now := time.Now()
+	var failures int
+	err := s.DB.QueryRowContext(ctx, query, subject, now, now.Add(-window)).Scan(&failures)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	return failures, nil
+}
+
+func (s *SQLite) LockLogin(ctx context.Context, subject string, until time.Time) error {
+	const query = `UPDATE login_attempts SET locked_until = $2 WHERE subject = $1`
+	if _, err := s.DB.ExecContext(ctx, query, subject, until); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) ResetLoginFailures(ctx context.Context, subject string) error {
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE subject = $1`, subject); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) GetLogin(ctx context.Context, idUser int) (string, error) {
+	var login string
+	err := s.DB.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, idUser).Scan(&login)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", SomeWrong
+	}
+	return login, nil
+}
+
+func (s *SQLite) GetTOTP(ctx context.Context, idUser int) (TOTP, error) {
+	const query = `SELECT secret, confirmed, last_step FROM user_totp WHERE user_id = $1`
+	var t TOTP
+	err := s.DB.QueryRowContext(ctx, query, idUser).Scan(&t.Secret, &t.Confirmed, &t.LastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return TOTP{}, Invaliddata
+		}
+		return TOTP{}, SomeWrong
+	}
+	return t, nil
+}
+
+func (s *SQLite) SaveTOTPSecret(ctx context.Context, idUser int, secret string) error {
+	const query = `INSERT INTO user_totp (user_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, created_at = $3
+		WHERE user_totp.confirmed = false`
+	result, err := s.DB.ExecContext(ctx, query, idUser, secret, time.Now())
+	if err != nil {
+		return SomeWrong
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Forbidden
+	}
+	return nil
+}
+
+func (s *SQLite) ConfirmTOTP(ctx context.Context, idUser int, step int64, recoveryHashes []string) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		const query1 = `UPDATE user_totp SET confirmed = true, last_step = $2
+			WHERE user_id = $1 AND confirmed = false`
+		result, err := tx.ExecContext(ctx, query1, idUser, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return Invaliddata
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, idUser); err != nil {
+			return err
+		}
+		for _, hash := range recoveryHashes {
+			const query2 = `INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+			if _, err = tx.ExecContext(ctx, query2, idUser, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, Invaliddata) {
+			return Invaliddata
+		}
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) UseTOTPStep(ctx context.Context, idUser int, step int64) error {
+	const query = `UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2`
+	result, err := s.DB.ExecContext(ctx, query, idUser, step)
+	if err != nil {
+		return SomeWrong
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Invalidtoken
+	}
+	return nil
+}
+
+func (s *SQLite) UseRecoveryCode(ctx context.Context, idUser int, codeHash string) error {
+	const query = `UPDATE totp_recovery_codes SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	result, err := s.DB.ExecContext(ctx, query, idUser, codeHash, time.Now())
+	if err != nil {
+		return SomeWrong
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Invalidtoken
+	}
+	return nil
+}
+
+func (s *SQLite) CreateChallenge(ctx context.Context, idUser int, token Token) error {
+	const query = `INSERT INTO login_challenges (token_hash, user_id, created_at, expire_at)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := s.DB.ExecContext(ctx, query, token.Token, idUser, token.TimeCreated, token.TimeExpired); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) UseChallenge(ctx context.Context, tokenHash string, maxAttempts int) (int, error) {
+	const query = `UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expire_at > $2 AND attempts < $3
+		RETURNING user_id`
+	var userId int
+	err := s.DB.QueryRowContext(ctx, query, tokenHash, time.Now(), maxAttempts).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+func (s *SQLite) DeleteChallenge(ctx context.Context, tokenHash string) error {
+	const query = `DELETE FROM login_challenges WHERE token_hash = $1 OR expire_at < $2`
+	if _, err := s.DB.ExecContext(ctx, query, tokenHash, time.Now()); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) CreateSession(ctx context.Context, idUser int, access Token, refresh Token, meta SessionMeta) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		const query1 = `INSERT INTO sessions (token, created_at, access_expire_at, expire_at, user_id, user_agent, ip)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING token_id`
+		var sessionId int
+		err := tx.QueryRowContext(ctx, query1, access.Token, access.TimeCreated, access.TimeExpired, refresh.TimeExpired,
+			idUser, meta.UserAgent, meta.IP).Scan(&sessionId)
+		if err != nil {
+			return err
+		}
+		const query2 = `INSERT INTO refresh_tokens (session_id, token_hash, created_at, expire_at)
+			VALUES ($1, $2, $3, $4)`
+		_, err = tx.ExecContext(ctx, query2, sessionId, refresh.Token, refresh.TimeCreated, refresh.TimeExpired)
+		return err
+	})
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) RotateRefreshToken(ctx context.Context, refreshHash string, access Token, refresh Token) (int, error) {
+	var userId int
+	reused := false
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		const query1 = `SELECT r.id, r.session_id, r.used_at, r.expire_at, s.user_id
+			FROM refresh_tokens r
+			JOIN sessions s ON s.token_id = r.session_id
+			WHERE r.token_hash = $1`
+		var (
+			refreshId, sessionId int
+			usedAt               *time.Time
+			expireAt             time.Time
+		)
+		err := tx.QueryRowContext(ctx, query1, refreshHash).Scan(&refreshId, &sessionId, &usedAt, &expireAt, &userId)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Invalidtoken
+			}
+			return err
+		}
+		if usedAt != nil {
+			// токен уже обменивали: завершаем сессию целиком и фиксируем это
+			reused = true
+			_, err = revokeSQLiteSessions(ctx, tx, "token_id = $2", sessionId)
+			return err
+		}
+		if time.Since(expireAt) > 0 {
+			return Invalidtoken
+		}
+		if _, err = tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = $2 WHERE id = $1`, refreshId, refresh.TimeCreated); err != nil {
+			return err
+		}
+		const query3 = `INSERT INTO refresh_tokens (session_id, token_hash, created_at, expire_at)
+			VALUES ($1, $2, $3, $4)`
+		if _, err = tx.ExecContext(ctx, query3, sessionId, refresh.Token, refresh.TimeCreated, refresh.TimeExpired); err != nil {
+			return err
+		}
+		const query4 = `UPDATE sessions SET token = $2, access_expire_at = $3, expire_at = $4 WHERE token_id = $1`
+		_, err = tx.ExecContext(ctx, query4, sessionId, access.Token, access.TimeExpired, refresh.TimeExpired)
+		return err
+	})
+	switch {
+	case errors.Is(err, Invalidtoken):
+		return 0, Invalidtoken
+	case err != nil:
+		return 0, SomeWrong
+	case reused:
+		return 0, TokenReused
+	}
+	return userId, nil
+}
+
+func (s *SQLite) ValidateToken(ctx context.Context, token string) (int, error) {
+	const query = `SELECT s.access_expire_at, s.expire_at, s.token_id, s.user_id, u.disabled
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token = $1`
+	var (
+		accessExpireAt, expireAt time.Time
+		id, userId               int
+		disabled                 bool
+	)
+	err := s.DB.QueryRowContext(ctx, query, token).Scan(&accessExpireAt, &expireAt, &id, &userId, &disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, Invalidtoken
+		}
+		return 0, SomeWrong
+	}
+	if disabled {
+		return 0, Invalidtoken
+	}
+	if time.Since(accessExpireAt) > 0 {
+		// сессию удаляем только когда истек и refresh токен
+		if time.Since(expireAt) > 0 {
+			go func() {
+				deletecontext, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				defer cancel()
+				_ = s.DeleteSessionById(deletecontext, userId, id)
+			}()
+		}
+		return 0, Invalidtoken
+	}
+	return userId, nil
+}
+
+// revokeSessions revokeSQLiteSessions в отдельной транзакции
+func (s *SQLite) revokeSessions(ctx context.Context, where string, args ...any) (int, error) {
+	var n int
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		n, err = revokeSQLiteSessions(ctx, tx, where, args...)
+		return err
+	})
+	return n, err
+}
+
+// revokeSQLiteSessions удаляет сессии по условию where (аргументы с $2, как в revokeSessions)
+// и запоминает их ещё не истекшие access токены в revoked_tokens
+func revokeSQLiteSessions(ctx context.Context, tx *sql.Tx, where string, args ...any) (int, error) {
+	args = append([]any{time.Now()}, args...)
+	query := `INSERT INTO revoked_tokens (token, expire_at)
+		SELECT token, access_expire_at FROM sessions WHERE (` + where + `) AND access_expire_at > $1
+		ON CONFLICT DO NOTHING`
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE `+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (s *SQLite) DeleteToken(ctx context.Context, token string) error {
+	if _, err := s.revokeSessions(ctx, "token = $2", token); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) ListRevoked(ctx context.Context) ([]string, error) {
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expire_at <= $1`, time.Now()); err != nil {
+		return nil, SomeWrong
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT token FROM revoked_tokens`)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, token)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) ListSessions(ctx context.Context, idUser int, currentToken string) ([]Session, error) {
+	const query = `SELECT token_id, created_at, expire_at, user_agent, ip, token = $2
+		FROM sessions
+		WHERE user_id = $1 AND expire_at > $3
+		ORDER BY created_at DESC`
+	rows, err := s.DB.QueryContext(ctx, query, idUser, currentToken, time.Now())
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.Id, &sess.CreatedAt, &sess.ExpireAt, &sess.UserAgent, &sess.IP, &sess.Current); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, sess)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) DeleteSessionById(ctx context.Context, idUser int, idSession int) error {
+	n, err := s.revokeSessions(ctx, "token_id = $2 AND user_id = $3", idSession, idUser)
+	if err != nil {
+		return SomeWrong
+	}
+	if n == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+func (s *SQLite) DeleteUserSessions(ctx context.Context, idUser int) error {
+	if _, err := s.revokeSessions(ctx, "user_id = $2", idUser); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) PurgeExpired(ctx context.Context) (int, error) {
+	now := time.Now()
+	result, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE expire_at <= $1`, now)
+	if err != nil {
+		return 0, SomeWrong
+	}
+	for _, table := range []string{"password_resets", "login_challenges", "oidc_logins", "revoked_tokens"} {
+		if _, err = s.DB.ExecContext(ctx, `DELETE FROM `+table+` WHERE expire_at <= $1`, now); err != nil {
+			return 0, SomeWrong
+		}
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+func (s *SQLite) GetUser(ctx context.Context, idUser int) (User, error) {
+	const query = `SELECT id, username, role, disabled, created_at FROM users WHERE id = $1`
+	var u User
+	err := s.DB.QueryRowContext(ctx, query, idUser).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, UnknownUser
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+func (s *SQLite) GetUserByLogin(ctx context.Context, username string) (User, error) {
+	const query = `SELECT id, username, role, disabled, created_at FROM users WHERE username = $1`
+	var u User
+	err := s.DB.QueryRowContext(ctx, query, username).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, UnknownUser
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+func (s *SQLite) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, username, role, disabled, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, u)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) CreateUser(ctx context.Context, username, passHash, role string) (User, error) {
+	const query = `INSERT INTO users (username, pass_hash, role, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+		RETURNING id, username, role, disabled, created_at`
+	var u User
+	err := s.DB.QueryRowContext(ctx, query, username, passHash, role, time.Now()).Scan(&u.Id, &u.Login, &u.Role, &u.Disabled, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, Invaliddata
+		}
+		return User{}, SomeWrong
+	}
+	return u, nil
+}
+
+func (s *SQLite) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var id int
+		err := tx.QueryRowContext(ctx, `UPDATE users SET disabled = $2 WHERE username = $1 RETURNING id`, username, disabled).Scan(&id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return UnknownUser
+			}
+			return err
+		}
+		if disabled {
+			_, err = revokeSQLiteSessions(ctx, tx, "user_id = $2", id)
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, UnknownUser) {
+			return UnknownUser
+		}
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) DeleteUser(ctx context.Context, username string) (DeletedUser, error) {
+	return s.deleteUser(ctx, `SELECT id FROM users WHERE username = $1`, username)
+}
+
+func (s *SQLite) DeleteAccount(ctx context.Context, idUser int) (DeletedUser, error) {
+	return s.deleteUser(ctx, `SELECT id FROM users WHERE id = $1`, idUser)
+}
+
+func (s *SQLite) deleteUser(ctx context.Context, lockQuery string, arg any) (DeletedUser, error) {
+	var deleted DeletedUser
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var id int
+		if err := tx.QueryRowContext(ctx, lockQuery, arg).Scan(&id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return UnknownUser
+			}
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM documents WHERE own_id = $1`, id)
+		if err != nil {
+			return err
+		}
+		deleted.Documents = []uuid.UUID{}
+		for rows.Next() {
+			var doc uuid.UUID
+			if err = rows.Scan(&doc); err != nil {
+				rows.Close()
+				return err
+			}
+			deleted.Documents = append(deleted.Documents, doc)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if deleted.Files, err = queueSQLiteDockFiles(ctx, tx, "d.own_id = $1", id); err != nil {
+			return err
+		}
+		if _, err = revokeSQLiteSessions(ctx, tx, "user_id = $2", id); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, UnknownUser) {
+			return DeletedUser{}, UnknownUser
+		}
+		return DeletedUser{}, SomeWrong
+	}
+	return deleted, nil
+}
+
+func (s *SQLite) HasAdmin(ctx context.Context) (bool, error) {
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE role = $1)`, RoleAdmin).Scan(&exists); err != nil {
+		return false, SomeWrong
+	}
+	return exists, nil
+}
+
+func (s *SQLite) AddAudit(ctx context.Context, idAdmin int, action, target string) error {
+	query := `INSERT INTO admin_audit (admin_id, admin_login, action, target, created_at)
+		SELECT id, username, $2, $3, $4 FROM users WHERE id = $1`
+	args := []any{idAdmin, action, target, time.Now()}
+	if idAdmin == SystemAdmin {
+		query = `INSERT INTO admin_audit (admin_id, admin_login, action, target, created_at)
+			VALUES (NULL, $1, $2, $3, $4)`
+		args[0] = SystemLogin
+	}
+	if _, err := s.DB.ExecContext(ctx, query, args...); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	const query = `SELECT id, admin_login, action, target, created_at FROM admin_audit
+		ORDER BY id DESC
+		LIMIT $1`
+	rows, err := s.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Id, &e.Admin, &e.Action, &e.Target, &e.CreatedAt); err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
+
+// //////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (t sqliteDockTx) NewDocs(ctx context.Context, dock Dock) (bool, error) {
+	const query = `INSERT INTO documents
+    (id, name, public, is_file, mime, json_data, file_path, own_id)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := t.tx.ExecContext(ctx, query, dock.Id, dock.Name, dock.Public,
+		dock.IsFile, dock.Mime, jsonArg(dock.Json), dock.Filepath, dock.OwnerId)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (t sqliteDockTx) AddGrant(ctx context.Context, grants []string, role string, docid uuid.UUID) (bool, error) {
+	ids := []int{}
+	unknown := []string{}
+	for _, grant := range grants {
+		var userID int
+		err := t.tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", grant).Scan(&userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				unknown = append(unknown, grant)
+				continue
+			}
+			return false, err
+		}
+		ids = append(ids, userID)
+	}
+	if len(unknown) > 0 {
+		return false, fmt.Errorf("%w: %s", UnknownUser, strings.Join(unknown, ", "))
+	}
+	const query = `INSERT INTO document_grants (document_id, granted_user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (document_id, granted_user_id) DO UPDATE SET role = excluded.role`
+	for _, id := range ids {
+		if _, err := t.tx.ExecContext(ctx, query, docid, id, role); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *SQLite) ListGrants(ctx context.Context, idDock uuid.UUID) ([]Grant, error) {
+	const query = `SELECT u.username, g.role, g.created_at
+		FROM document_grants g
+		JOIN users u ON u.id = g.granted_user_id
+		WHERE g.document_id = $1
+		ORDER BY u.username`
+	rows, err := s.DB.QueryContext(ctx, query, idDock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	results := []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Login, &g.Role, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, g)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) RevokeGrant(ctx context.Context, idDock uuid.UUID, login string) (int, error) {
+	const query = `DELETE FROM document_grants
+		WHERE document_id = $1 AND granted_user_id = (SELECT id FROM users WHERE username = $2)
+		RETURNING granted_user_id`
+	var revoked int
+	err := s.DB.QueryRowContext(ctx, query, idDock, login).Scan(&revoked)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, Invaliddata
+		}
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// sqliteDockColumns колонки документа с логинами грантов; array_agg ... FILTER из PostgreSQL
+// заменен json_group_array, пустой список - []
+const sqliteDockColumns = `d.id, d.name, d.mime, d.is_file, d.public, d.created_at, d.json_data,
+	COALESCE(d.file_path, ''),
+	json_group_array(u.username ORDER BY u.username) FILTER (WHERE u.username IS NOT NULL)`
+
+const sqliteDockGrants = `LEFT JOIN document_grants g ON d.id = g.document_id
+	LEFT JOIN users u ON g.granted_user_id = u.id`
+
+func scanSQLiteDock(row scanner) (DocumentWithGrants, error) {
+	var d DocumentWithGrants
+	var data []byte
+	var granted string
+	err := row.Scan(&d.ID, &d.Name, &d.Mime, &d.IsFile, &d.Public, &d.CreatedAt, &data, &d.Filepath, &granted)
+	if err != nil {
+		return DocumentWithGrants{}, err
+	}
+	d.Json = data
+	if err = json.Unmarshal([]byte(granted), &d.GrantedUsers); err != nil {
+		return DocumentWithGrants{}, err
+	}
+	return d, nil
+}
+
+func (s *SQLite) GetDock(ctx context.Context, filter GetDock) ([]DocumentWithGrants, error) {
+	value, err := filterValue(filter.Key, filter.Value)
+	if err != nil {
+		return []DocumentWithGrants{}, err
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("LIMIT must not be negative")
+	}
+
+	var rows *sql.Rows
+	if filter.Login == "" {
+		query := fmt.Sprintf(`SELECT %s
+			FROM documents d
+			%s
+			WHERE d.own_id = $1 AND d.%s = $2
+			GROUP BY d.id
+			LIMIT $3`, sqliteDockColumns, sqliteDockGrants, filter.Key)
+		rows, err = s.DB.QueryContext(ctx, query, filter.Id, value, filter.Limit)
+	} else {
+		query := fmt.Sprintf(`SELECT %s
+			FROM documents d
+			JOIN users o ON d.own_id = o.id
+			%s
+			WHERE
+				(
+					d.public = TRUE
+					OR
+					EXISTS (SELECT 1 FROM document_grants mg WHERE mg.document_id = d.id AND mg.granted_user_id = $4)
+				)
+				AND d.%s = $1
+				AND o.username = $2
+			GROUP BY d.id
+			LIMIT $3`, sqliteDockColumns, sqliteDockGrants, filter.Key)
+		rows, err = s.DB.QueryContext(ctx, query, value, filter.Login, filter.Limit, filter.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DocumentWithGrants
+	for rows.Next() {
+		doc, err := scanSQLiteDock(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, doc)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) ListOwnedDocks(ctx context.Context, idUser int) ([]DocumentWithGrants, error) {
+	query := `SELECT ` + sqliteDockColumns + `
+		FROM documents d
+		` + sqliteDockGrants + `
+		WHERE d.own_id = $1
+		GROUP BY d.id
+		ORDER BY d.created_at`
+	rows, err := s.DB.QueryContext(ctx, query, idUser)
+	if err != nil {
+		return nil, Internal
+	}
+	defer rows.Close()
+	results := []DocumentWithGrants{}
+	for rows.Next() {
+		d, err := scanSQLiteDock(rows)
+		if err != nil {
+			return nil, Internal
+		}
+		results = append(results, d)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) GetDockById(ctx context.Context, idDock uuid.UUID) (DocumentWithGrants, error) {
+	query := `SELECT ` + sqliteDockColumns + `
+		FROM documents d
+		` + sqliteDockGrants + `
+		WHERE d.id = $1
+		GROUP BY d.id`
+	data, err := scanSQLiteDock(s.DB.QueryRowContext(ctx, query, idDock))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DocumentWithGrants{}, Invaliddata
+		}
+		return DocumentWithGrants{}, err
+	}
+	return data, nil
+}
+
+func (s *SQLite) DeleteDock(ctx context.Context, idDock uuid.UUID) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := queueSQLiteDockFiles(ctx, tx, "d.id = $1", idDock); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM documents WHERE id = $1`, idDock)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return Invaliddata
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, Invaliddata) {
+			return Invaliddata
+		}
+		return Internal
+	}
+	return nil
+}
+
+// queueSQLiteDockFiles то же, что queueDockFiles: файлы документов d и их версий в очередь на удаление
+func queueSQLiteDockFiles(ctx context.Context, tx *sql.Tx, where string, arg any) ([]string, error) {
+	query := fmt.Sprintf(`SELECT d.file_path FROM documents d WHERE %[1]s AND COALESCE(d.file_path, '') <> ''
+		UNION
+		SELECT v.file_path FROM document_versions v JOIN documents d ON d.id = v.document_id
+		WHERE %[1]s AND COALESCE(v.file_path, '') <> ''`, where)
+	rows, err := tx.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for rows.Next() {
+		var file string
+		if err = rows.Scan(&file); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, file := range files {
+		const insert = `INSERT INTO blob_deletions (key, created_at) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`
+		if _, err = tx.ExecContext(ctx, insert, file, now); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func (s *SQLite) PendingBlobDeletions(ctx context.Context, limit int) ([]string, error) {
+	const cleanup = `DELETE FROM blob_deletions
+		WHERE EXISTS (SELECT 1 FROM documents d WHERE d.file_path = blob_deletions.key)
+			OR EXISTS (SELECT 1 FROM document_versions v WHERE v.file_path = blob_deletions.key)`
+	if _, err := s.DB.ExecContext(ctx, cleanup); err != nil {
+		return nil, SomeWrong
+	}
+	rows, err := s.DB.QueryContext(ctx, `SELECT key FROM blob_deletions ORDER BY attempts, created_at LIMIT $1`, limit)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, SomeWrong
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, SomeWrong
+	}
+	return keys, nil
+}
+
+func (s *SQLite) BlobDeleted(ctx context.Context, key string) error {
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM blob_deletions WHERE key = $1`, key); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) BlobDeleteFailed(ctx context.Context, key string, reason string) error {
+	const query = `UPDATE blob_deletions SET attempts = attempts + 1, last_error = $2 WHERE key = $1`
+	if _, err := s.DB.ExecContext(ctx, query, key, reason); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) ReferencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	const query = `SELECT file_path FROM documents WHERE COALESCE(file_path, '') <> ''
+		UNION SELECT file_path FROM document_versions WHERE COALESCE(file_path, '') <> ''
+		UNION SELECT key FROM blob_deletions`
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	keys := map[string]struct{}{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, SomeWrong
+		}
+		keys[key] = struct{}{}
+	}
+	return keys, rows.Err()
+}
+
+// GetDockForUpdate документ в транзакции; строку блокировать не нужно, транзакция SQLite уже держит запись
+func (t sqliteDockTx) GetDockForUpdate(ctx context.Context, idDock uuid.UUID) (Dock, error) {
+	const query = `SELECT id, is_file, public, name, mime, json_data, COALESCE(file_path, ''), own_id
+		FROM documents WHERE id = $1`
+	var d Dock
+	var data []byte
+	err := t.tx.QueryRowContext(ctx, query, idDock).Scan(&d.Id, &d.IsFile, &d.Public, &d.Name, &d.Mime, &data, &d.Filepath, &d.OwnerId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Dock{}, Invaliddata
+		}
+		return Dock{}, err
+	}
+	d.Json = data
+	return d, nil
+}
+
+func (t sqliteDockTx) UpdateDock(ctx context.Context, dock Dock) error {
+	const query = `UPDATE documents
+		SET name = $2, public = $3, is_file = $4, mime = $5, json_data = $6, file_path = $7
+		WHERE id = $1`
+	result, err := t.tx.ExecContext(ctx, query, dock.Id, dock.Name, dock.Public,
+		dock.IsFile, dock.Mime, jsonArg(dock.Json), dock.Filepath)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+func (t sqliteDockTx) AddVersion(ctx context.Context, dock Dock, authorId int, hash string) (int, error) {
+	const query = `INSERT INTO document_versions
+    (document_id, version, author_id, content_hash, name, public, is_file, mime, json_data, file_path)
+    SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9
+    FROM document_versions WHERE document_id = $1
+    RETURNING version`
+	var version int
+	err := t.tx.QueryRowContext(ctx, query, dock.Id, authorId, hash, dock.Name, dock.Public,
+		dock.IsFile, dock.Mime, jsonArg(dock.Json), dock.Filepath).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+func scanSQLiteVersion(row scanner) (DockVersion, error) {
+	var v DockVersion
+	var data []byte
+	err := row.Scan(&v.ID, &v.Name, &v.Mime, &v.IsFile, &v.Public, &v.CreatedAt, &data,
+		&v.Filepath, &v.Version, &v.AuthorId, &v.Author, &v.ContentHash)
+	v.Json = data
+	return v, err
+}
+
+func (s *SQLite) ListVersions(ctx context.Context, idDock uuid.UUID) ([]DockVersion, error) {
+	query := `SELECT ` + versionColumns + `
+        FROM document_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.document_id = $1
+        ORDER BY v.version`
+	rows, err := s.DB.QueryContext(ctx, query, idDock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DockVersion
+	for rows.Next() {
+		v, err := scanSQLiteVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, Invaliddata
+	}
+	return results, nil
+}
+
+func (s *SQLite) GetVersion(ctx context.Context, idDock uuid.UUID, version int) (DockVersion, error) {
+	query := `SELECT ` + versionColumns + `
+        FROM document_versions v
+        LEFT JOIN users u ON u.id = v.author_id
+        WHERE v.document_id = $1 AND v.version = $2`
+	v, err := scanSQLiteVersion(s.DB.QueryRowContext(ctx, query, idDock, version))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DockVersion{}, Invaliddata
+		}
+		return DockVersion{}, err
+	}
+	return v, nil
+}
+
+func (s *SQLite) GetDockRole(ctx context.Context, idUser int, idDock uuid.UUID) (string, error) {
+	const query = `SELECT CASE
+			WHEN d.own_id = $2 THEN 'owner'
+			WHEN g.role IS NOT NULL THEN g.role
+			WHEN d.public THEN 'public'
+			ELSE '' END
+		FROM documents d
+		LEFT JOIN document_grants g ON g.document_id = d.id AND g.granted_user_id = $2
+		WHERE d.id = $1`
+	var role string
+	err := s.DB.QueryRowContext(ctx, query, idDock, idUser).Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", Invaliddata
+		}
+		return "", err
+	}
+	if role == "" {
+		return "", Invaliddata
+	}
+	return role, nil
+}
+
+// scanSQLiteAPIKey ключ; scopes хранятся json массивом
+func scanSQLiteAPIKey(row scanner) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	err := row.Scan(&k.Id, &k.UserId, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &k.ExpireAt, &k.LastUsedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if err = json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return APIKey{}, err
+	}
+	return k, nil
+}
+
+func (s *SQLite) CreateAPIKey(ctx context.Context, idUser int, keyHash string, key APIKey) (APIKey, error) {
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return APIKey{}, SomeWrong
+	}
+	query := `INSERT INTO api_keys (user_id, name, key_hash, prefix, scopes, created_at, expire_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + apiKeyColumns
+	created, err := scanSQLiteAPIKey(s.DB.QueryRowContext(ctx, query, idUser, key.Name, keyHash, key.Prefix, string(scopes), key.CreatedAt, key.ExpireAt))
+	if err != nil {
+		return APIKey{}, SomeWrong
+	}
+	return created, nil
+}
+
+func (s *SQLite) ListAPIKeys(ctx context.Context, idUser int) ([]APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := s.DB.QueryContext(ctx, query, idUser)
+	if err != nil {
+		return nil, SomeWrong
+	}
+	defer rows.Close()
+	results := []APIKey{}
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, SomeWrong
+		}
+		results = append(results, k)
+	}
+	return results, rows.Err()
+}
+
+func (s *SQLite) DeleteAPIKey(ctx context.Context, idUser int, idKey int) error {
+	result, err := s.DB.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, idKey, idUser)
+	if err != nil {
+		return SomeWrong
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return Invaliddata
+	}
+	return nil
+}
+
+func (s *SQLite) UseAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	query := `UPDATE api_keys SET last_used_at = $2
+		WHERE key_hash = $1 AND (expire_at IS NULL OR expire_at > $2)
+			AND user_id IN (SELECT id FROM users WHERE NOT disabled)
+		RETURNING ` + apiKeyColumns
+	k, err := scanSQLiteAPIKey(s.DB.QueryRowContext(ctx, query, keyHash, time.Now()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, Invalidtoken
+		}
+		return APIKey{}, SomeWrong
+	}
+	return k, nil
+}
+
+func (s *SQLite) CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error {
+	const query = `INSERT INTO oidc_logins (state_hash, verifier, nonce, created_at, expire_at, link_user_id)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))`
+	_, err := s.DB.ExecContext(ctx, query, stateHash, login.Verifier, login.Nonce, login.CreatedAt, login.ExpireAt, login.LinkUserId)
+	if err != nil {
+		return SomeWrong
+	}
+	return nil
+}
+
+func (s *SQLite) UseOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error) {
+	const query = `DELETE FROM oidc_logins WHERE state_hash = $1
+		RETURNING verifier, nonce, created_at, expire_at, COALESCE(link_user_id, 0)`
+	var l OIDCLogin
+	err := s.DB.QueryRowContext(ctx, query, stateHash).Scan(&l.Verifier, &l.Nonce, &l.CreatedAt, &l.ExpireAt, &l.LinkUserId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OIDCLogin{}, Invalidtoken
+		}
+		return OIDCLogin{}, SomeWrong
+	}
+	if time.Now().After(l.ExpireAt) {
+		return OIDCLogin{}, Invalidtoken
+	}
+	return l, nil
+}
+
+func (s *SQLite) FindIdentity(ctx context.Context, issuer, subject string) (int, error) {
+	const query = `SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2`
+	var userId int
+	err := s.DB.QueryRowContext(ctx, query, issuer, subject).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, Invaliddata
+		}
+		return 0, SomeWrong
+	}
+	return userId, nil
+}
+
+func (s *SQLite) LinkIdentity(ctx context.Context, issuer, subject string, idUser int) error {
+	const query = `INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO NOTHING`
+	if _, err := s.DB.ExecContext(ctx, query, issuer, subject, idUser, time.Now()); err != nil {
+		return SomeWrong
+	}
+	return nil
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"fmt"
+	"gomodlag/internal/cli"
 	cfg "gomodlag/internal/config"
-	"gomodlag/internal/server"
+	"os"
 )
 
 func main() {
-	err := cfg.InitEnv()
-	config, err := cfg.ItitConfig()
-	fmt.Println(config, err)
-
-	server.Start(*config)
+	// secrets.env необязателен: в контейнере переменные приходят из окружения
+	_ = cfg.InitEnv()
+	os.Exit(cli.Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiffOp операция в формате RFC 6902
+type DiffOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// MarshalJSON у remove нет value, у add/replace value обязателен даже если он null
+func (o DiffOp) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+	type op DiffOp
+	return json.Marshal(op(o))
+}
+
+// JsonDiff строит структурный diff двух json документов в виде JSON Patch,
+// применение которого к from дает to
+func JsonDiff(from, to []byte) ([]DiffOp, error) {
+	var a, b any
+	if len(from) > 0 {
+		if err := json.Unmarshal(from, &a); err != nil {
+			return nil, err
+		}
+	}
+	if len(to) > 0 {
+		if err := json.Unmarshal(to, &b); err != nil {
+			return nil, err
+		}
+	}
+	ops := []DiffOp{}
+	return diffValues(ops, "", a, b), nil
+}
+
+func diffValues(ops []DiffOp, path string, a, b any) []DiffOp {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			return diffObjects(ops, path, av, bv)
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			return diffArrays(ops, path, av, bv)
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, DiffOp{Op: "replace", Path: path, Value: b})
+	}
+	return ops
+}
+
+func diffObjects(ops []DiffOp, path string, a, b map[string]any) []DiffOp {
+	for _, key := range sortedKeys(a) {
+		p := path + "/" + escapePointer(key)
+		if bv, ok := b[key]; ok {
+			ops = diffValues(ops, p, a[key], bv)
+		} else {
+			ops = append(ops, DiffOp{Op: "remove", Path: p})
+		}
+	}
+	for _, key := range sortedKeys(b) {
+		if _, ok := a[key]; !ok {
+			ops = append(ops, DiffOp{Op: "add", Path: path + "/" + escapePointer(key), Value: b[key]})
+		}
+	}
+	return ops
+}
+
+func diffArrays(ops []DiffOp, path string, a, b []any) []DiffOp {
+	common := min(len(a), len(b))
+	for i := 0; i < common; i++ {
+		ops = diffValues(ops, path+"/"+strconv.Itoa(i), a[i], b[i])
+	}
+	// удаляем с конца, чтобы индексы оставшихся элементов не сдвигались
+	for i := len(a) - 1; i >= common; i-- {
+		ops = append(ops, DiffOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+	}
+	for i := common; i < len(b); i++ {
+		ops = append(ops, DiffOp{Op: "add", Path: path + "/-", Value: b[i]})
+	}
+	return ops
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
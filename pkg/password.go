@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// PasswordHasher хеширует пароли выбранным алгоритмом; проверять умеет и bcrypt, и argon2id,
+// поэтому алгоритм и параметры можно менять без сброса паролей - хеш обновится при следующем входе
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	// параметры argon2id: проходы, память в KiB, потоки
+	ArgonTime    uint32
+	ArgonMemory  uint32
+	ArgonThreads uint8
+}
+
+const (
+	argonSaltLen = 16
+	argonKeyLen  = 32
+)
+
+func (h PasswordHasher) bcryptCost() int {
+	if h.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.BcryptCost
+}
+
+func (h PasswordHasher) argonParams() (uint32, uint32, uint8) {
+	t, m, p := h.ArgonTime, h.ArgonMemory, h.ArgonThreads
+	if t == 0 {
+		t = 1
+	}
+	if m == 0 {
+		m = 64 * 1024
+	}
+	if p == 0 {
+		p = 4
+	}
+	return t, m, p
+}
+
+func (h PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm != Argon2id {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost())
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	t, m, p := h.argonParams()
+	key := argon2.IDKey([]byte(password), salt, t, m, p, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify проверяет пароль; rehash - хеш сделан другим алгоритмом или с другими параметрами
+func (h PasswordHasher) Verify(hash, password string) (ok bool, rehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		var version int
+		var t, m uint32
+		var p uint8
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+		other := argon2.IDKey([]byte(password), salt, t, m, p, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false
+		}
+		wt, wm, wp := h.argonParams()
+		return true, h.Algorithm != Argon2id || t != wt || m != wm || p != wp
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, h.Algorithm == Argon2id || err != nil || cost != h.bcryptCost()
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -56,9 +57,13 @@ func TestLogin_Success(t *testing.T) {
 	_, err := s.Register(ctx, hashedPassword, username)
 	require.NoError(t, err)
 
-	// Пытаемся залогиниться с хешированным паролем
+	// Достаем хеш и сверяем с паролем
+	userID, hash, err := s.GetCredentials(ctx, username)
+	require.NoError(t, err)
+	assert.True(t, pkg.CompareHash(hash, password))
+
 	token := "test_token_123"
-	err = s.Login(ctx, hashedPassword, username, token, time.Hour)
+	err = s.CreateSession(ctx, userID, testToken(token, time.Hour), testToken("refresh_"+token, 24*time.Hour), storage.SessionMeta{})
 
 	assert.NoError(t, err)
 }
@@ -76,14 +81,38 @@ func TestLogin_WrongCredentials(t *testing.T) {
 	_, err := s.Register(ctx, hashedPassword, username)
 	require.NoError(t, err)
 
-	// Пытаемся залогиниться с неправильным хешированным паролем
-	wrongHashedPassword := pkg.CreateHash("wrong_pass")
-	err = s.Login(ctx, wrongHashedPassword, username, "token", time.Hour)
+	// Неправильный пароль не совпадает с хешем
+	_, hash, err := s.GetCredentials(ctx, username)
+	require.NoError(t, err)
+	assert.False(t, pkg.CompareHash(hash, "wrong_pass"))
 
-	assert.Error(t, err)
+	// Неизвестный пользователь
+	_, _, err = s.GetCredentials(ctx, "unknown_user")
 	assert.Equal(t, storage.Invaliddata, err)
 }
 
+// TestUpdatePasswordHash тест пересчета хеша пароля
+func TestUpdatePasswordHash(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	username := "rehash_user"
+	_, err := s.Register(ctx, pkg.CreateHash("old_pass"), username)
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, username)
+	require.NoError(t, err)
+
+	newHash, err := pkg.PasswordHasher{Algorithm: pkg.Argon2id}.Hash("old_pass")
+	require.NoError(t, err)
+	require.NoError(t, s.UpdatePasswordHash(ctx, userID, newHash))
+
+	_, hash, err := s.GetCredentials(ctx, username)
+	require.NoError(t, err)
+	assert.Equal(t, newHash, hash)
+}
+
 // TestValidateToken_Success тест валидации токена
 func TestValidateToken_Success(t *testing.T) {
 	s := setupTestDB(t)
@@ -98,7 +127,7 @@ func TestValidateToken_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	token := "valid_token_123"
-	err = s.Login(ctx, password, username, token, time.Hour)
+	_, err = login(ctx, s, username, testToken(token, time.Hour), testToken("refresh_"+token, 24*time.Hour), storage.SessionMeta{})
 	require.NoError(t, err)
 
 	// Валидируем токен
@@ -133,8 +162,8 @@ func TestValidateToken_Expired(t *testing.T) {
 	createTime := nowUTC.Add(-2 * time.Hour)
 
 	_, err = s.Pool.Exec(ctx, `
-		INSERT INTO sessions (token, created_at, expire_at, user_id)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO sessions (token, created_at, access_expire_at, expire_at, user_id)
+		VALUES ($1, $2, $3, $3, $4)
 	`, expiredToken, createTime, expireTime, userID)
 	require.NoError(t, err)
 
@@ -175,11 +204,6 @@ func TestNewDocs_Success(t *testing.T) {
 	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "doc_owner").Scan(&userID)
 	require.NoError(t, err)
 
-	// Начинаем транзакцию
-	tx, err := s.Begin(ctx)
-	require.NoError(t, err)
-	defer tx.Rollback(ctx)
-
 	// Создаем документ
 	doc := storage.Dock{
 		Id:       uuid.New(),
@@ -192,7 +216,11 @@ func TestNewDocs_Success(t *testing.T) {
 		OwnerId:  userID,
 	}
 
-	success, err := s.NewDocs(ctx, doc, tx)
+	var success bool
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		success, err = tx.NewDocs(ctx, doc)
+		return err
+	})
 
 	assert.NoError(t, err)
 	assert.True(t, success)
@@ -260,7 +288,7 @@ func TestGetDockById_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	// Получаем документ по ID
-	doc, err := s.GetDockById(ctx, userID, docID)
+	doc, err := s.GetDockById(ctx, docID)
 
 	assert.NoError(t, err)
 	assert.Equal(t, "Specific Doc", doc.Name)
@@ -291,7 +319,7 @@ func TestDeleteDock_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	// Удаляем документ
-	err = s.DeleteDock(ctx, userID, docID)
+	err = s.DeleteDock(ctx, docID)
 
 	assert.NoError(t, err)
 
@@ -319,8 +347,804 @@ func TestDeleteDock_NotFound(t *testing.T) {
 
 	// Пытаемся удалить несуществующий документ
 	nonExistentID := uuid.New()
-	err = s.DeleteDock(ctx, userID, nonExistentID)
+	err = s.DeleteDock(ctx, nonExistentID)
 
 	assert.Error(t, err)
-	assert.Equal(t, storage.Forbidden, err)
+	assert.Equal(t, storage.Invaliddata, err)
+}
+
+// TestUpdateDock_Success тест изменения документа
+func TestUpdateDock_Success(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "pass", "update_owner")
+	require.NoError(t, err)
+
+	var ownerID int
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "update_owner").Scan(&ownerID)
+	require.NoError(t, err)
+
+	docID := uuid.New()
+	_, err = s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Owned", false, false, "application/json", `{"a": 1}`, ownerID)
+	require.NoError(t, err)
+
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		doc, err := tx.GetDockForUpdate(ctx, docID)
+		require.NoError(t, err)
+		assert.Equal(t, ownerID, doc.OwnerId)
+		doc.Name = "Renamed"
+		return tx.UpdateDock(ctx, doc)
+	})
+	assert.NoError(t, err)
+
+	// Несуществующий документ
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.GetDockForUpdate(ctx, uuid.New())
+		return err
+	})
+	assert.Equal(t, storage.Invaliddata, err)
+}
+
+// TestGetDockRole тест определения роли пользователя в документе
+func TestGetDockRole(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	ids := map[string]int{}
+	for _, name := range []string{"role_owner", "role_editor", "role_stranger"} {
+		_, err := s.Register(ctx, "pass", name)
+		require.NoError(t, err)
+		var id int
+		err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", name).Scan(&id)
+		require.NoError(t, err)
+		ids[name] = id
+	}
+
+	docID := uuid.New()
+	_, err := s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Roles", false, false, "application/json", `{}`, ids["role_owner"])
+	require.NoError(t, err)
+	_, err = s.Pool.Exec(ctx, `INSERT INTO document_grants (document_id, granted_user_id, role) VALUES ($1, $2, 'editor')`,
+		docID, ids["role_editor"])
+	require.NoError(t, err)
+
+	role, err := s.GetDockRole(ctx, ids["role_owner"], docID)
+	assert.NoError(t, err)
+	assert.Equal(t, "owner", role)
+
+	role, err = s.GetDockRole(ctx, ids["role_editor"], docID)
+	assert.NoError(t, err)
+	assert.Equal(t, "editor", role)
+
+	_, err = s.GetDockRole(ctx, ids["role_stranger"], docID)
+	assert.Equal(t, storage.Invaliddata, err)
+}
+
+// TestVersions_Increment тест нумерации версий документа
+func TestVersions_Increment(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "pass", "version_user")
+	require.NoError(t, err)
+
+	var userID int
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "version_user").Scan(&userID)
+	require.NoError(t, err)
+
+	doc := storage.Dock{
+		Id:      uuid.New(),
+		Name:    "Versioned",
+		Mime:    "application/json",
+		Json:    json.RawMessage(`{"v": 1}`),
+		OwnerId: userID,
+	}
+	var first, second int
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, doc)
+		require.NoError(t, err)
+		first, err = tx.AddVersion(ctx, doc, userID, pkg.HashContent(doc.Json))
+		require.NoError(t, err)
+		doc.Json = json.RawMessage(`{"v": 2}`)
+		second, err = tx.AddVersion(ctx, doc, userID, pkg.HashContent(doc.Json))
+		return err
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 2, second)
+
+	versions, err := s.ListVersions(ctx, doc.Id)
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "version_user", versions[1].Author)
+	assert.JSONEq(t, `{"v": 2}`, string(versions[1].Json))
+}
+
+// TestAddGrant_UnknownUser тест гранта несуществующему пользователю
+func TestAddGrant_UnknownUser(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "pass", "grant_owner")
+	require.NoError(t, err)
+	_, err = s.Register(ctx, "pass", "grant_friend")
+	require.NoError(t, err)
+
+	var userID int
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "grant_owner").Scan(&userID)
+	require.NoError(t, err)
+
+	docID := uuid.New()
+	_, err = s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Shared", false, false, "application/json", `{}`, userID)
+	require.NoError(t, err)
+
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.AddGrant(ctx, []string{"grant_friend", "nobody_here"}, "viewer", docID)
+		return err
+	})
+	assert.ErrorIs(t, err, storage.UnknownUser)
+	assert.Contains(t, err.Error(), "nobody_here")
+}
+
+// TestWithTx_RetriesSerializationFailure транзакция, прерванная конфликтом, выполняется заново
+func TestWithTx_RetriesSerializationFailure(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+	owner, err := s.CreateUser(ctx, "retry_user", "hash", storage.RoleUser)
+	require.NoError(t, err)
+
+	doc := storage.Dock{Id: uuid.New(), Name: "retried", Mime: "application/json", Json: json.RawMessage(`{}`), OwnerId: owner.Id}
+	attempts := 0
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		attempts++
+		if _, err := tx.NewDocs(ctx, doc); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return &pgconn.PgError{Code: "40001"}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	_, err = s.GetDockById(ctx, doc.Id)
+	assert.NoError(t, err)
+
+	// настоящий конфликт: документ меняется вне транзакции после ее снимка, но до блокировки строки
+	other := storage.Dock{Id: uuid.New(), Name: "other", Mime: "application/json", Json: json.RawMessage(`{}`), OwnerId: owner.Id}
+	require.NoError(t, s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, other)
+		return err
+	}))
+	attempts = 0
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		attempts++
+		if _, err := tx.GetDockForUpdate(ctx, other.Id); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := s.Pool.Exec(ctx, `UPDATE documents SET name = 'changed' WHERE id = $1`, doc.Id); err != nil {
+				return err
+			}
+		}
+		d, err := tx.GetDockForUpdate(ctx, doc.Id)
+		if err != nil {
+			return err
+		}
+		d.Name = "renamed"
+		return tx.UpdateDock(ctx, d)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	got, err := s.GetDockById(ctx, doc.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", got.Name)
+
+	// прочие ошибки не повторяются
+	attempts = 0
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		attempts++
+		return storage.Invaliddata
+	})
+	assert.ErrorIs(t, err, storage.Invaliddata)
+	assert.Equal(t, 1, attempts)
+}
+
+// TestRevokeGrant_Success тест отзыва гранта
+func TestRevokeGrant_Success(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "pass", "revoke_owner")
+	require.NoError(t, err)
+	_, err = s.Register(ctx, "pass", "revoke_friend")
+	require.NoError(t, err)
+
+	var ownerID, friendID int
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "revoke_owner").Scan(&ownerID)
+	require.NoError(t, err)
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "revoke_friend").Scan(&friendID)
+	require.NoError(t, err)
+
+	docID := uuid.New()
+	_, err = s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Shared", false, false, "application/json", `{}`, ownerID)
+	require.NoError(t, err)
+	_, err = s.Pool.Exec(ctx, `INSERT INTO document_grants (document_id, granted_user_id) VALUES ($1, $2)`, docID, friendID)
+	require.NoError(t, err)
+
+	grants, err := s.ListGrants(ctx, docID)
+	require.NoError(t, err)
+	assert.Len(t, grants, 1)
+	assert.Equal(t, "viewer", grants[0].Role)
+
+	revoked, err := s.RevokeGrant(ctx, docID, "revoke_friend")
+	assert.NoError(t, err)
+	assert.Equal(t, friendID, revoked)
+
+	_, err = s.RevokeGrant(ctx, docID, "revoke_friend")
+	assert.Equal(t, storage.Invaliddata, err)
+}
+
+// TestGetDockRole_Public тест чтения публичного документа без гранта
+func TestGetDockRole_Public(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "pass", "public_owner")
+	require.NoError(t, err)
+
+	var ownerID int
+	err = s.Pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", "public_owner").Scan(&ownerID)
+	require.NoError(t, err)
+
+	docID := uuid.New()
+	_, err = s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Public Doc", true, false, "application/json", `{}`, ownerID)
+	require.NoError(t, err)
+
+	// Анонимный пользователь
+	role, err := s.GetDockRole(ctx, 0, docID)
+	assert.NoError(t, err)
+	assert.Equal(t, "public", role)
+}
+
+// TestSessions_Multiple тест нескольких сессий одного пользователя
+func TestSessions_Multiple(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	password := "hashed_pass"
+	username := "multi_device"
+	_, err := s.Register(ctx, password, username)
+	require.NoError(t, err)
+
+	// Входим с двух устройств
+	_, err = login(ctx, s, username, testToken("laptop_token", time.Hour), testToken("refresh_laptop_token", 24*time.Hour), storage.SessionMeta{UserAgent: "laptop", IP: "10.0.0.1"})
+	require.NoError(t, err)
+	_, err = login(ctx, s, username, testToken("phone_token", time.Hour), testToken("refresh_phone_token", 24*time.Hour), storage.SessionMeta{UserAgent: "phone", IP: "10.0.0.2"})
+	require.NoError(t, err)
+
+	// Обе сессии валидны
+	userID, err := s.ValidateToken(ctx, "laptop_token")
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, "phone_token")
+	require.NoError(t, err)
+
+	sessions, err := s.ListSessions(ctx, userID, "phone_token")
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	var laptop storage.Session
+	for _, sess := range sessions {
+		if sess.UserAgent == "laptop" {
+			laptop = sess
+		} else {
+			assert.True(t, sess.Current)
+		}
+	}
+	assert.False(t, laptop.Current)
+
+	// Завершаем сессию ноутбука
+	err = s.DeleteSessionById(ctx, userID, laptop.Id)
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, "laptop_token")
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	// Выход со всех устройств
+	err = s.DeleteUserSessions(ctx, userID)
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, "phone_token")
+	assert.Equal(t, storage.Invalidtoken, err)
+}
+
+// TestRefreshToken_Rotation тест ротации refresh токена и отзыва семейства при повторном использовании
+func TestRefreshToken_Rotation(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	password := "hashed_pass"
+	username := "refresh_user"
+	_, err := s.Register(ctx, password, username)
+	require.NoError(t, err)
+
+	_, err = login(ctx, s, username, testToken("access_1", time.Hour), testToken("refresh_hash_1", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+
+	// Обмениваем refresh токен на новую пару
+	userID, err := s.RotateRefreshToken(ctx, "refresh_hash_1", testToken("access_2", time.Hour), testToken("refresh_hash_2", 24*time.Hour))
+	require.NoError(t, err)
+	assert.Greater(t, userID, 0)
+
+	// Старый access токен заменен новым в той же сессии
+	_, err = s.ValidateToken(ctx, "access_1")
+	assert.Equal(t, storage.Invalidtoken, err)
+	_, err = s.ValidateToken(ctx, "access_2")
+	require.NoError(t, err)
+
+	// Повторное использование старого refresh токена отзывает всю сессию
+	_, err = s.RotateRefreshToken(ctx, "refresh_hash_1", testToken("access_3", time.Hour), testToken("refresh_hash_3", 24*time.Hour))
+	assert.Equal(t, storage.TokenReused, err)
+	_, err = s.ValidateToken(ctx, "access_2")
+	assert.Equal(t, storage.Invalidtoken, err)
+	_, err = s.RotateRefreshToken(ctx, "refresh_hash_2", testToken("access_4", time.Hour), testToken("refresh_hash_4", 24*time.Hour))
+	assert.Equal(t, storage.Invalidtoken, err)
+}
+
+// TestRevokedTokens токены удаленных сессий попадают в список отозванных до истечения срока
+func TestRevokedTokens(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	password := "hashed_pass"
+	username := "revoke_user"
+	_, err := s.Register(ctx, password, username)
+	require.NoError(t, err)
+
+	_, err = login(ctx, s, username, testToken("session_a", time.Hour), testToken("refresh_a", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+	userID, err := login(ctx, s, username, testToken("session_b", time.Hour), testToken("refresh_b", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteToken(ctx, "session_a"))
+	revoked, err := s.ListRevoked(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"session_a"}, revoked)
+
+	require.NoError(t, s.DeleteUserSessions(ctx, userID))
+	revoked, err = s.ListRevoked(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"session_a", "session_b"}, revoked)
+}
+
+// TestPasswordReset тест одноразового токена сброса пароля
+func TestPasswordReset(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	username := "reset_user"
+	_, err := s.Register(ctx, pkg.CreateHash("old_pass"), username)
+	require.NoError(t, err)
+	_, err = login(ctx, s, username, testToken("reset_session", time.Hour), testToken("reset_refresh", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+
+	err = s.CreateResetToken(ctx, "unknown_user", testToken("hash_x", time.Hour))
+	assert.Equal(t, storage.UnknownUser, err)
+
+	require.NoError(t, s.CreateResetToken(ctx, username, testToken("reset_hash", time.Hour)))
+	userID, err := s.UseResetToken(ctx, "reset_hash", pkg.CreateHash("new_pass"))
+	require.NoError(t, err)
+
+	// Пароль заменен, сессии завершены
+	hash, err := s.GetPasswordHash(ctx, userID)
+	require.NoError(t, err)
+	assert.True(t, pkg.CompareHash(hash, "new_pass"))
+	_, err = s.ValidateToken(ctx, "reset_session")
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	// Токен одноразовый
+	_, err = s.UseResetToken(ctx, "reset_hash", pkg.CreateHash("other_pass"))
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	// Просроченный токен не принимается
+	require.NoError(t, s.CreateResetToken(ctx, username, testToken("expired_hash", -time.Minute)))
+	_, err = s.UseResetToken(ctx, "expired_hash", pkg.CreateHash("other_pass"))
+	assert.Equal(t, storage.Invalidtoken, err)
+}
+
+// TestChangePassword тест смены хеша пароля с завершением всех сессий, кроме текущей
+func TestChangePassword(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+	checkChangePassword(t, s)
+}
+
+func TestChangePassword_Memory(t *testing.T) {
+	checkChangePassword(t, storage.NewMemory())
+}
+
+func TestChangePassword_SQLite(t *testing.T) {
+	checkChangePassword(t, sqliteStore(t))
+}
+
+func checkChangePassword(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	user, err := s.CreateUser(ctx, "other_sessions", "hashed_pass", storage.RoleUser)
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSession(ctx, user.Id, testToken("keep_token", time.Hour), testToken("refresh_keep", 24*time.Hour), storage.SessionMeta{}))
+	require.NoError(t, s.CreateSession(ctx, user.Id, testToken("drop_token", time.Hour), testToken("refresh_drop", 24*time.Hour), storage.SessionMeta{}))
+
+	require.NoError(t, s.ChangePassword(ctx, user.Id, "new_hash", "keep_token"))
+
+	hash, err := s.GetPasswordHash(ctx, user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "new_hash", hash)
+	_, err = s.ValidateToken(ctx, "keep_token")
+	assert.NoError(t, err)
+	_, err = s.ValidateToken(ctx, "drop_token")
+	assert.Equal(t, storage.Invalidtoken, err)
+	revoked, err := s.ListRevoked(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"drop_token"}, revoked)
+}
+
+// TestLoginAttempts тест счетчика неудачных входов и блокировки
+func TestLoginAttempts(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	failures, err := s.AddLoginFailure(ctx, "user:bruteforced", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+	failures, err = s.AddLoginFailure(ctx, "user:bruteforced", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, failures)
+
+	locks, err := s.GetLoginLocks(ctx, "user:bruteforced", "ip:10.0.0.1")
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+
+	require.NoError(t, s.LockLogin(ctx, "user:bruteforced", time.Now().Add(time.Minute)))
+	locks, err = s.GetLoginLocks(ctx, "user:bruteforced", "ip:10.0.0.1")
+	require.NoError(t, err)
+	assert.Contains(t, locks, "user:bruteforced")
+
+	// Разблокировка сбрасывает и счетчик
+	require.NoError(t, s.ResetLoginFailures(ctx, "user:bruteforced"))
+	locks, err = s.GetLoginLocks(ctx, "user:bruteforced")
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+	failures, err = s.AddLoginFailure(ctx, "user:bruteforced", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+}
+
+// TestTOTP_Storage тест хранения 2fa: подтверждение, защита от повтора кода, коды восстановления
+func TestTOTP_Storage(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "hashed_pass", "totp_user")
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, "totp_user")
+	require.NoError(t, err)
+
+	_, err = s.GetTOTP(ctx, userID)
+	assert.Equal(t, storage.Invaliddata, err)
+
+	// Секрет можно перевыпустить, пока 2fa не подтверждена
+	require.NoError(t, s.SaveTOTPSecret(ctx, userID, "SECRET1"))
+	require.NoError(t, s.SaveTOTPSecret(ctx, userID, "SECRET2"))
+	require.NoError(t, s.ConfirmTOTP(ctx, userID, 100, []string{"code_hash_1", "code_hash_2"}))
+	assert.Equal(t, storage.Forbidden, s.SaveTOTPSecret(ctx, userID, "SECRET3"))
+
+	totp, err := s.GetTOTP(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.TOTP{Secret: "SECRET2", Confirmed: true, LastStep: 100}, totp)
+
+	// Код шага 100 уже использован при подтверждении
+	assert.Equal(t, storage.Invalidtoken, s.UseTOTPStep(ctx, userID, 100))
+	assert.NoError(t, s.UseTOTPStep(ctx, userID, 101))
+
+	// Код восстановления одноразовый
+	assert.NoError(t, s.UseRecoveryCode(ctx, userID, "code_hash_1"))
+	assert.Equal(t, storage.Invalidtoken, s.UseRecoveryCode(ctx, userID, "code_hash_1"))
+}
+
+// TestLoginChallenge тест токена второго шага входа
+func TestLoginChallenge(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, "hashed_pass", "challenge_user")
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, "challenge_user")
+	require.NoError(t, err)
+
+	require.NoError(t, s.CreateChallenge(ctx, userID, testToken("challenge_hash", time.Minute)))
+
+	// Число попыток ограничено
+	for i := 0; i < 2; i++ {
+		id, err := s.UseChallenge(ctx, "challenge_hash", 2)
+		require.NoError(t, err)
+		assert.Equal(t, userID, id)
+	}
+	_, err = s.UseChallenge(ctx, "challenge_hash", 2)
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	// Просроченный токен не принимается
+	require.NoError(t, s.CreateChallenge(ctx, userID, testToken("expired_challenge", -time.Minute)))
+	_, err = s.UseChallenge(ctx, "expired_challenge", 5)
+	assert.Equal(t, storage.Invalidtoken, err)
+}
+
+// TestAdminUsers тест управления пользователями и журнала
+func TestAdminUsers(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	hasAdmin, err := s.HasAdmin(ctx)
+	require.NoError(t, err)
+	assert.False(t, hasAdmin)
+
+	admin, err := s.CreateUser(ctx, "root_admin", "hash", storage.RoleAdmin)
+	require.NoError(t, err)
+	assert.Equal(t, storage.RoleAdmin, admin.Role)
+	hasAdmin, err = s.HasAdmin(ctx)
+	require.NoError(t, err)
+	assert.True(t, hasAdmin)
+
+	_, err = s.CreateUser(ctx, "root_admin", "hash", storage.RoleUser)
+	assert.Equal(t, storage.Invaliddata, err)
+
+	user, err := s.CreateUser(ctx, "plain_user", "hash", storage.RoleUser)
+	require.NoError(t, err)
+	_, err = login(ctx, s, "plain_user", testToken("plain_token", time.Hour), testToken("plain_refresh", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+
+	// Заблокированный пользователь теряет сессии и не может войти
+	require.NoError(t, s.SetUserDisabled(ctx, "plain_user", true))
+	_, err = s.ValidateToken(ctx, "plain_token")
+	assert.Equal(t, storage.Invalidtoken, err)
+	_, _, err = s.GetCredentials(ctx, "plain_user")
+	assert.Equal(t, storage.Invaliddata, err)
+	got, err := s.GetUser(ctx, user.Id)
+	require.NoError(t, err)
+	assert.True(t, got.Disabled)
+
+	users, err := s.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	_, err = s.DeleteUser(ctx, "plain_user")
+	require.NoError(t, err)
+	_, err = s.DeleteUser(ctx, "plain_user")
+	assert.Equal(t, storage.UnknownUser, err)
+
+	require.NoError(t, s.AddAudit(ctx, admin.Id, "delete_user", "plain_user"))
+	audit, err := s.ListAudit(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, audit, 1)
+	assert.Equal(t, "root_admin", audit[0].Admin)
+	assert.Equal(t, "delete_user", audit[0].Action)
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	user, err := s.CreateUser(ctx, "ci_user", "hash", storage.RoleUser)
+	require.NoError(t, err)
+
+	expired := time.Now().Add(-time.Minute)
+	key, err := s.CreateAPIKey(ctx, user.Id, "ci_hash", storage.APIKey{Name: "ci", Prefix: "dk_abcdef", Scopes: []string{"docs:write"}, CreatedAt: time.Now()})
+	require.NoError(t, err)
+	_, err = s.CreateAPIKey(ctx, user.Id, "old_hash", storage.APIKey{Name: "old", Prefix: "dk_old", Scopes: []string{}, CreatedAt: time.Now(), ExpireAt: &expired})
+	require.NoError(t, err)
+
+	used, err := s.UseAPIKey(ctx, "ci_hash")
+	require.NoError(t, err)
+	assert.Equal(t, user.Id, used.UserId)
+	assert.Equal(t, []string{"docs:write"}, used.Scopes)
+	assert.NotNil(t, used.LastUsedAt)
+
+	// Истекший и неизвестный ключи не принимаются
+	_, err = s.UseAPIKey(ctx, "old_hash")
+	assert.Equal(t, storage.Invalidtoken, err)
+	_, err = s.UseAPIKey(ctx, "unknown_hash")
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	keys, err := s.ListAPIKeys(ctx, user.Id)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	// Ключи заблокированного пользователя не работают
+	require.NoError(t, s.SetUserDisabled(ctx, "ci_user", true))
+	_, err = s.UseAPIKey(ctx, "ci_hash")
+	assert.Equal(t, storage.Invalidtoken, err)
+	require.NoError(t, s.SetUserDisabled(ctx, "ci_user", false))
+
+	assert.Equal(t, storage.Invaliddata, s.DeleteAPIKey(ctx, user.Id+1, key.Id))
+	require.NoError(t, s.DeleteAPIKey(ctx, user.Id, key.Id))
+	_, err = s.UseAPIKey(ctx, "ci_hash")
+	assert.Equal(t, storage.Invalidtoken, err)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+
+	owner, err := s.CreateUser(ctx, "leaving_user", "hash", storage.RoleUser)
+	require.NoError(t, err)
+	_, err = login(ctx, s, "leaving_user", testToken("leaving_token", time.Hour), testToken("leaving_refresh", 24*time.Hour), storage.SessionMeta{})
+	require.NoError(t, err)
+
+	doc := storage.Dock{Id: uuid.New(), Name: "scan.pdf", Mime: "application/pdf", IsFile: true, Filepath: "old.pdf", OwnerId: owner.Id}
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, doc)
+		require.NoError(t, err)
+		_, err = tx.AddVersion(ctx, doc, owner.Id, "h1")
+		require.NoError(t, err)
+		doc.Filepath = "new.pdf"
+		require.NoError(t, tx.UpdateDock(ctx, doc))
+		_, err = tx.AddVersion(ctx, doc, owner.Id, "h2")
+		return err
+	})
+	require.NoError(t, err)
+
+	owned, err := s.ListOwnedDocks(ctx, owner.Id)
+	require.NoError(t, err)
+	require.Len(t, owned, 1)
+	assert.Equal(t, "new.pdf", owned[0].Filepath)
+
+	deleted, err := s.DeleteAccount(ctx, owner.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{doc.Id}, deleted.Documents)
+	assert.ElementsMatch(t, []string{"old.pdf", "new.pdf"}, deleted.Files)
+
+	_, err = s.ValidateToken(ctx, "leaving_token")
+	assert.Equal(t, storage.Invalidtoken, err)
+	_, err = s.GetDockById(ctx, doc.Id)
+	assert.Equal(t, storage.Invaliddata, err)
+	_, err = s.DeleteAccount(ctx, owner.Id)
+	assert.Equal(t, storage.UnknownUser, err)
+
+	// файлы удаленных документов ждут удаления из хранилища
+	pending, err := s.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"old.pdf", "new.pdf"}, pending)
+	require.NoError(t, s.BlobDeleted(ctx, "old.pdf"))
+	require.NoError(t, s.BlobDeleteFailed(ctx, "new.pdf", "timeout"))
+	pending, err = s.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new.pdf"}, pending)
+}
+
+// TestDeleteUser_VersionAuthor удаляется редактор, писавший версии чужого документа: версии остаются без автора
+func TestDeleteUser_VersionAuthor(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+	checkDeleteVersionAuthor(t, s)
+}
+
+func TestDeleteUser_VersionAuthor_SQLite(t *testing.T) {
+	checkDeleteVersionAuthor(t, sqliteStore(t))
+}
+
+func checkDeleteVersionAuthor(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	owner, err := s.CreateUser(ctx, "author_owner", "hash", storage.RoleUser)
+	require.NoError(t, err)
+	editor, err := s.CreateUser(ctx, "author_editor", "hash", storage.RoleUser)
+	require.NoError(t, err)
+
+	doc := storage.Dock{Id: uuid.New(), Name: "shared", Mime: "application/json", Json: json.RawMessage(`{"v": 1}`), OwnerId: owner.Id}
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, doc)
+		require.NoError(t, err)
+		_, err = tx.AddVersion(ctx, doc, owner.Id, "h1")
+		require.NoError(t, err)
+		_, err = tx.AddGrant(ctx, []string{"author_editor"}, "editor", doc.Id)
+		require.NoError(t, err)
+		doc.Json = json.RawMessage(`{"v": 2}`)
+		require.NoError(t, tx.UpdateDock(ctx, doc))
+		_, err = tx.AddVersion(ctx, doc, editor.Id, "h2")
+		return err
+	})
+	require.NoError(t, err)
+
+	deleted, err := s.DeleteUser(ctx, "author_editor")
+	require.NoError(t, err)
+	assert.Empty(t, deleted.Documents)
+
+	versions, err := s.ListVersions(ctx, doc.Id)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "author_owner", versions[0].Author)
+	assert.Zero(t, versions[1].AuthorId)
+	assert.Empty(t, versions[1].Author)
+	assert.Equal(t, "h2", versions[1].ContentHash)
+}
+
+func TestDeleteDock_QueuesFiles(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+
+	ctx := context.Background()
+	owner, err := s.CreateUser(ctx, "files_user1", "hash", storage.RoleUser)
+	require.NoError(t, err)
+
+	kept := storage.Dock{Id: uuid.New(), Name: "kept", Mime: "application/pdf", IsFile: true, Filepath: "kept.pdf", OwnerId: owner.Id}
+	gone := storage.Dock{Id: uuid.New(), Name: "gone", Mime: "application/pdf", IsFile: true, Filepath: "gone.pdf", OwnerId: owner.Id}
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		for _, d := range []storage.Dock{kept, gone} {
+			if _, err := tx.NewDocs(ctx, d); err != nil {
+				return err
+			}
+			if _, err := tx.AddVersion(ctx, d, owner.Id, "hash"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteDock(ctx, gone.Id))
+	assert.Equal(t, storage.Invaliddata, s.DeleteDock(ctx, gone.Id))
+
+	pending, err := s.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gone.pdf"}, pending)
+
+	referenced, err := s.ReferencedBlobs(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, referenced, "kept.pdf")
+	assert.Contains(t, referenced, "gone.pdf")
 }
@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"gomodlag/internal/blob"
+	"gomodlag/internal/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLocalStore проверяет полный цикл Put/Get/Stat/List/Delete на диске
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	err = store.Put(ctx, "a.png", strings.NewReader("hello"), 5, "image/png")
+	require.NoError(t, err)
+
+	r, info, err := store.Get(ctx, "a.png")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "image/png", info.Mime)
+
+	st, err := store.Stat(ctx, "a.png")
+	require.NoError(t, err)
+	assert.Equal(t, "a.png", st.Key)
+
+	list, err := store.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	require.NoError(t, store.Delete(ctx, "a.png"))
+	_, err = store.Stat(ctx, "a.png")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+}
+
+// TestLocalStore_InvalidKey ключи не должны выходить за пределы каталога
+func TestLocalStore_InvalidKey(t *testing.T) {
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+
+	err = store.Put(context.Background(), "../escape", strings.NewReader("x"), 1, "")
+	assert.ErrorIs(t, err, blob.ErrInvalidKey)
+}
+
+type s3Object struct {
+	data    []byte
+	mime    string
+	modTime time.Time
+}
+
+// fakeS3 минимальный S3 в памяти: bucket, put/get/head/delete объекта и ListObjectsV2, подписи не проверяются
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]s3Object
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			f.list(w, r.URL.Query().Get("prefix"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data, err := s3Body(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = s3Object{data: data, mime: r.Header.Get("Content-Type"), modTime: time.Now().UTC().Truncate(time.Second)}
+		w.Header().Set("ETag", `"`+key+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", obj.mime)
+		w.Header().Set("ETag", `"`+key+`"`)
+		http.ServeContent(w, r, "", obj.modTime, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key: key, LastModified: obj.modTime.Format("2006-01-02T15:04:05.000Z"), ETag: `"` + key + `"`, Size: int64(len(obj.data)),
+			})
+		}
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// s3Body тело PUT; по http клиент шлет его в aws-chunked: "размер;подпись\r\nданные\r\n" до нулевого блока
+func s3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	br := bufio.NewReader(r.Body)
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+// TestS3Store тот же цикл, что у LocalStore, плюс чтение с середины через Seek, поверх fakeS3
+func TestS3Store(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(&fakeS3{bucket: "docs", objects: map[string]s3Object{}})
+	t.Cleanup(srv.Close)
+	store, err := blob.NewS3Store(config.S3Config{
+		Endpoint: strings.TrimPrefix(srv.URL, "http://"), AccessKey: "key", SecretKey: "secret", Bucket: "docs", Region: "us-east-1",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(ctx, "a.png", strings.NewReader("hello world"), 11, "image/png"))
+	require.NoError(t, store.Put(ctx, "b/c.png", strings.NewReader("x"), 1, "image/png"))
+
+	r, info, err := store.Get(ctx, "a.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.Equal(t, "image/png", info.Mime)
+	_, err = r.Seek(6, io.SeekStart)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+
+	st, err := store.Stat(ctx, "a.png")
+	require.NoError(t, err)
+	assert.Equal(t, "a.png", st.Key)
+	assert.Equal(t, int64(11), st.Size)
+
+	list, err := store.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	list, err = store.List(ctx, "b/")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "b/c.png", list[0].Key)
+
+	require.NoError(t, store.Delete(ctx, "a.png"))
+	_, err = store.Stat(ctx, "a.png")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+	_, _, err = store.Get(ctx, "a.png")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+
+	for _, key := range []string{"", "../escape", "/abs.png"} {
+		assert.ErrorIs(t, store.Put(ctx, key, strings.NewReader("x"), 1, ""), blob.ErrInvalidKey, key)
+		_, _, err = store.Get(ctx, key)
+		assert.ErrorIs(t, err, blob.ErrInvalidKey, key)
+		assert.ErrorIs(t, store.Delete(ctx, key), blob.ErrInvalidKey, key)
+	}
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"gomodlag/internal/cli"
+	"gomodlag/internal/storage"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setCLIEnv минимальное окружение для ItitConfig с тестовой БД
+func setCLIEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"TTLSESION": "900",
+		"TTLCACHE":  "3600",
+		"USER":      "boss",
+		"PASSWORD":  "bosspass",
+		"HOST":      "localhost",
+		"PORT":      "5443",
+		"DBNAME":    "test",
+		"UPLOADDIR": t.TempDir(),
+	} {
+		t.Setenv(k, v)
+	}
+}
+
+func runCLI(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := cli.Run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLI_Usage(t *testing.T) {
+	for name, args := range map[string][]string{
+		"unknown command":  {"frobnicate"},
+		"help":             {"help"},
+		"migrate no args":  {"migrate"},
+		"migrate bad down": {"migrate", "down", "-1"},
+		"user no login":    {"user", "disable"},
+		"user unknown":     {"user", "rename", "someuser1"},
+		"docs unknown":     {"docs", "purge"},
+		"sessions unknown": {"sessions", "list"},
+		"bad flag":         {"docs", "gc", "-force"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code, stdout, stderr := runCLI("", args...)
+			assert.Equal(t, 2, code)
+			assert.Empty(t, stdout)
+			assert.Contains(t, stderr, "usage: gomodlag")
+		})
+	}
+}
+
+func TestCLI_ConfigCheck(t *testing.T) {
+	setCLIEnv(t)
+	code, stdout, _ := runCLI("", "config", "check")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "config ok\n", stdout)
+
+	t.Setenv("TOKENMODE", "jwt")
+	t.Setenv("JWTKEYS", "k1:hs256:c2hvcnQ=")
+	code, _, stderr := runCLI("", "config", "check")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "JWTKEYS")
+
+	t.Setenv("TOKENMODE", "")
+	t.Setenv("TTLSESION", "")
+	code, _, stderr = runCLI("", "config", "check")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "TTLSESION is required")
+}
+
+func TestCLI_UserCreateRejectsWeakPassword(t *testing.T) {
+	setCLIEnv(t)
+	// пароль проверяется до подключения к базе
+	code, _, stderr := runCLI("weak\n", "user", "create", "clitest01")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "invalid password")
+}
+
+func TestCLI_UserCreateRejectsInvalidLogin(t *testing.T) {
+	setCLIEnv(t)
+	// логин проверяется по тем же правилам, что в POST /api/admin/users
+	for _, login := range []string{"boss", "clitestuser", "логин12345"} {
+		code, _, stderr := runCLI("Password123!\n", "user", "create", login)
+		assert.Equal(t, 1, code, login)
+		assert.Contains(t, stderr, "invalid login", login)
+	}
+}
+
+func TestCLI_ServeStartError(t *testing.T) {
+	setCLIEnv(t)
+	t.Setenv("DBURL", "memory://")
+	t.Setenv("BLOBBACKEND", "bogus")
+	code, _, stderr := runCLI("", "serve")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "unknown blob backend")
+}
+
+func TestCLI_User(t *testing.T) {
+	s := setupTestDB(t)
+	defer s.Pool.Close()
+	cleanupTestDB(t, s)
+	defer cleanupTestDB(t, s)
+	setCLIEnv(t)
+	ctx := context.Background()
+
+	code, stdout, stderr := runCLI("Password123!\n", "user", "create", "-role", "admin", "clitest01")
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "created user clitest01")
+	users, err := s.ListUsers(ctx)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, storage.RoleAdmin, users[0].Role)
+
+	code, _, stderr = runCLI("", "user", "disable", "clitest01")
+	require.Equal(t, 0, code, stderr)
+	_, _, err = s.GetCredentials(ctx, "clitest01")
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	code, stdout, stderr = runCLI("", "user", "reset-password", "clitest01")
+	require.Equal(t, 0, code, stderr)
+	assert.NotEmpty(t, strings.TrimSpace(stdout))
+
+	// действия из командной строки пишутся в журнал от "cli"
+	audit, err := s.ListAudit(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, audit, 3)
+	for _, e := range audit {
+		assert.Equal(t, storage.SystemLogin, e.Admin)
+	}
+
+	code, _, _ = runCLI("", "user", "disable", "nosuchuser1")
+	assert.Equal(t, 1, code)
+
+	code, stdout, stderr = runCLI("", "sessions", "purge")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "purged 0 expired sessions\n", stdout)
+}
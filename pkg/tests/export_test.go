@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"gomodlag/internal/blob"
+	"gomodlag/internal/docks"
+	"gomodlag/internal/storage"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWriteExport архив выгрузки: манифест, json и файлы документов
+func TestWriteExport(t *testing.T) {
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, "k1.pdf", strings.NewReader("%PDF"), 4, "application/pdf"))
+	service := &docks.ServiceDocks{Blob: store}
+
+	jsonDoc := storage.DocumentWithGrants{ID: uuid.New(), Name: "settings", Mime: "application/json",
+		CreatedAt: time.Now(), GrantedUsers: []string{"reader01"}, Json: json.RawMessage(`{"a":1}`)}
+	fileDoc := storage.DocumentWithGrants{ID: uuid.New(), Name: "../../report", Mime: "application/pdf",
+		IsFile: true, CreatedAt: time.Now(), GrantedUsers: []string{}, Filepath: "k1.pdf"}
+
+	var buf bytes.Buffer
+	require.NoError(t, service.WriteExport(ctx, []storage.DocumentWithGrants{jsonDoc, fileDoc}, &buf))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	files := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		files[f.Name] = string(data)
+	}
+
+	var manifest struct {
+		Documents []docks.ExportEntry `json:"documents"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &manifest))
+	require.Len(t, manifest.Documents, 2)
+	assert.Equal(t, []string{"reader01"}, manifest.Documents[0].GrantedUsers)
+
+	jsonPath := "documents/" + jsonDoc.ID.String() + "/data.json"
+	assert.Equal(t, jsonPath, manifest.Documents[0].Json)
+	assert.JSONEq(t, `{"a":1}`, files[jsonPath])
+
+	// имя документа не выводит файл за пределы каталога документа
+	filePath := "documents/" + fileDoc.ID.String() + "/report.pdf"
+	assert.Equal(t, filePath, manifest.Documents[1].File)
+	assert.Equal(t, "%PDF", files[filePath])
+	assert.Len(t, files, 3)
+}
+
+// TestWriteExport_MissingBlob пропавший файл не обрывает архив, а отмечается в манифесте
+func TestWriteExport_MissingBlob(t *testing.T) {
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, "k2.pdf", strings.NewReader("%PDF"), 4, "application/pdf"))
+	service := &docks.ServiceDocks{Blob: store}
+
+	lost := storage.DocumentWithGrants{ID: uuid.New(), Name: "lost", Mime: "application/pdf",
+		IsFile: true, CreatedAt: time.Now(), GrantedUsers: []string{}, Filepath: "missing.pdf"}
+	kept := storage.DocumentWithGrants{ID: uuid.New(), Name: "kept", Mime: "application/pdf",
+		IsFile: true, CreatedAt: time.Now(), GrantedUsers: []string{}, Filepath: "k2.pdf"}
+
+	var buf bytes.Buffer
+	require.NoError(t, service.WriteExport(ctx, []storage.DocumentWithGrants{lost, kept}, &buf))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	names := map[string]bool{}
+	var manifest struct {
+		Documents []docks.ExportEntry `json:"documents"`
+	}
+	for _, f := range zr.File {
+		names[f.Name] = true
+		if f.Name == "manifest.json" {
+			r, err := f.Open()
+			require.NoError(t, err)
+			require.NoError(t, json.NewDecoder(r).Decode(&manifest))
+			r.Close()
+		}
+	}
+
+	require.Len(t, manifest.Documents, 2)
+	assert.Empty(t, manifest.Documents[0].File)
+	assert.Equal(t, "file unavailable", manifest.Documents[0].Error)
+	keptPath := "documents/" + kept.ID.String() + "/kept.pdf"
+	assert.Equal(t, keptPath, manifest.Documents[1].File)
+	assert.Empty(t, manifest.Documents[1].Error)
+	assert.True(t, names[keptPath])
+	assert.Len(t, names, 2)
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"gomodlag/internal/blob"
+	"gomodlag/internal/docks"
+	"gomodlag/internal/logger"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBlobGC очередь удаления и ссылки на файлы без базы
+type fakeBlobGC struct {
+	queue      []string
+	failed     map[string]string
+	referenced map[string]struct{}
+}
+
+func (f *fakeBlobGC) PendingBlobDeletions(ctx context.Context, limit int) ([]string, error) {
+	return append([]string{}, f.queue...), nil
+}
+
+func (f *fakeBlobGC) BlobDeleted(ctx context.Context, key string) error {
+	for i, k := range f.queue {
+		if k == key {
+			f.queue = append(f.queue[:i], f.queue[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeBlobGC) BlobDeleteFailed(ctx context.Context, key string, reason string) error {
+	f.failed[key] = reason
+	return nil
+}
+
+func (f *fakeBlobGC) ReferencedBlobs(ctx context.Context) (map[string]struct{}, error) {
+	return f.referenced, nil
+}
+
+// failingStore хранилище, в котором удаление одного ключа не удается
+type failingStore struct {
+	blob.BlobStore
+	key string
+}
+
+func (f failingStore) Delete(ctx context.Context, key string) error {
+	if key == f.key {
+		return errors.New("storage unavailable")
+	}
+	return f.BlobStore.Delete(ctx, key)
+}
+
+func putBlob(t *testing.T, store blob.BlobStore, key string) {
+	require.NoError(t, store.Put(context.Background(), key, strings.NewReader("data"), 4, "text/plain"))
+}
+
+func TestBlobGC_ProcessDeletions(t *testing.T) {
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	putBlob(t, store, "gone.pdf")
+	putBlob(t, store, "stuck.pdf")
+	model := &fakeBlobGC{queue: []string{"gone.pdf", "stuck.pdf", "missing.pdf"}, failed: map[string]string{}}
+	gc := &docks.BlobGC{BlobGCModel: model, Blob: failingStore{BlobStore: store, key: "stuck.pdf"}, Logger: *logger.SetupLogger()}
+
+	deleted, err := gc.ProcessDeletions(ctx)
+	require.NoError(t, err)
+
+	// уже удаленный файл тоже считается удаленным, неудачный остается в очереди
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, []string{"stuck.pdf"}, model.queue)
+	assert.Contains(t, model.failed, "stuck.pdf")
+	_, err = store.Stat(ctx, "gone.pdf")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+}
+
+func TestBlobGC_CollectOrphans(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := blob.NewLocalStore(dir)
+	require.NoError(t, err)
+	for _, key := range []string{"doc.pdf", "old-orphan.pdf", "new-orphan.pdf"} {
+		putBlob(t, store, key)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "old-orphan.pdf"), old, old))
+	model := &fakeBlobGC{referenced: map[string]struct{}{"doc.pdf": {}}}
+	gc := &docks.BlobGC{BlobGCModel: model, Blob: store, Logger: *logger.SetupLogger(), Grace: 24 * time.Hour}
+
+	report, err := gc.CollectOrphans(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Len(t, report.Orphans, 2)
+	assert.Equal(t, 0, report.Deleted)
+
+	// удаляется только сирота старше Grace
+	report, err = gc.CollectOrphans(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	_, err = store.Stat(ctx, "old-orphan.pdf")
+	assert.ErrorIs(t, err, blob.ErrNotFound)
+	_, err = store.Stat(ctx, "new-orphan.pdf")
+	assert.NoError(t, err)
+	_, err = store.Stat(ctx, "doc.pdf")
+	assert.NoError(t, err)
+}
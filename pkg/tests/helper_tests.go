@@ -3,8 +3,10 @@ package tests
 import (
 	"context"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"gomodlag/internal/logger"
 	"gomodlag/internal/storage"
 	"testing"
+	"time"
 )
 
 // setupTestDB подключается к тестовой БД
@@ -22,7 +24,12 @@ func setupTestDB(t *testing.T) *storage.StructPool {
 		t.Fatalf("Failed to ping database: %v", err)
 	}
 
-	return &storage.StructPool{Pool: pool}
+	s := &storage.StructPool{Pool: pool}
+	// схема тестовой БД - те же миграции, что применяет сервер при старте
+	if _, err = s.MigrateUp(ctx, *logger.SetupLogger()); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return s
 }
 
 // cleanupTestDB очищает тестовые данные
@@ -30,9 +37,24 @@ func cleanupTestDB(t *testing.T, s *storage.StructPool) {
 	ctx := context.Background()
 
 	_, err := s.Pool.Exec(ctx, `
-		TRUNCATE TABLE sessions, document_grants, documents, users RESTART IDENTITY CASCADE;
+		TRUNCATE TABLE sessions, revoked_tokens, password_resets, login_attempts, user_totp, totp_recovery_codes, login_challenges, admin_audit, api_keys, user_identities, oidc_logins, blob_deletions, document_grants, documents, users RESTART IDENTITY CASCADE;
 	`)
 	if err != nil {
 		t.Fatalf("Failed to clean tables: %v", err)
 	}
 }
+
+// testToken токен сессии, сброса пароля или challenge со сроком жизни ttl
+func testToken(token string, ttl time.Duration) storage.Token {
+	now := time.Now()
+	return storage.Token{Token: token, TimeCreated: now, TimeExpired: now.Add(ttl)}
+}
+
+// login создает сессию пользователя, как LogicLogin после проверки пароля
+func login(ctx context.Context, s *storage.StructPool, username string, access, refresh storage.Token, meta storage.SessionMeta) (int, error) {
+	userID, _, err := s.GetCredentials(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	return userID, s.CreateSession(ctx, userID, access, refresh, meta)
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"encoding/json"
+	"gomodlag/pkg"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJsonDiff применение diff к исходному документу должно давать целевой
+func TestJsonDiff(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+	}{
+		{"equal", `{"a": 1}`, `{"a": 1}`},
+		{"replace and add", `{"a": 1, "b": {"c": true}}`, `{"a": 2, "b": {"c": true, "d": null}}`},
+		{"remove", `{"a": 1, "b/x": 2}`, `{"a": 1}`},
+		{"arrays", `{"list": [1, 2, 3, 4]}`, `{"list": [1, 5]}`},
+		{"array grows", `[{"id": 1}]`, `[{"id": 2}, {"id": 3}]`},
+		{"type change", `{"a": [1]}`, `{"a": {"b": 1}}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ops, err := pkg.JsonDiff([]byte(tc.from), []byte(tc.to))
+			require.NoError(t, err)
+
+			raw, err := json.Marshal(ops)
+			require.NoError(t, err)
+			patch, err := jsonpatch.DecodePatch(raw)
+			require.NoError(t, err)
+			result, err := patch.Apply([]byte(tc.from))
+			require.NoError(t, err)
+
+			assert.JSONEq(t, tc.to, string(result))
+		})
+	}
+}
+
+func TestJsonDiff_Equal(t *testing.T) {
+	ops, err := pkg.JsonDiff([]byte(`{"a": [1, {"b": 2}]}`), []byte(`{"a": [1, {"b": 2}]}`))
+
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"gomodlag/internal/auth"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoginLimits_LockDuration экспоненциальная блокировка после порога неудач
+func TestLoginLimits_LockDuration(t *testing.T) {
+	limits := auth.LoginLimits{LockBase: 30 * time.Second, LockMax: 5 * time.Minute}
+
+	assert.Equal(t, time.Duration(0), limits.LockDuration(4, 5))
+	assert.Equal(t, 30*time.Second, limits.LockDuration(5, 5))
+	assert.Equal(t, time.Minute, limits.LockDuration(6, 5))
+	assert.Equal(t, 2*time.Minute, limits.LockDuration(7, 5))
+	assert.Equal(t, 5*time.Minute, limits.LockDuration(9, 5))
+	assert.Equal(t, 5*time.Minute, limits.LockDuration(100, 5))
+
+	// 0 попыток - проверка выключена
+	assert.Equal(t, time.Duration(0), limits.LockDuration(100, 0))
+}
+
+// TestIPExtractor ip для блокировок: X-Forwarded-For учитывается только от доверенного прокси
+func TestIPExtractor(t *testing.T) {
+	direct := newServer(t, testConfig(), storage.NewMemory())
+	req := httptest.NewRequest("GET", "/api/docs", nil)
+	req.RemoteAddr = "10.0.0.5:40000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Real-IP", "203.0.113.7")
+	assert.Equal(t, "10.0.0.5", direct.IPExtractor(req))
+
+	c := testConfig()
+	_, proxies, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	c.TrustedProxies = []*net.IPNet{proxies}
+	behindProxy := newServer(t, c, storage.NewMemory())
+	assert.Equal(t, "203.0.113.7", behindProxy.IPExtractor(req))
+
+	// чужой адрес, даже из частной сети, заголовком ip не подменит
+	req.RemoteAddr = "192.168.1.9:40000"
+	assert.Equal(t, "192.168.1.9", behindProxy.IPExtractor(req))
+}
+
+// TestTwoFactor_Lockout неверные коды 2fa копятся в счетчике логина: новые challenge после верного пароля
+// попыток не добавляют
+func TestTwoFactor_Lockout(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory()
+	hasher := pkg.PasswordHasher{BcryptCost: 4}
+	service := &auth.ServiceDB{AuthRegDelModel: s, AdminModel: s, Logger: *logger.SetupLogger(), AccessTokens: auth.DBTokens{TokenValidator: s},
+		Hasher: hasher, Limits: auth.LoginLimits{UserAttempts: 3, LockBase: time.Minute, LockMax: time.Hour, Window: time.Hour}}
+	hash, err := hasher.Hash("Password123!")
+	require.NoError(t, err)
+	user, err := s.CreateUser(ctx, "twofactor1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	const secret = "JBSWY3DPEHPK3PXP"
+	require.NoError(t, s.SaveTOTPSecret(ctx, user.Id, secret))
+	require.NoError(t, s.ConfirmTOTP(ctx, user.Id, 1, []string{"recovery_hash"}))
+	ttl := auth.TokenTTL{Access: time.Minute, Refresh: time.Hour}
+	credentials := auth.Login{Login: "twofactor1", Password: "Password123!"}
+
+	// каждый раз верный пароль и неверный код с новым challenge
+	for range 3 {
+		tokens, err := service.LogicLogin(ctx, credentials, ttl, storage.SessionMeta{})
+		require.NoError(t, err)
+		require.NotEmpty(t, tokens.Challenge)
+		_, err = service.LogicTwoFactor(ctx, auth.TwoFactorLogin{Challenge: tokens.Challenge, TOTPCode: auth.TOTPCode{Code: "000000"}}, ttl, storage.SessionMeta{})
+		assert.Equal(t, storage.Invalidtoken, err)
+	}
+	_, err = service.LogicLogin(ctx, credentials, ttl, storage.SessionMeta{})
+	assert.True(t, errors.Is(err, auth.Locked), err)
+
+	// после снятия блокировки верный код дает сессию и обнуляет счетчик
+	require.NoError(t, s.ResetLoginFailures(ctx, "user:twofactor1"))
+	tokens, err := service.LogicLogin(ctx, credentials, ttl, storage.SessionMeta{})
+	require.NoError(t, err)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	tokens, err = service.LogicTwoFactor(ctx, auth.TwoFactorLogin{Challenge: tokens.Challenge, TOTPCode: auth.TOTPCode{Code: code}}, ttl, storage.SessionMeta{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+	failures, err := s.AddLoginFailure(ctx, "user:twofactor1", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+}
+
+func TestChangePassword_Lockout(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory()
+	hasher := pkg.PasswordHasher{BcryptCost: 4}
+	service := &auth.ServiceDB{AuthRegDelModel: s, AdminModel: s, Logger: *logger.SetupLogger(), AccessTokens: auth.DBTokens{TokenValidator: s},
+		Hasher: hasher, Limits: auth.LoginLimits{UserAttempts: 3, LockBase: time.Minute, LockMax: time.Hour, Window: time.Hour}}
+	hash, err := hasher.Hash("Password123!")
+	require.NoError(t, err)
+	_, err = s.CreateUser(ctx, "changepass1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	ttl := auth.TokenTTL{Access: time.Minute, Refresh: time.Hour}
+	credentials := auth.Login{Login: "changepass1", Password: "Password123!"}
+	tokens, err := service.LogicLogin(ctx, credentials, ttl, storage.SessionMeta{})
+	require.NoError(t, err)
+	userId, err := s.ValidateToken(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+
+	// подбор текущего пароля из чужой сессии блокирует логин так же, как подбор при входе
+	for range 3 {
+		err = service.ChangePasswordLogic(ctx, userId, tokens.AccessToken, "", auth.ChangePassword{CurrentPassword: "wrong", NewPassword: "Password456!"})
+		assert.Equal(t, storage.Invaliddata, err)
+	}
+	err = service.ChangePasswordLogic(ctx, userId, tokens.AccessToken, "", auth.ChangePassword{CurrentPassword: "Password123!", NewPassword: "Password456!"})
+	assert.True(t, errors.Is(err, auth.Locked), err)
+	_, err = service.LogicLogin(ctx, credentials, ttl, storage.SessionMeta{})
+	assert.True(t, errors.Is(err, auth.Locked), err)
+
+	require.NoError(t, s.ResetLoginFailures(ctx, "user:changepass1"))
+	err = service.ChangePasswordLogic(ctx, userId, tokens.AccessToken, "", auth.ChangePassword{CurrentPassword: "Password123!", NewPassword: "Password456!"})
+	require.NoError(t, err)
+	_, err = service.LogicLogin(ctx, auth.Login{Login: "changepass1", Password: "Password456!"}, ttl, storage.SessionMeta{})
+	assert.NoError(t, err)
+}
+
+func TestUnlock_Memory(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory()
+	hasher := pkg.PasswordHasher{BcryptCost: 4}
+	service := &auth.ServiceDB{AuthRegDelModel: s, AdminModel: s, Logger: *logger.SetupLogger(), AccessTokens: auth.DBTokens{TokenValidator: s},
+		Hasher: hasher, Limits: auth.LoginLimits{UserAttempts: 2, LockBase: time.Minute, LockMax: time.Hour, Window: time.Hour}}
+	hash, err := hasher.Hash("Password123!")
+	require.NoError(t, err)
+	_, err = s.CreateUser(ctx, "unlockme1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	ttl := auth.TokenTTL{Access: time.Minute, Refresh: time.Hour}
+
+	// без блокировки разблокировать нечего, в журнал ничего не пишется
+	unlocked, err := service.UnlockLogic(ctx, storage.SystemAdmin, "unlockme1")
+	require.NoError(t, err)
+	assert.False(t, unlocked)
+
+	for range 2 {
+		_, err = service.LogicLogin(ctx, auth.Login{Login: "unlockme1", Password: "wrong"}, ttl, storage.SessionMeta{})
+		assert.Equal(t, storage.Invaliddata, err)
+	}
+	_, err = service.LogicLogin(ctx, auth.Login{Login: "unlockme1", Password: "Password123!"}, ttl, storage.SessionMeta{})
+	assert.True(t, errors.Is(err, auth.Locked), err)
+	unlocked, err = service.UnlockLogic(ctx, storage.SystemAdmin, "unlockme1")
+	require.NoError(t, err)
+	assert.True(t, unlocked)
+	_, err = service.LogicLogin(ctx, auth.Login{Login: "unlockme1", Password: "Password123!"}, ttl, storage.SessionMeta{})
+	assert.NoError(t, err)
+
+	_, err = service.UnlockLogic(ctx, storage.SystemAdmin, "nosuchuser1")
+	assert.ErrorIs(t, err, storage.UnknownUser)
+
+	audit, err := s.ListAudit(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, audit, 1)
+	assert.Equal(t, auth.AuditUnlockUser, audit[0].Action)
+	assert.Equal(t, "unlockme1", audit[0].Target)
+
+	// неизвестный логин - 404
+	srv := storeServer(t, storage.NewMemory())
+	admin := loginAs(t, srv, "memadmin1")
+	code, _ := call(t, srv, http.MethodPost, "/api/admin/users/nosuchuser1/unlock", admin, nil, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,546 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gomodlag/internal/blob"
+	"gomodlag/internal/cache"
+	"gomodlag/internal/config"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/server"
+	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_Tx(t *testing.T) {
+	m := storage.NewMemory()
+	ctx := context.Background()
+	_, err := m.Register(ctx, "hash", "memowner1")
+	require.NoError(t, err)
+	ownerID, _, err := m.GetCredentials(ctx, "memowner1")
+	require.NoError(t, err)
+
+	// ошибка fn: документа нет
+	dock := storage.Dock{Id: uuid.New(), Name: "draft", Json: json.RawMessage(`{"a":1}`), OwnerId: ownerID}
+	errAbort := errors.New("abort")
+	err = m.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+	_, err = m.GetDockById(ctx, dock.Id)
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	// неизвестный пользователь в гранте: транзакция откатывается целиком
+	err = m.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddGrant(ctx, []string{"nosuchuser1"}, "viewer", dock.Id)
+		return err
+	})
+	assert.ErrorIs(t, err, storage.UnknownUser)
+	_, err = m.GetDockById(ctx, dock.Id)
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	err = m.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		v, err := tx.AddVersion(ctx, dock, ownerID, "h1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, v)
+		// до конца транзакции изменения не видны читателям
+		_, err = m.GetDockById(ctx, dock.Id)
+		assert.ErrorIs(t, err, storage.Invaliddata)
+
+		// вторая транзакция ждет первую, пока не истечет ctx
+		waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err = m.WithTx(waitCtx, func(tx storage.DockTx) error { return nil })
+		assert.ErrorIs(t, err, storage.SomeWrong)
+		return nil
+	})
+	require.NoError(t, err)
+
+	doc, err := m.GetDockById(ctx, dock.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "draft", doc.Name)
+	assert.Equal(t, []string{}, doc.GrantedUsers)
+	versions, err := m.ListVersions(ctx, dock.Id)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, "memowner1", versions[0].Author)
+}
+
+func TestMemory_Grants(t *testing.T) {
+	m := storage.NewMemory()
+	ctx := context.Background()
+	ids := map[string]int{}
+	for _, name := range []string{"memowner1", "memfriend1", "memstranger1"} {
+		_, err := m.Register(ctx, "hash", name)
+		require.NoError(t, err)
+		ids[name], _, err = m.GetCredentials(ctx, name)
+		require.NoError(t, err)
+	}
+	_, err := m.Register(ctx, "hash", "memowner1")
+	assert.Error(t, err)
+
+	dock := storage.Dock{Id: uuid.New(), Name: "shared", Mime: "application/json", Json: json.RawMessage(`{}`), OwnerId: ids["memowner1"]}
+	err = m.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddGrant(ctx, []string{"memfriend1"}, "viewer", dock.Id)
+		require.NoError(t, err)
+		// повторный грант меняет роль
+		_, err = tx.AddGrant(ctx, []string{"memfriend1"}, "editor", dock.Id)
+		return err
+	})
+	require.NoError(t, err)
+
+	for name, want := range map[string]string{"memowner1": "owner", "memfriend1": "editor"} {
+		role, err := m.GetDockRole(ctx, ids[name], dock.Id)
+		require.NoError(t, err)
+		assert.Equal(t, want, role)
+	}
+	_, err = m.GetDockRole(ctx, ids["memstranger1"], dock.Id)
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	// чужие документы владельца видны только по гранту
+	docs, err := m.GetDock(ctx, storage.GetDock{Id: ids["memfriend1"], Login: "memowner1", Key: "name", Value: "shared", Limit: 50})
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, []string{"memfriend1"}, docs[0].GrantedUsers)
+	docs, err = m.GetDock(ctx, storage.GetDock{Id: ids["memstranger1"], Login: "memowner1", Key: "name", Value: "shared", Limit: 50})
+	require.NoError(t, err)
+	assert.Empty(t, docs)
+	_, err = m.GetDock(ctx, storage.GetDock{Id: ids["memowner1"], Key: "owner_id", Value: "1"})
+	assert.Error(t, err)
+
+	revoked, err := m.RevokeGrant(ctx, dock.Id, "memfriend1")
+	require.NoError(t, err)
+	assert.Equal(t, ids["memfriend1"], revoked)
+	_, err = m.RevokeGrant(ctx, dock.Id, "memfriend1")
+	assert.ErrorIs(t, err, storage.Invaliddata)
+}
+
+func TestMemory_Sessions(t *testing.T) {
+	m := storage.NewMemory()
+	ctx := context.Background()
+	_, err := m.Register(ctx, "hash", "memsession1")
+	require.NoError(t, err)
+	userID, _, err := m.GetCredentials(ctx, "memsession1")
+	require.NoError(t, err)
+
+	require.NoError(t, m.CreateSession(ctx, userID, testToken("access1", time.Hour), testToken("refresh1", 24*time.Hour), storage.SessionMeta{UserAgent: "test"}))
+	got, err := m.ValidateToken(ctx, "access1")
+	require.NoError(t, err)
+	assert.Equal(t, userID, got)
+
+	_, err = m.RotateRefreshToken(ctx, "refresh1", testToken("access2", time.Hour), testToken("refresh2", 24*time.Hour))
+	require.NoError(t, err)
+	_, err = m.ValidateToken(ctx, "access1")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+
+	// повторное использование refresh токена завершает сессию
+	_, err = m.RotateRefreshToken(ctx, "refresh1", testToken("access3", time.Hour), testToken("refresh3", 24*time.Hour))
+	assert.ErrorIs(t, err, storage.TokenReused)
+	_, err = m.ValidateToken(ctx, "access2")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	revoked, err := m.ListRevoked(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, revoked, "access2")
+
+	require.NoError(t, m.CreateSession(ctx, userID, testToken("access4", -time.Minute), testToken("refresh4", -time.Second), storage.SessionMeta{}))
+	_, err = m.ValidateToken(ctx, "access4")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	n, err := m.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestMemory_DeleteUser(t *testing.T) {
+	m := storage.NewMemory()
+	ctx := context.Background()
+	_, err := m.Register(ctx, "hash", "memleaver1")
+	require.NoError(t, err)
+	userID, _, err := m.GetCredentials(ctx, "memleaver1")
+	require.NoError(t, err)
+	require.NoError(t, m.CreateSession(ctx, userID, testToken("access1", time.Hour), testToken("refresh1", time.Hour), storage.SessionMeta{}))
+
+	dock := storage.Dock{Id: uuid.New(), Name: "report", IsFile: true, Filepath: "ab/report", OwnerId: userID}
+	err = m.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddVersion(ctx, dock, userID, "h1")
+		return err
+	})
+	require.NoError(t, err)
+
+	deleted, err := m.DeleteUser(ctx, "memleaver1")
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{dock.Id}, deleted.Documents)
+	assert.Equal(t, []string{"ab/report"}, deleted.Files)
+	_, err = m.ValidateToken(ctx, "access1")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	_, err = m.GetUser(ctx, userID)
+	assert.ErrorIs(t, err, storage.UnknownUser)
+
+	keys, err := m.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ab/report"}, keys)
+	require.NoError(t, m.BlobDeleted(ctx, "ab/report"))
+	keys, err = m.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestMemory_Concurrent(t *testing.T) {
+	m := storage.NewMemory()
+	ctx := context.Background()
+	const n = 50
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = m.AddLoginFailure(ctx, "user:memrace1", time.Hour)
+			_, _ = m.Register(ctx, "hash", fmt.Sprintf("memrace%03d", i))
+		}()
+	}
+	wg.Wait()
+	failures, err := m.AddLoginFailure(ctx, "user:memrace1", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, n+1, failures)
+	users, err := m.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, n)
+}
+
+// storeServer сервер целиком поверх db и локального хранилища файлов
+func storeServer(t *testing.T, db storage.Store) *httptest.Server {
+	srv := httptest.NewServer(newServer(t, testConfig(), db))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newServer сервер из server.New поверх db с файлами во временном каталоге
+func newServer(t *testing.T, c config.Config, db storage.Store) *echo.Echo {
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	e, err := server.New(ctx, c, db, store, *logger.SetupLogger())
+	require.NoError(t, err)
+	return e
+}
+
+func testConfig() config.Config {
+	return config.Config{
+		BootstrapAdmin: config.BootstrapAdmin{Login: "memadmin1", Password: "Password123!"},
+		DockTTL:        15 * time.Minute,
+		RefreshTTL:     24 * time.Hour,
+		ResetTTL:       time.Hour,
+		CacheTTL:       time.Minute,
+		CacheFileMax:   1 << 20,
+		Password:       config.PasswordConfig{BcryptCost: 4},
+		TOTPIssuer:     "gomodlag",
+		Login:          config.LoginConfig{UserAttempts: 5, IPAttempts: 20, LockMax: time.Minute},
+		BlobGC:         config.BlobGCConfig{Interval: time.Hour, Grace: time.Hour},
+	}
+}
+
+type apiResp struct {
+	Error    *struct{ Text string } `json:"error"`
+	Response json.RawMessage        `json:"response"`
+	Data     json.RawMessage        `json:"data"`
+}
+
+// call запрос к серверу; body - JSON или готовый *bytes.Buffer с contentType
+func call(t *testing.T, srv *httptest.Server, method, path, token string, body any, contentType string) (int, apiResp) {
+	var reader *bytes.Buffer
+	switch b := body.(type) {
+	case nil:
+		reader = &bytes.Buffer{}
+	case *bytes.Buffer:
+		reader = b
+	default:
+		raw, err := json.Marshal(b)
+		require.NoError(t, err)
+		reader = bytes.NewBuffer(raw)
+		contentType = "application/json"
+	}
+	req, err := http.NewRequest(method, srv.URL+path, reader)
+	require.NoError(t, err)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var resp apiResp
+	_ = json.NewDecoder(res.Body).Decode(&resp)
+	return res.StatusCode, resp
+}
+
+func loginAs(t *testing.T, srv *httptest.Server, username string) string {
+	code, resp := call(t, srv, http.MethodPost, "/api/auth", "", map[string]string{"login": username, "password": "Password123!"}, "")
+	require.Equal(t, http.StatusOK, code)
+	var tokens struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Response, &tokens))
+	require.NotEmpty(t, tokens.Token)
+	return tokens.Token
+}
+
+// TestMemory_FileCache файл с mime application/json берется из кеша как файл, а HEAD идет через ServeContent
+func TestMemory_FileCache(t *testing.T) {
+	c := cache.NewMemoryCache(time.Minute)
+	c.SetFile("f", []byte(`{"a":1}`), "application/json", `"etag"`, time.Now())
+	var dest json.RawMessage
+	found, _ := c.GetJSON("f", &dest)
+	assert.False(t, found)
+	require.NoError(t, c.SetJSON("j", map[string]int{"a": 1}))
+	_, found = c.GetFile("j")
+	assert.False(t, found)
+
+	m := storage.NewMemory()
+	srv := storeServer(t, m)
+	hash, err := pkg.PasswordHasher{BcryptCost: 4}.Hash("Password123!")
+	require.NoError(t, err)
+	carolUser, err := m.CreateUser(context.Background(), "memcarol1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	carol := loginAs(t, srv, "memcarol1")
+
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	require.NoError(t, w.WriteField("meta", `{"name":"raw","mime":"application/json","file":true}`))
+	fw, err := w.CreateFormFile("file", "raw.png")
+	require.NoError(t, err)
+	// тип содержимого проверяется по сигнатуре, mime в meta задает клиент
+	content := "\x89PNG\r\n\x1a\nbody"
+	_, err = fw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	code, resp := call(t, srv, http.MethodPost, "/api/docs", carol, &form, w.FormDataContentType())
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	docs, err := m.GetDock(context.Background(), storage.GetDock{Id: carolUser.Id, Key: "name", Value: "raw", Limit: 50})
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	docPath := srv.URL + "/api/docs/" + docs[0].ID.String()
+
+	get := func(method string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, docPath, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+carol)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+	// второй запрос отдается из кеша с тем же Last-Modified
+	first, body := get(http.MethodGet)
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Equal(t, content, string(body))
+	require.NotEmpty(t, first.Header.Get("Last-Modified"))
+	cached, body := get(http.MethodGet)
+	require.Equal(t, http.StatusOK, cached.StatusCode)
+	assert.Equal(t, content, string(body))
+	assert.Equal(t, first.Header.Get("Last-Modified"), cached.Header.Get("Last-Modified"))
+
+	head, body := get(http.MethodHead)
+	require.Equal(t, http.StatusOK, head.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, "12", head.Header.Get("Content-Length"))
+	assert.Equal(t, "bytes", head.Header.Get("Accept-Ranges"))
+}
+
+// TestMemory_ReplacePublic editor меняет содержимое, но не может открыть документ для всех
+func TestMemory_ReplacePublic(t *testing.T) {
+	m := storage.NewMemory()
+	srv := storeServer(t, m)
+	hash, err := pkg.PasswordHasher{BcryptCost: 4}.Hash("Password123!")
+	require.NoError(t, err)
+	owner, err := m.CreateUser(context.Background(), "memowner1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	_, err = m.CreateUser(context.Background(), "memeditor1", hash, storage.RoleUser)
+	require.NoError(t, err)
+	ownerToken := loginAs(t, srv, "memowner1")
+	editorToken := loginAs(t, srv, "memeditor1")
+
+	send := func(method, path, token, meta string) int {
+		var form bytes.Buffer
+		w := multipart.NewWriter(&form)
+		require.NoError(t, w.WriteField("meta", meta))
+		require.NoError(t, w.WriteField("json", `{"a":1}`))
+		require.NoError(t, w.Close())
+		code, _ := call(t, srv, method, path, token, &form, w.FormDataContentType())
+		return code
+	}
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/api/docs", ownerToken, `{"name":"shared","mime":"application/json"}`))
+	docs, err := m.GetDock(context.Background(), storage.GetDock{Id: owner.Id, Key: "name", Value: "shared", Limit: 50})
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	docPath := "/api/docs/" + docs[0].ID.String()
+	publicPath := "/api/public/docs/" + docs[0].ID.String()
+	code, resp := call(t, srv, http.MethodPost, docPath+"/grants", ownerToken, map[string]any{"grant": []string{"memeditor1"}, "role": "editor"}, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPut, docPath, editorToken, `{"name":"shared","mime":"application/json","public":true}`))
+	code, _ = call(t, srv, http.MethodGet, publicPath, "", nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, docPath, editorToken, `{"name":"shared","mime":"application/json"}`))
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, docPath, ownerToken, `{"name":"shared","mime":"application/json","public":true}`))
+	code, _ = call(t, srv, http.MethodGet, publicPath, "", nil, "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// TestMemory_LoginRule правило для логина одно на /api/register и создание пользователя администратором:
+// от 8 символов, латиница и цифры, хотя бы одна цифра
+func TestMemory_LoginRule(t *testing.T) {
+	c := testConfig()
+	c.AdminToken = "regtoken"
+	srv := httptest.NewServer(newServer(t, c, storage.NewMemory()))
+	t.Cleanup(srv.Close)
+	admin := loginAs(t, srv, "memadmin1")
+
+	cases := map[string]bool{
+		"user2024x":  true,
+		"2024login":  true,
+		"nodigitsss": false,
+		"short1":     false,
+		"логин12345": false,
+		"user_12345": false,
+	}
+	for login, ok := range cases {
+		want := http.StatusBadRequest
+		if ok {
+			want = http.StatusOK
+		}
+		code, _ := call(t, srv, http.MethodPost, "/api/register", "",
+			map[string]string{"login": login, "password": "Password123!", "token": "regtoken"}, "")
+		assert.Equal(t, want, code, login)
+		code, _ = call(t, srv, http.MethodPost, "/api/admin/users", admin,
+			map[string]string{"login": "a" + login, "password": "Password123!"}, "")
+		assert.Equal(t, want, code, login)
+	}
+}
+
+// TestMemory_BootstrapWeakPassword сервер стартует, но администратор со слабым паролем не создается
+func TestMemory_BootstrapWeakPassword(t *testing.T) {
+	m := storage.NewMemory()
+	c := testConfig()
+	c.BootstrapAdmin.Password = "password"
+	newServer(t, c, m)
+	hasAdmin, err := m.HasAdmin(context.Background())
+	require.NoError(t, err)
+	assert.False(t, hasAdmin)
+}
+
+func TestMemory_HTTP(t *testing.T) {
+	m := storage.NewMemory()
+	checkHTTPFlow(t, storeServer(t, m), m)
+}
+
+// checkHTTPFlow загрузка, гранты, правка с версиями, удаление, выход и блокировка через HTTP
+func checkHTTPFlow(t *testing.T, srv *httptest.Server, db storage.Store) {
+	admin := loginAs(t, srv, "memadmin1")
+	hash, err := pkg.PasswordHasher{BcryptCost: 4}.Hash("Password123!")
+	require.NoError(t, err)
+	for _, name := range []string{"memalice1", "membobby1"} {
+		_, err = db.CreateUser(context.Background(), name, hash, storage.RoleUser)
+		require.NoError(t, err)
+	}
+	code, resp := call(t, srv, http.MethodGet, "/api/admin/users", admin, nil, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	alice := loginAs(t, srv, "memalice1")
+	bobby := loginAs(t, srv, "membobby1")
+
+	// загрузка JSON документа с грантом bobby
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	require.NoError(t, w.WriteField("meta", `{"name":"notes","mime":"application/json","grant":["membobby1"]}`))
+	require.NoError(t, w.WriteField("json", `{"a":1}`))
+	require.NoError(t, w.Close())
+	code, resp = call(t, srv, http.MethodPost, "/api/docs", alice, &form, w.FormDataContentType())
+	require.Equal(t, http.StatusOK, code, resp.Error)
+
+	code, resp = call(t, srv, http.MethodGet, "/api/docs", alice, map[string]string{"key": "name", "value": "notes"}, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	var list struct {
+		Docs []struct {
+			Id    string   `json:"id"`
+			Grant []string `json:"grant"`
+		} `json:"docs"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Data, &list))
+	require.Len(t, list.Docs, 1)
+	assert.Equal(t, []string{"membobby1"}, list.Docs[0].Grant)
+	docPath := "/api/docs/" + list.Docs[0].Id
+
+	code, resp = call(t, srv, http.MethodGet, docPath, bobby, nil, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	assert.JSONEq(t, `{"data":{"a":1}}`, string(resp.Data))
+
+	// viewer не может править, владелец - может, и правка дает новую версию
+	code, _ = call(t, srv, http.MethodPatch, docPath, bobby, bytes.NewBufferString(`{"b":2}`), "application/merge-patch+json")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, resp = call(t, srv, http.MethodPatch, docPath, alice, bytes.NewBufferString(`{"b":2}`), "application/merge-patch+json")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	code, resp = call(t, srv, http.MethodGet, docPath+"/versions", alice, nil, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	var versions struct {
+		Versions []struct {
+			Version int    `json:"version"`
+			Author  string `json:"author"`
+		} `json:"versions"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Data, &versions))
+	require.Len(t, versions.Versions, 2)
+	assert.Equal(t, "memalice1", versions.Versions[1].Author)
+
+	code, _ = call(t, srv, http.MethodDelete, docPath+"/grants/membobby1", alice, nil, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = call(t, srv, http.MethodGet, docPath, bobby, nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp = call(t, srv, http.MethodDelete, docPath, alice, nil, "")
+	require.Equal(t, http.StatusOK, code, resp.Error)
+	code, _ = call(t, srv, http.MethodGet, docPath, alice, nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// выход: токен больше не принимается
+	code, _ = call(t, srv, http.MethodPost, "/api/auth/"+bobby, "", nil, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = call(t, srv, http.MethodGet, "/api/docs", bobby, nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// заблокированный администратором пользователь теряет сессии
+	code, _ = call(t, srv, http.MethodPost, "/api/admin/users/memalice1/disable", admin, nil, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = call(t, srv, http.MethodGet, "/api/docs", alice, nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(t, srv, http.MethodGet, "/api/admin/users", bobby, nil, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/storage"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations_Embedded(t *testing.T) {
+	migrations, err := storage.Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	// версии идут подряд с 1, у каждой есть up и down
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up, m.Name)
+		assert.NotEmpty(t, m.Down, m.Name)
+	}
+	assert.Equal(t, "baseline", migrations[0].Name)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+	t.Run("sorted by version", func(t *testing.T) {
+		migrations, err := storage.LoadMigrations(fstest.MapFS{
+			"0010_b.up.sql":   file("B"),
+			"0010_b.down.sql": file("-B"),
+			"0002_a.up.sql":   file("A"),
+			"0002_a.down.sql": file("-A"),
+		})
+		require.NoError(t, err)
+		require.Len(t, migrations, 2)
+		assert.Equal(t, storage.Migration{Version: 2, Name: "a", Up: "A", Down: "-A"}, migrations[0])
+		assert.Equal(t, 10, migrations[1].Version)
+	})
+
+	for name, dir := range map[string]fstest.MapFS{
+		"missing down":  {"0001_a.up.sql": file("A")},
+		"bad name":      {"init.sql": file("A")},
+		"zero version":  {"0000_a.up.sql": file("A"), "0000_a.down.sql": file("-A")},
+		"name mismatch": {"0001_a.up.sql": file("A"), "0001_b.down.sql": file("-B")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := storage.LoadMigrations(dir)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s := setupTestDB(t)
+	defer s.Pool.Close()
+	ctx := context.Background()
+	logg := *logger.SetupLogger()
+
+	// setupTestDB уже применил все миграции
+	n, err := s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	states, err := s.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, st := range states {
+		assert.NotNil(t, st.AppliedAt, st.Name)
+	}
+
+	// последняя миграция откатывается и применяется снова
+	n, err = s.MigrateDown(ctx, 1, logg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	states, err = s.MigrationStatus(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, states[len(states)-1].AppliedAt)
+
+	n, err = s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+// TestMigrate_VersionsBackfill документ без истории (созданный до document_versions) получает версию 1
+func TestMigrate_VersionsBackfill(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+	ctx := context.Background()
+	logg := *logger.SetupLogger()
+
+	owner, err := s.CreateUser(ctx, "backfill_owner", "hash", storage.RoleUser)
+	require.NoError(t, err)
+
+	// откатываемся до baseline: document_versions еще нет
+	migrations, err := storage.Migrations()
+	require.NoError(t, err)
+	_, err = s.MigrateDown(ctx, len(migrations)-1, logg)
+	require.NoError(t, err)
+
+	docID := uuid.New()
+	_, err = s.Pool.Exec(ctx, `
+		INSERT INTO documents (id, name, public, is_file, mime, json_data, own_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, docID, "Legacy", false, false, "application/json", `{"a": 1}`, owner.Id)
+	require.NoError(t, err)
+
+	// 0002 дописывает версии уже существующим документам
+	_, err = s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+
+	v, err := s.GetVersion(ctx, docID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Legacy", v.Name)
+	assert.Equal(t, owner.Id, v.AuthorId)
+	assert.JSONEq(t, `{"a": 1}`, string(v.Json))
+	assert.NotEmpty(t, v.ContentHash)
+	versions, err := s.ListVersions(ctx, docID)
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
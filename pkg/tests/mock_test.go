@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"gomodlag/internal/api"
+	"gomodlag/internal/auth"
+	"gomodlag/internal/blob"
 	"gomodlag/internal/cache"
 	"gomodlag/internal/docks"
 	"gomodlag/internal/storage"
+	"gomodlag/pkg"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -44,19 +50,124 @@ func (m *MockDockService) DeleteDockLogic(ctx context.Context, data docks.DockBy
 	return args.Error(0)
 }
 
+func (m *MockDockService) OpenDockFile(ctx context.Context, doc storage.DocumentWithGrants) (io.ReadSeekCloser, blob.ObjectInfo, error) {
+	args := m.Called(ctx, doc)
+	return args.Get(0).(io.ReadSeekCloser), args.Get(1).(blob.ObjectInfo), args.Error(2)
+}
+
+func (m *MockDockService) ReplaceDockLogic(ctx context.Context, id docks.DockById, data docks.UploadRequest) error {
+	args := m.Called(ctx, id, data)
+	return args.Error(0)
+}
+
+func (m *MockDockService) PatchDockLogic(ctx context.Context, id docks.DockById, patch docks.DockPatch) (json.RawMessage, error) {
+	args := m.Called(ctx, id, patch)
+	return args.Get(0).(json.RawMessage), args.Error(1)
+}
+
+func (m *MockDockService) GetDockForUpdate(ctx context.Context, idDock uuid.UUID) (storage.Dock, error) {
+	args := m.Called(ctx, idDock)
+	return args.Get(0).(storage.Dock), args.Error(1)
+}
+
+func (m *MockDockService) UpdateDock(ctx context.Context, dock storage.Dock) error {
+	args := m.Called(ctx, dock)
+	return args.Error(0)
+}
+
+func (m *MockDockService) ListVersionsLogic(ctx context.Context, id docks.DockById) ([]storage.DockVersion, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]storage.DockVersion), args.Error(1)
+}
+
+func (m *MockDockService) GetVersionLogic(ctx context.Context, id docks.DockById, version int) (storage.DockVersion, error) {
+	args := m.Called(ctx, id, version)
+	return args.Get(0).(storage.DockVersion), args.Error(1)
+}
+
+func (m *MockDockService) RestoreVersionLogic(ctx context.Context, id docks.DockById, version int) (int, error) {
+	args := m.Called(ctx, id, version)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDockService) DiffVersionsLogic(ctx context.Context, id docks.DockById, from, to int) ([]pkg.DiffOp, error) {
+	args := m.Called(ctx, id, from, to)
+	return args.Get(0).([]pkg.DiffOp), args.Error(1)
+}
+
+func (m *MockDockService) AddVersion(ctx context.Context, dock storage.Dock, authorId int, hash string) (int, error) {
+	args := m.Called(ctx, dock, authorId, hash)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDockService) ListVersions(ctx context.Context, idDock uuid.UUID) ([]storage.DockVersion, error) {
+	args := m.Called(ctx, idDock)
+	return args.Get(0).([]storage.DockVersion), args.Error(1)
+}
+
+func (m *MockDockService) GetVersion(ctx context.Context, idDock uuid.UUID, version int) (storage.DockVersion, error) {
+	args := m.Called(ctx, idDock, version)
+	return args.Get(0).(storage.DockVersion), args.Error(1)
+}
+
+func (m *MockDockService) ListGrantsLogic(ctx context.Context, id docks.DockById) ([]storage.Grant, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]storage.Grant), args.Error(1)
+}
+
+func (m *MockDockService) AddGrantsLogic(ctx context.Context, id docks.DockById, logins []string, role docks.Role) error {
+	args := m.Called(ctx, id, logins, role)
+	return args.Error(0)
+}
+
+func (m *MockDockService) RevokeGrantLogic(ctx context.Context, id docks.DockById, login string) (int, error) {
+	args := m.Called(ctx, id, login)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDockService) ListGrants(ctx context.Context, idDock uuid.UUID) ([]storage.Grant, error) {
+	args := m.Called(ctx, idDock)
+	return args.Get(0).([]storage.Grant), args.Error(1)
+}
+
+func (m *MockDockService) RevokeGrant(ctx context.Context, idDock uuid.UUID, login string) (int, error) {
+	args := m.Called(ctx, idDock, login)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockDockService) Authorize(ctx context.Context, id docks.DockById, perm docks.Permission) error {
+	args := m.Called(ctx, id, perm)
+	return args.Error(0)
+}
+
+func (m *MockDockService) GetDockRole(ctx context.Context, idUser int, idDock uuid.UUID) (string, error) {
+	args := m.Called(ctx, idUser, idDock)
+	return args.String(0), args.Error(1)
+}
+
+// nopSeekCloser превращает bytes.Reader в io.ReadSeekCloser
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
 // Добавляем методы интерфейса если нужно
-func (m *MockDockService) Begin(ctx context.Context) (pgx.Tx, error) {
+func (m *MockDockService) WithTx(ctx context.Context, fn func(tx storage.DockTx) error) error {
 	args := m.Called(ctx)
-	return args.Get(0).(pgx.Tx), args.Error(1)
+	if err := args.Error(0); err != nil {
+		return err
+	}
+	return fn(m)
 }
 
-func (m *MockDockService) NewDocs(ctx context.Context, dock storage.Dock, tx pgx.Tx) (bool, error) {
-	args := m.Called(ctx, dock, tx)
+func (m *MockDockService) NewDocs(ctx context.Context, dock storage.Dock) (bool, error) {
+	args := m.Called(ctx, dock)
 	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockDockService) AddGrant(ctx context.Context, grants []string, docid uuid.UUID, tx pgx.Tx) (bool, error) {
-	args := m.Called(ctx, grants, docid, tx)
+func (m *MockDockService) AddGrant(ctx context.Context, grants []string, role string, docid uuid.UUID) (bool, error) {
+	args := m.Called(ctx, grants, role, docid)
 	return args.Bool(0), args.Error(1)
 }
 
@@ -65,13 +176,28 @@ func (m *MockDockService) GetDock(ctx context.Context, filter storage.GetDock) (
 	return args.Get(0).([]storage.DocumentWithGrants), args.Error(1)
 }
 
-func (m *MockDockService) GetDockById(ctx context.Context, idUser int, idDock uuid.UUID) (storage.DocumentWithGrants, error) {
-	args := m.Called(ctx, idUser, idDock)
+func (m *MockDockService) GetDockById(ctx context.Context, idDock uuid.UUID) (storage.DocumentWithGrants, error) {
+	args := m.Called(ctx, idDock)
 	return args.Get(0).(storage.DocumentWithGrants), args.Error(1)
 }
 
-func (m *MockDockService) DeleteDock(ctx context.Context, idUser int, idDock uuid.UUID) error {
-	args := m.Called(ctx, idUser, idDock)
+func (m *MockDockService) DeleteDock(ctx context.Context, idDock uuid.UUID) error {
+	args := m.Called(ctx, idDock)
+	return args.Error(0)
+}
+
+func (m *MockDockService) ListOwnedDocks(ctx context.Context, idUser int) ([]storage.DocumentWithGrants, error) {
+	args := m.Called(ctx, idUser)
+	return args.Get(0).([]storage.DocumentWithGrants), args.Error(1)
+}
+
+func (m *MockDockService) ExportDocksLogic(ctx context.Context, idUser int) ([]storage.DocumentWithGrants, error) {
+	args := m.Called(ctx, idUser)
+	return args.Get(0).([]storage.DocumentWithGrants), args.Error(1)
+}
+
+func (m *MockDockService) WriteExport(ctx context.Context, docs []storage.DocumentWithGrants, w io.Writer) error {
+	args := m.Called(ctx, docs, w)
 	return args.Error(0)
 }
 
@@ -91,8 +217,8 @@ func TestDockHandler_Smoke(t *testing.T) {
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
 
-		// Устанавливаем userid в контекст (как это делает middleware)
-		c.Set("userid", 1)
+		// Кладём пользователя в контекст (как это делает middleware)
+		withUser(c, 1)
 
 		expectedFilter := storage.GetDock{
 			Id:    1,
@@ -116,7 +242,7 @@ func TestDockHandler_Smoke(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.SetParamNames("id")
 		c.SetParamValues("invalid")
-		c.Set("userid", 1)
+		withUser(c, 1)
 
 		err := handler.GetDocHandler(c)
 
@@ -131,7 +257,7 @@ func TestDockHandler_Smoke(t *testing.T) {
 		c := e.NewContext(req, rec)
 		c.SetParamNames("id")
 		c.SetParamValues("invalid")
-		c.Set("userid", 1)
+		withUser(c, 1)
 
 		err := handler.DeleteDocHandler(c)
 
@@ -144,7 +270,7 @@ func TestDockHandler_Smoke(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
-		// НЕ устанавливаем userid
+		// НЕ кладём пользователя в контекст
 
 		err := handler.ListDocsHandler(c)
 
@@ -153,6 +279,35 @@ func TestDockHandler_Smoke(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
 
+	// Test отдачи файла по частям (Range)
+	t.Run("GetDoc serves byte ranges for files", func(t *testing.T) {
+		docID := uuid.New()
+		doc := storage.DocumentWithGrants{ID: docID, IsFile: true, Mime: "video/mp4", Filepath: "v.mp4"}
+		content := []byte("0123456789")
+
+		mockDock.On("Authorize", mock.Anything, docks.DockById{IdUser: 1, IdDock: docID}, docks.PermRead).Return(nil)
+		mockDock.On("GetDockByIdLogic", mock.Anything, docks.DockById{IdUser: 1, IdDock: docID}).Return(doc, nil)
+		mockDock.On("OpenDockFile", mock.Anything, doc).
+			Return(io.ReadSeekCloser(nopSeekCloser{bytes.NewReader(content)}), blob.ObjectInfo{Size: int64(len(content))}, nil)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/docs/"+docID.String(), nil)
+		req.Header.Set("Range", "bytes=2-5")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(docID.String())
+		withUser(c, 1)
+
+		err := handler.GetDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "2345", rec.Body.String())
+		assert.Equal(t, "4", rec.Header().Get("Content-Length"))
+		assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+		assert.Equal(t, "video/mp4", rec.Header().Get("Content-Type"))
+	})
+
 	// Test с параметрами фильтра
 	t.Run("ListDocs with filter parameters", func(t *testing.T) {
 		body := []byte(`{"key": "name", "value": "test", "limit": 10}`)
@@ -160,7 +315,7 @@ func TestDockHandler_Smoke(t *testing.T) {
 		req.Header.Set("Content-Type", "application/json")
 		rec := httptest.NewRecorder()
 		c := e.NewContext(req, rec)
-		c.Set("userid", 1)
+		withUser(c, 1)
 
 		// Настраиваем mock
 		expectedFilter := storage.GetDock{
@@ -180,6 +335,395 @@ func TestDockHandler_Smoke(t *testing.T) {
 	})
 }
 
+func TestPatchDocHandler(t *testing.T) {
+	e := echo.New()
+
+	mockDock := new(MockDockService)
+	handler := &api.DockHandler{
+		DockLogic: mockDock,
+		Cache:     cache.NewMemoryCache(time.Minute),
+	}
+	docID := uuid.New()
+	mockDock.On("Authorize", mock.Anything, docks.DockById{IdUser: 1, IdDock: docID}, docks.PermWrite).Return(nil)
+
+	newContext := func(contentType string, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/docs/"+docID.String(), bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(docID.String())
+		withUser(c, 1)
+		return c, rec
+	}
+
+	t.Run("rejects plain json", func(t *testing.T) {
+		c, rec := newContext("application/json", `{"a": 1}`)
+
+		err := handler.PatchDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	})
+
+	t.Run("applies merge patch", func(t *testing.T) {
+		body := `{"a": null}`
+		patch := docks.DockPatch{Type: docks.MergePatch, Body: []byte(body)}
+		mockDock.On("PatchDockLogic", mock.Anything, docks.DockById{IdUser: 1, IdDock: docID}, patch).
+			Return(json.RawMessage(`{"b": 2}`), nil)
+		c, rec := newContext(docks.MergePatch, body)
+
+		err := handler.PatchDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"data": {"data": {"b": 2}}}`, rec.Body.String())
+		mockDock.AssertExpectations(t)
+	})
+
+	t.Run("denies users without write permission", func(t *testing.T) {
+		readOnlyID := uuid.New()
+		mockDock.On("Authorize", mock.Anything, docks.DockById{IdUser: 1, IdDock: readOnlyID}, docks.PermWrite).
+			Return(storage.Forbidden)
+		req := httptest.NewRequest(http.MethodPatch, "/api/docs/"+readOnlyID.String(), bytes.NewReader([]byte(`{}`)))
+		req.Header.Set("Content-Type", docks.MergePatch)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(readOnlyID.String())
+		withUser(c, 1)
+
+		err := handler.PatchDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("maps invalid patch to 400", func(t *testing.T) {
+		body := `[{"op": "remove", "path": "/missing"}]`
+		patch := docks.DockPatch{Type: docks.JsonPatch, Body: []byte(body)}
+		mockDock.On("PatchDockLogic", mock.Anything, docks.DockById{IdUser: 1, IdDock: docID}, patch).
+			Return(json.RawMessage(nil), storage.InvalidPatch)
+		c, rec := newContext(docks.JsonPatch, body)
+
+		err := handler.PatchDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestPublicDocHandler(t *testing.T) {
+	e := echo.New()
+
+	mockDock := new(MockDockService)
+	handler := &api.DockHandler{
+		DockLogic: mockDock,
+		Cache:     cache.NewMemoryCache(time.Minute),
+	}
+
+	newContext := func(id uuid.UUID) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/api/public/docs/"+id.String(), nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(id.String())
+		return c, rec
+	}
+
+	t.Run("serves public document anonymously", func(t *testing.T) {
+		publicID := uuid.New()
+		anon := docks.DockById{IdDock: publicID}
+		mockDock.On("Authorize", mock.Anything, anon, docks.PermRead).Return(nil)
+		mockDock.On("GetDockByIdLogic", mock.Anything, anon).
+			Return(storage.DocumentWithGrants{ID: publicID, Public: true, Json: json.RawMessage(`{"a": 1}`)}, nil)
+		c, rec := newContext(publicID)
+
+		err := handler.PublicDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"data": {"data": {"a": 1}}}`, rec.Body.String())
+	})
+
+	t.Run("hides private document", func(t *testing.T) {
+		privateID := uuid.New()
+		mockDock.On("Authorize", mock.Anything, docks.DockById{IdDock: privateID}, docks.PermRead).
+			Return(storage.Invaliddata)
+		c, rec := newContext(privateID)
+
+		err := handler.PublicDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+// TestDockHandler_CacheRechecksAccess запись в кеше не заменяет проверку доступа
+func TestDockHandler_CacheRechecksAccess(t *testing.T) {
+	e := echo.New()
+	mockDock := new(MockDockService)
+	mockCache := cache.NewMemoryCache(time.Minute)
+	handler := &api.DockHandler{DockLogic: mockDock, Cache: mockCache}
+	dockId := uuid.New()
+	require.NoError(t, mockCache.SetJSON(fmt.Sprintf(cache.Key, dockId.String(), 5), json.RawMessage(`{"secret": 1}`)))
+	mockDock.On("Authorize", mock.Anything, docks.DockById{IdUser: 5, IdDock: dockId}, docks.PermRead).Return(storage.Forbidden)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/docs/"+dockId.String(), nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(dockId.String())
+	withUser(c, 5)
+
+	err := handler.GetDocHandler(c)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+}
+
+func TestAddNewLogic_Tx(t *testing.T) {
+	ctx := context.Background()
+	upload := docks.UploadRequest{
+		Meta: docks.DocMeta{Name: "doc", Mime: "application/json", Grant: []string{"nobody"}, OwnerId: 1},
+		Json: json.RawMessage(`{"a": 1}`),
+	}
+
+	t.Run("passes unknown user through", func(t *testing.T) {
+		mockDock := new(MockDockService)
+		service := &docks.ServiceDocks{DockModel: mockDock}
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("NewDocs", mock.Anything, mock.Anything).Return(true, nil)
+		mockDock.On("AddVersion", mock.Anything, mock.Anything, 1, pkg.HashContent(upload.Json)).Return(1, nil)
+		mockDock.On("AddGrant", mock.Anything, []string{"nobody"}, "viewer", mock.Anything).
+			Return(false, fmt.Errorf("%w: nobody", storage.UnknownUser))
+
+		err := service.AddNewLogic(ctx, upload)
+
+		assert.ErrorIs(t, err, storage.UnknownUser)
+		mockDock.AssertExpectations(t)
+	})
+
+	t.Run("keeps storage error", func(t *testing.T) {
+		mockDock := new(MockDockService)
+		service := &docks.ServiceDocks{DockModel: mockDock}
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("NewDocs", mock.Anything, mock.Anything).Return(false, storage.SomeWrong)
+
+		err := service.AddNewLogic(ctx, upload)
+
+		assert.ErrorIs(t, err, storage.SomeWrong)
+		mockDock.AssertNotCalled(t, "AddGrant", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+// pngUpload файл с png сигнатурой, как его отдает multipart форма
+func pngUpload(t *testing.T) *multipart.FileHeader {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fw, err := w.CreateFormFile("file", "a.png")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("\x89PNG\r\n\x1a\nbody"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+func TestAddNewLogic_FileCleanup(t *testing.T) {
+	ctx := context.Background()
+	store, err := blob.NewLocalStore(t.TempDir())
+	require.NoError(t, err)
+	mockDock := new(MockDockService)
+	service := &docks.ServiceDocks{DockModel: mockDock, Blob: store}
+	mockDock.On("WithTx", mock.Anything).Return(storage.SomeWrong)
+
+	err = service.AddNewLogic(ctx, docks.UploadRequest{
+		Meta: docks.DocMeta{Name: "doc", Mime: "image/png", OwnerId: 1},
+		File: pngUpload(t),
+	})
+
+	assert.ErrorIs(t, err, storage.SomeWrong)
+	files, err := store.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestReplaceDockLogic(t *testing.T) {
+	ctx := context.Background()
+	newService := func(t *testing.T) (*docks.ServiceDocks, *MockDockService, *blob.LocalStore) {
+		store, err := blob.NewLocalStore(t.TempDir())
+		require.NoError(t, err)
+		mockDock := new(MockDockService)
+		return &docks.ServiceDocks{DockModel: mockDock, Blob: store}, mockDock, store
+	}
+
+	t.Run("json keeps id and owner", func(t *testing.T) {
+		service, mockDock, _ := newService(t)
+		id := docks.DockById{IdUser: 2, IdDock: uuid.New()}
+		body := json.RawMessage(`{"b": 2}`)
+		want := storage.Dock{Id: id.IdDock, Name: "new", Mime: "application/json", Json: body, OwnerId: 1}
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("GetDockForUpdate", mock.Anything, id.IdDock).
+			Return(storage.Dock{Id: id.IdDock, IsFile: true, Filepath: "old.png", OwnerId: 1}, nil)
+		mockDock.On("UpdateDock", mock.Anything, want).Return(nil)
+		mockDock.On("AddVersion", mock.Anything, want, 2, pkg.HashContent(body)).Return(2, nil)
+
+		err := service.ReplaceDockLogic(ctx, id, docks.UploadRequest{
+			Meta: docks.DocMeta{Name: "new", Mime: "application/json"},
+			Json: body,
+		})
+
+		assert.NoError(t, err)
+		mockDock.AssertExpectations(t)
+	})
+
+	t.Run("file is stored and versioned", func(t *testing.T) {
+		service, mockDock, store := newService(t)
+		id := docks.DockById{IdUser: 1, IdDock: uuid.New()}
+		isFile := mock.MatchedBy(func(d storage.Dock) bool { return d.IsFile && d.Filepath != "" && d.Json == nil })
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("GetDockForUpdate", mock.Anything, id.IdDock).Return(storage.Dock{Id: id.IdDock, OwnerId: 1}, nil)
+		mockDock.On("UpdateDock", mock.Anything, isFile).Return(nil)
+		mockDock.On("AddVersion", mock.Anything, isFile, 1, mock.Anything).Return(2, nil)
+
+		err := service.ReplaceDockLogic(ctx, id, docks.UploadRequest{
+			Meta: docks.DocMeta{Name: "img", Mime: "image/png"},
+			File: pngUpload(t),
+		})
+
+		assert.NoError(t, err)
+		mockDock.AssertExpectations(t)
+		files, err := store.List(ctx, "")
+		require.NoError(t, err)
+		assert.Len(t, files, 1)
+	})
+
+	t.Run("new file removed when tx fails", func(t *testing.T) {
+		service, mockDock, store := newService(t)
+		id := docks.DockById{IdUser: 1, IdDock: uuid.New()}
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("GetDockForUpdate", mock.Anything, id.IdDock).Return(storage.Dock{}, storage.Invaliddata)
+
+		err := service.ReplaceDockLogic(ctx, id, docks.UploadRequest{
+			Meta: docks.DocMeta{Name: "img", Mime: "image/png"},
+			File: pngUpload(t),
+		})
+
+		assert.ErrorIs(t, err, storage.Invaliddata)
+		files, err := store.List(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("editor cannot make document public", func(t *testing.T) {
+		service, mockDock, _ := newService(t)
+		id := docks.DockById{IdUser: 2, IdDock: uuid.New()}
+		mockDock.On("WithTx", mock.Anything).Return(nil)
+		mockDock.On("GetDockForUpdate", mock.Anything, id.IdDock).Return(storage.Dock{Id: id.IdDock, OwnerId: 1}, nil)
+		mockDock.On("GetDockRole", mock.Anything, 2, id.IdDock).Return(string(docks.RoleEditor), nil)
+
+		err := service.ReplaceDockLogic(ctx, id, docks.UploadRequest{
+			Meta: docks.DocMeta{Name: "new", Mime: "application/json", Public: true},
+			Json: json.RawMessage(`{"b": 2}`),
+		})
+
+		assert.ErrorIs(t, err, storage.Forbidden)
+		mockDock.AssertNotCalled(t, "UpdateDock", mock.Anything, mock.Anything)
+	})
+
+	t.Run("requires file or json", func(t *testing.T) {
+		service, mockDock, _ := newService(t)
+
+		err := service.ReplaceDockLogic(ctx, docks.DockById{IdUser: 1, IdDock: uuid.New()}, docks.UploadRequest{})
+
+		assert.ErrorIs(t, err, storage.Invaliddata)
+		mockDock.AssertNotCalled(t, "WithTx", mock.Anything)
+	})
+}
+
+func TestDockHandler_Replace(t *testing.T) {
+	e := echo.New()
+	mockDock := new(MockDockService)
+	mockCache := cache.NewMemoryCache(time.Minute)
+	handler := &api.DockHandler{DockLogic: mockDock, Cache: mockCache}
+
+	newRequest := func(dockId uuid.UUID, user int, withFile bool) (echo.Context, *httptest.ResponseRecorder) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		require.NoError(t, w.WriteField("meta", `{"name":"new","mime":"application/json"}`))
+		if withFile {
+			fw, err := w.CreateFormFile("file", "a.png")
+			require.NoError(t, err)
+			_, err = fw.Write([]byte("\x89PNG\r\n\x1a\nbody"))
+			require.NoError(t, err)
+		} else {
+			require.NoError(t, w.WriteField("json", `{"b":2}`))
+		}
+		require.NoError(t, w.Close())
+		req := httptest.NewRequest(http.MethodPut, "/api/docs/"+dockId.String(), &body)
+		req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(dockId.String())
+		withUser(c, user)
+		return c, rec
+	}
+
+	t.Run("editor replaces with file", func(t *testing.T) {
+		dockId := uuid.New()
+		id := docks.DockById{IdUser: 2, IdDock: dockId}
+		cacheKey := fmt.Sprintf(cache.Key, dockId.String(), 3)
+		require.NoError(t, mockCache.SetJSON(cacheKey, map[string]int{"a": 1}))
+		mockDock.On("Authorize", mock.Anything, id, docks.PermWrite).Return(nil)
+		mockDock.On("ReplaceDockLogic", mock.Anything, id, mock.MatchedBy(func(data docks.UploadRequest) bool {
+			return data.File != nil && data.File.Filename == "a.png" && data.Json == nil
+		})).Return(nil)
+		c, rec := newRequest(dockId, 2, true)
+
+		err := handler.ReplaceDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var cached json.RawMessage
+		found, _ := mockCache.GetJSON(cacheKey, &cached)
+		assert.False(t, found, "cache of all users must be dropped")
+	})
+
+	t.Run("editor replaces with json", func(t *testing.T) {
+		dockId := uuid.New()
+		id := docks.DockById{IdUser: 2, IdDock: dockId}
+		mockDock.On("Authorize", mock.Anything, id, docks.PermWrite).Return(nil)
+		mockDock.On("ReplaceDockLogic", mock.Anything, id, mock.MatchedBy(func(data docks.UploadRequest) bool {
+			return data.File == nil && string(data.Json) == `{"b":2}` && data.Meta.Name == "new"
+		})).Return(nil)
+		c, rec := newRequest(dockId, 2, false)
+
+		err := handler.ReplaceDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("viewer gets 403", func(t *testing.T) {
+		dockId := uuid.New()
+		id := docks.DockById{IdUser: 4, IdDock: dockId}
+		mockDock.On("Authorize", mock.Anything, id, docks.PermWrite).Return(storage.Forbidden)
+		c, rec := newRequest(dockId, 4, false)
+
+		err := handler.ReplaceDocHandler(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		mockDock.AssertNotCalled(t, "ReplaceDockLogic", mock.Anything, id, mock.Anything)
+	})
+	mockDock.AssertExpectations(t)
+}
+
 // Тест на структуру ответа
 func TestAPIResponseStructure(t *testing.T) {
 	e := echo.New()
@@ -228,7 +772,7 @@ func TestAuthMiddleware(t *testing.T) {
 	e := echo.New()
 
 	mockValidator := new(MockTokenValidator)
-	middleware := api.AuthTokenRequired(mockValidator)
+	middleware := api.AuthTokenRequired(mockValidator, nil)
 
 	t.Run("Middleware rejects request without token", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
@@ -246,6 +790,131 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 }
 
+// withUser кладёт пользователя в контекст запроса, как это делает AuthTokenRequired
+func withUser(c echo.Context, id int) {
+	c.SetRequest(c.Request().WithContext(auth.WithIdentity(c.Request().Context(), auth.Identity{UserId: id})))
+}
+
+// Mock для UserGetter
+type MockUserGetter struct {
+	mock.Mock
+}
+
+func (m *MockUserGetter) GetUser(ctx context.Context, idUser int) (storage.User, error) {
+	args := m.Called(ctx, idUser)
+	return args.Get(0).(storage.User), args.Error(1)
+}
+
+func TestAdminRequired(t *testing.T) {
+	e := echo.New()
+	users := new(MockUserGetter)
+	users.On("GetUser", mock.Anything, 1).Return(storage.User{Id: 1, Role: storage.RoleAdmin}, nil)
+	users.On("GetUser", mock.Anything, 2).Return(storage.User{Id: 2, Role: storage.RoleUser}, nil)
+	users.On("GetUser", mock.Anything, 3).Return(storage.User{Id: 3, Role: storage.RoleAdmin, Disabled: true}, nil)
+	middleware := api.AdminRequired(users)
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, "success")
+	}
+
+	cases := []struct {
+		name string
+		user int
+		code int
+	}{
+		{"no user", 0, http.StatusUnauthorized},
+		{"regular user", 2, http.StatusForbidden},
+		{"disabled admin", 3, http.StatusForbidden},
+		{"admin", 1, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			if tc.user != 0 {
+				withUser(c, tc.user)
+			}
+
+			err := middleware(handler)(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.code, rec.Code)
+		})
+	}
+}
+
+// Mock для APIKeyValidator
+type MockAPIKeyValidator struct {
+	mock.Mock
+}
+
+func (m *MockAPIKeyValidator) ValidateAPIKey(ctx context.Context, key string) (auth.Identity, error) {
+	args := m.Called(ctx, key)
+	return args.Get(0).(auth.Identity), args.Error(1)
+}
+
+func TestAuthMiddleware_APIKey(t *testing.T) {
+	e := echo.New()
+	tokens := new(MockTokenValidator)
+	keys := new(MockAPIKeyValidator)
+	readKey := auth.Identity{UserId: 4, Token: "dk_read", APIKey: 9, Scopes: []string{auth.ScopeDocsRead}}
+	keys.On("ValidateAPIKey", mock.Anything, "dk_read").Return(readKey, nil)
+	keys.On("ValidateAPIKey", mock.Anything, "dk_revoked").Return(auth.Identity{}, storage.Invalidtoken)
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, "success")
+	}
+
+	cases := []struct {
+		name       string
+		middleware echo.MiddlewareFunc
+		key        string
+		code       int
+	}{
+		{"key with scope", api.ScopeRequired(auth.ScopeDocsRead), "dk_read", http.StatusOK},
+		{"key without scope", api.ScopeRequired(auth.ScopeDocsWrite), "dk_read", http.StatusForbidden},
+		{"key on session route", api.SessionRequired(), "dk_read", http.StatusForbidden},
+		{"revoked key", api.ScopeRequired(auth.ScopeDocsRead), "dk_revoked", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+tc.key)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := api.AuthTokenRequired(tokens, keys)(tc.middleware(handler))(c)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.code, rec.Code)
+		})
+	}
+
+	t.Run("Keys rejected without key validator", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer dk_read")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		err := api.AuthTokenRequired(tokens, nil)(handler)(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		tokens.AssertNotCalled(t, "ValidateToken", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Session passes scope and session checks", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/keys", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		withUser(c, 4)
+
+		err := api.SessionRequired()(api.ScopeRequired(auth.ScopeGrantsManage)(handler))(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
+
 // Mock для TokenValidator
 type MockTokenValidator struct {
 	mock.Mock
@@ -259,7 +928,7 @@ func TestAuthMiddleware_Smoke(t *testing.T) {
 	e := echo.New()
 
 	mockValidator := new(MockTokenValidator)
-	middleware := api.AuthTokenRequired(mockValidator)
+	middleware := api.AuthTokenRequired(mockValidator, nil)
 
 	t.Run("Middleware rejects request without token", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
@@ -296,4 +965,62 @@ func TestAuthMiddleware_Smoke(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 		mockValidator.AssertExpectations(t)
 	})
+	t.Run("Middleware accepts bearer token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/docs", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer bearer_token")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		mockValidator.On("ValidateToken", mock.Anything, "bearer_token").Return(7, nil)
+
+		var got auth.Identity
+		handler := func(c echo.Context) error {
+			got, _ = auth.IdentityFrom(c.Request().Context())
+			return c.String(http.StatusOK, "success")
+		}
+
+		err := middleware(handler)(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, auth.Identity{UserId: 7, Token: "bearer_token"}, got)
+	})
+
+	t.Run("Middleware accepts session cookie", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/docs", nil)
+		req.AddCookie(&http.Cookie{Name: api.SessionCookie, Value: "cookie_token"})
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		mockValidator.On("ValidateToken", mock.Anything, "cookie_token").Return(3, nil)
+
+		handler := func(c echo.Context) error {
+			return c.String(http.StatusOK, "success")
+		}
+
+		err := middleware(handler)(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("Middleware leaves json body readable", func(t *testing.T) {
+		body := `{"token": "valid_token", "grant": ["bob"]}`
+		req := httptest.NewRequest(http.MethodPost, "/api/docs", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+
+		var got []byte
+		handler := func(c echo.Context) error {
+			got, _ = io.ReadAll(c.Request().Body)
+			return c.String(http.StatusOK, "success")
+		}
+
+		err := middleware(handler)(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body, string(got))
+	})
 }
@@ -0,0 +1,256 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"gomodlag/internal/auth"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/storage"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOIDC OIDC провайдер в процессе теста: discovery, JWKS и token endpoint с проверкой PKCE
+type fakeOIDC struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientId string
+	mu       sync.Mutex
+	codes    map[string]fakeCode
+}
+
+type fakeCode struct {
+	challenge string
+	nonce     string
+	subject   string
+	username  string
+}
+
+func newFakeOIDC(t *testing.T, clientId string) *fakeOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f := &fakeOIDC{key: key, clientId: clientId, codes: map[string]fakeCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                f.URL,
+			"authorization_endpoint":                f.URL + "/authorize",
+			"token_endpoint":                        f.URL + "/token",
+			"jwks_uri":                              f.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", f.token)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// authorize имитирует вход пользователя у провайдера: возвращает code и state для callback
+func (f *fakeOIDC) authorize(t *testing.T, authURL, subject, username string) (string, string) {
+	u, err := url.Parse(authURL)
+	require.NoError(t, err)
+	q := u.Query()
+	require.Equal(t, f.clientId, q.Get("client_id"))
+	require.Equal(t, "S256", q.Get("code_challenge_method"))
+	code := "code_" + subject + "_" + q.Get("state")[:8]
+	f.mu.Lock()
+	f.codes[code] = fakeCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: subject, username: username}
+	f.mu.Unlock()
+	return code, q.Get("state")
+}
+
+func (f *fakeOIDC) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	c, ok := f.codes[r.FormValue("code")]
+	delete(f.codes, r.FormValue("code"))
+	f.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                f.URL,
+		"sub":                c.subject,
+		"aud":                f.clientId,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"nonce":              c.nonce,
+		"preferred_username": c.username,
+	})
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(f.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+}
+
+// TestOIDCProvider обмен кода на проверенный ID токен
+func TestOIDCProvider(t *testing.T) {
+	ctx := context.Background()
+	idp := newFakeOIDC(t, "docs")
+	provider, err := auth.NewOIDCProvider(ctx, idp.URL, "docs", "secret", "http://localhost/api/auth/oidc/callback", false)
+	require.NoError(t, err)
+
+	t.Run("valid login", func(t *testing.T) {
+		code, _ := idp.authorize(t, provider.AuthURL("state_valid_1", "nonce_1", "verifier_verifier_verifier_verifier_verifier_1"), "sub-1", "oidcuser1")
+
+		claims, err := provider.Exchange(ctx, code, "verifier_verifier_verifier_verifier_verifier_1", "nonce_1")
+		require.NoError(t, err)
+		assert.Equal(t, auth.OIDCClaims{Issuer: idp.URL, Subject: "sub-1", Username: "oidcuser1"}, claims)
+	})
+
+	t.Run("wrong PKCE verifier", func(t *testing.T) {
+		code, _ := idp.authorize(t, provider.AuthURL("state_pkce_1", "nonce_2", "verifier_verifier_verifier_verifier_verifier_2"), "sub-2", "")
+
+		_, err := provider.Exchange(ctx, code, "verifier_verifier_verifier_verifier_other", "nonce_2")
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		code, _ := idp.authorize(t, provider.AuthURL("state_nonce_1", "nonce_3", "verifier_verifier_verifier_verifier_verifier_3"), "sub-3", "")
+
+		_, err := provider.Exchange(ctx, code, "verifier_verifier_verifier_verifier_verifier_3", "nonce_other")
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+
+	t.Run("token for another client", func(t *testing.T) {
+		other, err := auth.NewOIDCProvider(ctx, idp.URL, "other", "secret", "http://localhost/callback", false)
+		require.NoError(t, err)
+		code, _ := idp.authorize(t, provider.AuthURL("state_aud_1", "nonce_4", "verifier_verifier_verifier_verifier_verifier_4"), "sub-4", "")
+
+		_, err = other.Exchange(ctx, code, "verifier_verifier_verifier_verifier_verifier_4", "nonce_4")
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+}
+
+// TestOIDCLogin полный вход через провайдера с привязкой и созданием пользователей
+func TestOIDCLogin(t *testing.T) {
+	s := setupTestDB(t)
+	defer cleanupTestDB(t, s)
+	checkOIDCLogin(t, s)
+}
+
+func TestOIDCLogin_Memory(t *testing.T) {
+	checkOIDCLogin(t, storage.NewMemory())
+}
+
+func TestOIDCLogin_SQLite(t *testing.T) {
+	checkOIDCLogin(t, sqliteStore(t))
+}
+
+func checkOIDCLogin(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	idp := newFakeOIDC(t, "docs")
+	provider, err := auth.NewOIDCProvider(ctx, idp.URL, "docs", "secret", "http://localhost/api/auth/oidc/callback", false)
+	require.NoError(t, err)
+	service := &auth.ServiceDB{AuthRegDelModel: s, AdminModel: s, OIDCModel: s, Logger: *logger.SetupLogger(), AccessTokens: auth.DBTokens{TokenValidator: s}, OIDC: provider}
+	ttl := auth.TokenTTL{Access: time.Minute, Refresh: time.Hour}
+
+	callback := func(linkUserId int, subject, username string) (auth.Tokens, error) {
+		authURL, _, err := service.OIDCStartLogic(ctx, linkUserId)
+		require.NoError(t, err)
+		code, state := idp.authorize(t, authURL, subject, username)
+		return service.OIDCCallbackLogic(ctx, code, state, ttl, storage.SessionMeta{})
+	}
+	signIn := func(subject, username string) (auth.Tokens, error) {
+		return callback(0, subject, username)
+	}
+
+	// Без автосоздания входят только привязанные учетные записи
+	_, err = signIn("sub-new", "newcomer1")
+	assert.Equal(t, storage.Forbidden, err)
+
+	// совпадение preferred_username с логином не дает чужую сессию, даже с автосозданием
+	local, err := s.CreateUser(ctx, "localuser1", "hash", storage.RoleAdmin)
+	require.NoError(t, err)
+	for _, provision := range []bool{false, true} {
+		provider.Provision = provision
+		tokens, err := signIn("sub-local", "localuser1")
+		assert.Equal(t, storage.Forbidden, err)
+		assert.Empty(t, tokens.AccessToken)
+	}
+	provider.Provision = false
+	_, err = s.FindIdentity(ctx, idp.URL, "sub-local")
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	// привязка из сессии пользователя
+	tokens, err := callback(local.Id, "sub-local", "whatever1")
+	require.NoError(t, err)
+	userID, err := s.ValidateToken(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, local.Id, userID)
+
+	// Привязанная учетная запись входит по sub, даже если логин у провайдера поменялся
+	tokens, err = signIn("sub-local", "renamed1")
+	require.NoError(t, err)
+	userID, err = s.ValidateToken(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, local.Id, userID)
+
+	// чужую привязанную учетную запись к себе не перепривязать
+	other, err := s.CreateUser(ctx, "otheruser1", "hash", storage.RoleUser)
+	require.NoError(t, err)
+	_, err = callback(other.Id, "sub-local", "localuser1")
+	assert.Equal(t, storage.Forbidden, err)
+
+	provider.Provision = true
+	tokens, err = signIn("sub-new", "newcomer1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	_, _, err = s.GetCredentials(ctx, "newcomer1")
+	require.NoError(t, err)
+
+	// с включенной 2fa вместо сессии выдается токен второго шага
+	newcomerID, _, err := s.GetCredentials(ctx, "newcomer1")
+	require.NoError(t, err)
+	require.NoError(t, s.SaveTOTPSecret(ctx, newcomerID, "JBSWY3DPEHPK3PXP"))
+	require.NoError(t, s.ConfirmTOTP(ctx, newcomerID, 1, []string{"recovery_hash"}))
+	tokens, err = signIn("sub-new", "newcomer1")
+	require.NoError(t, err)
+	assert.Empty(t, tokens.AccessToken)
+	assert.Empty(t, tokens.RefreshToken)
+	assert.NotEmpty(t, tokens.Challenge)
+
+	// state одноразовый
+	authURL, _, err := service.OIDCStartLogic(ctx, 0)
+	require.NoError(t, err)
+	code, state := idp.authorize(t, authURL, "sub-local", "localuser1")
+	_, err = service.OIDCCallbackLogic(ctx, code, state, ttl, storage.SessionMeta{})
+	require.NoError(t, err)
+	_, err = service.OIDCCallbackLogic(ctx, code, state, ttl, storage.SessionMeta{})
+	assert.Equal(t, storage.Invalidtoken, err)
+
+	require.NoError(t, s.SetUserDisabled(ctx, "localuser1", true))
+	_, err = signIn("sub-local", "localuser1")
+	assert.Equal(t, storage.Forbidden, err)
+}
@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"gomodlag/pkg"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestPasswordHasher_Bcrypt проверка bcrypt хеша и пересчет при смене cost
+func TestPasswordHasher_Bcrypt(t *testing.T) {
+	h := pkg.PasswordHasher{BcryptCost: bcrypt.MinCost}
+	hash, err := h.Hash("Secret_pass1")
+	require.NoError(t, err)
+
+	ok, rehash := h.Verify(hash, "Secret_pass1")
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	ok, _ = h.Verify(hash, "wrong")
+	assert.False(t, ok)
+
+	// cost увеличили - хеш нужно пересчитать
+	ok, rehash = pkg.PasswordHasher{BcryptCost: bcrypt.MinCost + 1}.Verify(hash, "Secret_pass1")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+// TestPasswordHasher_Argon2id проверка argon2id хеша и переход с bcrypt
+func TestPasswordHasher_Argon2id(t *testing.T) {
+	h := pkg.PasswordHasher{Algorithm: pkg.Argon2id, ArgonMemory: 1024}
+	hash, err := h.Hash("Secret_pass1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=4$"))
+
+	ok, rehash := h.Verify(hash, "Secret_pass1")
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	ok, _ = h.Verify(hash, "wrong")
+	assert.False(t, ok)
+
+	// старый bcrypt хеш принимается и помечается на пересчет
+	bcryptHash := pkg.CreateHash("Secret_pass1")
+	ok, rehash = h.Verify(bcryptHash, "Secret_pass1")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	// и обратно: argon2id хеш при возврате на bcrypt
+	ok, rehash = pkg.PasswordHasher{}.Verify(hash, "Secret_pass1")
+	assert.True(t, ok)
+	assert.True(t, rehash)
+}
+
+func TestValidateLogin(t *testing.T) {
+	cases := map[string]bool{
+		"memadmin1":  true,
+		"user2024x":  true,
+		"short1":     false,
+		"nodigitsss": false,
+		"логин12345": false,
+		"user_12345": false,
+	}
+	for login, ok := range cases {
+		assert.Equal(t, ok, pkg.ValidateLogin(login), login)
+	}
+}
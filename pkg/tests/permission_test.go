@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"gomodlag/internal/docks"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRolePermissions матрица прав ролей
+func TestRolePermissions(t *testing.T) {
+	cases := []struct {
+		role  docks.Role
+		allow []docks.Permission
+		deny  []docks.Permission
+	}{
+		{docks.RoleOwner, []docks.Permission{docks.PermRead, docks.PermWrite, docks.PermManageGrants, docks.PermDelete}, nil},
+		{docks.RoleCoOwner, []docks.Permission{docks.PermRead, docks.PermWrite, docks.PermManageGrants, docks.PermDelete}, nil},
+		{docks.RoleEditor, []docks.Permission{docks.PermRead, docks.PermWrite}, []docks.Permission{docks.PermManageGrants, docks.PermDelete}},
+		{docks.RoleViewer, []docks.Permission{docks.PermRead}, []docks.Permission{docks.PermWrite, docks.PermManageGrants, docks.PermDelete}},
+		{docks.Role(""), nil, []docks.Permission{docks.PermRead}},
+	}
+	for _, tc := range cases {
+		for _, p := range tc.allow {
+			assert.True(t, tc.role.Can(p), "%s should have %d", tc.role, p)
+		}
+		for _, p := range tc.deny {
+			assert.False(t, tc.role.Can(p), "%s should not have %d", tc.role, p)
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	role, ok := docks.ParseRole("")
+	assert.True(t, ok)
+	assert.Equal(t, docks.RoleViewer, role)
+
+	role, ok = docks.ParseRole("editor")
+	assert.True(t, ok)
+	assert.Equal(t, docks.RoleEditor, role)
+
+	_, ok = docks.ParseRole("owner")
+	assert.False(t, ok)
+}
@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gomodlag/internal/logger"
+	"gomodlag/internal/storage"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sqliteStore SQLite в файле во временном каталоге со всеми миграциями
+func sqliteStore(t *testing.T) *storage.SQLite {
+	s, err := storage.OpenSQLite(filepath.Join(t.TempDir(), "test.db"), *logger.SetupLogger())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.DB.Close() })
+	_, err = s.MigrateUp(context.Background(), *logger.SetupLogger())
+	require.NoError(t, err)
+	return s
+}
+
+func TestSQLite_Migrations(t *testing.T) {
+	ctx := context.Background()
+	logg := *logger.SetupLogger()
+	store, closeStore, err := storage.Open("sqlite://"+filepath.Join(t.TempDir(), "test.db"), logg)
+	require.NoError(t, err)
+	defer closeStore()
+	s := store.(*storage.SQLite)
+
+	all, err := storage.SQLiteMigrations()
+	require.NoError(t, err)
+	pg, err := storage.Migrations()
+	require.NoError(t, err)
+	require.Len(t, all, len(pg))
+	for i := range pg {
+		assert.Equal(t, pg[i].Version, all[i].Version)
+		assert.Equal(t, pg[i].Name, all[i].Name)
+	}
+
+	n, err := s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+	assert.Equal(t, len(all), n)
+	n, err = s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// все down миграции откатываются, и схема собирается заново
+	n, err = s.MigrateDown(ctx, len(all), logg)
+	require.NoError(t, err)
+	assert.Equal(t, len(all), n)
+	states, err := s.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, st := range states {
+		assert.Nil(t, st.AppliedAt)
+	}
+	n, err = s.MigrateUp(ctx, logg)
+	require.NoError(t, err)
+	assert.Equal(t, len(all), n)
+	states, err = s.MigrationStatus(ctx)
+	require.NoError(t, err)
+	for _, st := range states {
+		assert.NotNil(t, st.AppliedAt)
+	}
+}
+
+func TestSQLite_Docks(t *testing.T) {
+	s := sqliteStore(t)
+	ctx := context.Background()
+	ids := map[string]int{}
+	for _, name := range []string{"sqlowner1", "sqlzed01", "sqlamy01", "sqlstranger1"} {
+		_, err := s.Register(ctx, "hash", name)
+		require.NoError(t, err)
+		ids[name], _, err = s.GetCredentials(ctx, name)
+		require.NoError(t, err)
+	}
+	_, err := s.Register(ctx, "hash", "sqlowner1")
+	assert.Error(t, err)
+
+	// неизвестный пользователь в гранте: транзакция откатывается целиком
+	dock := storage.Dock{Id: uuid.New(), Name: "shared", Mime: "application/json", Json: json.RawMessage(`{"a":1}`), OwnerId: ids["sqlowner1"]}
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddGrant(ctx, []string{"nosuchuser1"}, "viewer", dock.Id)
+		return err
+	})
+	assert.ErrorIs(t, err, storage.UnknownUser)
+	_, err = s.GetDockById(ctx, dock.Id)
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	var v int
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddGrant(ctx, []string{"sqlzed01", "sqlamy01"}, "viewer", dock.Id)
+		require.NoError(t, err)
+		// повторный грант меняет роль
+		_, err = tx.AddGrant(ctx, []string{"sqlzed01"}, "editor", dock.Id)
+		require.NoError(t, err)
+		v, err = tx.AddVersion(ctx, dock, ids["sqlowner1"], "h1")
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	doc, err := s.GetDockById(ctx, dock.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sqlamy01", "sqlzed01"}, doc.GrantedUsers)
+	assert.JSONEq(t, `{"a":1}`, string(doc.Json))
+	assert.WithinDuration(t, time.Now(), doc.CreatedAt, time.Minute)
+
+	for name, want := range map[string]string{"sqlowner1": "owner", "sqlzed01": "editor", "sqlamy01": "viewer"} {
+		role, err := s.GetDockRole(ctx, ids[name], dock.Id)
+		require.NoError(t, err)
+		assert.Equal(t, want, role)
+	}
+	_, err = s.GetDockRole(ctx, ids["sqlstranger1"], dock.Id)
+	assert.ErrorIs(t, err, storage.Invaliddata)
+
+	// чужие документы владельца видны только по гранту; фильтр по bool приводится к типу колонки
+	docs, err := s.GetDock(ctx, storage.GetDock{Id: ids["sqlzed01"], Login: "sqlowner1", Key: "public", Value: "false", Limit: 50})
+	require.NoError(t, err)
+	require.Len(t, docs, 1)
+	assert.Equal(t, []string{"sqlamy01", "sqlzed01"}, docs[0].GrantedUsers)
+	docs, err = s.GetDock(ctx, storage.GetDock{Id: ids["sqlstranger1"], Login: "sqlowner1", Key: "name", Value: "shared", Limit: 50})
+	require.NoError(t, err)
+	assert.Empty(t, docs)
+	_, err = s.GetDock(ctx, storage.GetDock{Id: ids["sqlowner1"], Key: "owner_id", Value: "1"})
+	assert.Error(t, err)
+
+	// правка и вторая версия
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		current, err := tx.GetDockForUpdate(ctx, dock.Id)
+		require.NoError(t, err)
+		current.Json = json.RawMessage(`{"a":2}`)
+		require.NoError(t, tx.UpdateDock(ctx, current))
+		v, err = tx.AddVersion(ctx, current, ids["sqlzed01"], "h2")
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, v)
+	versions, err := s.ListVersions(ctx, dock.Id)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "sqlzed01", versions[1].Author)
+	first, err := s.GetVersion(ctx, dock.Id, 1)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a":1}`, string(first.Json))
+
+	revoked, err := s.RevokeGrant(ctx, dock.Id, "sqlzed01")
+	require.NoError(t, err)
+	assert.Equal(t, ids["sqlzed01"], revoked)
+	_, err = s.RevokeGrant(ctx, dock.Id, "sqlzed01")
+	assert.ErrorIs(t, err, storage.Invaliddata)
+	grants, err := s.ListGrants(ctx, dock.Id)
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	assert.Equal(t, "sqlamy01", grants[0].Login)
+}
+
+func TestSQLite_Sessions(t *testing.T) {
+	s := sqliteStore(t)
+	ctx := context.Background()
+	_, err := s.Register(ctx, "hash", "sqlsession1")
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, "sqlsession1")
+	require.NoError(t, err)
+
+	require.NoError(t, s.CreateSession(ctx, userID, testToken("access1", time.Hour), testToken("refresh1", 24*time.Hour), storage.SessionMeta{UserAgent: "test"}))
+	got, err := s.ValidateToken(ctx, "access1")
+	require.NoError(t, err)
+	assert.Equal(t, userID, got)
+
+	_, err = s.RotateRefreshToken(ctx, "refresh1", testToken("access2", time.Hour), testToken("refresh2", 24*time.Hour))
+	require.NoError(t, err)
+	_, err = s.ValidateToken(ctx, "access1")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+
+	// повторное использование refresh токена завершает сессию
+	_, err = s.RotateRefreshToken(ctx, "refresh1", testToken("access3", time.Hour), testToken("refresh3", 24*time.Hour))
+	assert.ErrorIs(t, err, storage.TokenReused)
+	_, err = s.ValidateToken(ctx, "access2")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	revoked, err := s.ListRevoked(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, revoked, "access2")
+
+	failures, err := s.AddLoginFailure(ctx, "user:sqlsession1", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, failures)
+	require.NoError(t, s.LockLogin(ctx, "user:sqlsession1", time.Now().Add(time.Minute)))
+	locks, err := s.GetLoginLocks(ctx, "user:sqlsession1", "ip:127.0.0.1")
+	require.NoError(t, err)
+	assert.Len(t, locks, 1)
+
+	require.NoError(t, s.CreateSession(ctx, userID, testToken("access4", -time.Minute), testToken("refresh4", -time.Second), storage.SessionMeta{}))
+	_, err = s.ValidateToken(ctx, "access4")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	n, err := s.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestSQLite_DeleteUser(t *testing.T) {
+	s := sqliteStore(t)
+	ctx := context.Background()
+	_, err := s.Register(ctx, "hash", "sqlleaver1")
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, "sqlleaver1")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateSession(ctx, userID, testToken("access1", time.Hour), testToken("refresh1", time.Hour), storage.SessionMeta{}))
+
+	dock := storage.Dock{Id: uuid.New(), Name: "report", IsFile: true, Filepath: "ab/report", OwnerId: userID}
+	err = s.WithTx(ctx, func(tx storage.DockTx) error {
+		_, err := tx.NewDocs(ctx, dock)
+		require.NoError(t, err)
+		_, err = tx.AddVersion(ctx, dock, userID, "h1")
+		return err
+	})
+	require.NoError(t, err)
+
+	deleted, err := s.DeleteUser(ctx, "sqlleaver1")
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{dock.Id}, deleted.Documents)
+	assert.Equal(t, []string{"ab/report"}, deleted.Files)
+	_, err = s.ValidateToken(ctx, "access1")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	_, err = s.GetUser(ctx, userID)
+	assert.ErrorIs(t, err, storage.UnknownUser)
+	_, err = s.DeleteUser(ctx, "sqlleaver1")
+	assert.ErrorIs(t, err, storage.UnknownUser)
+
+	keys, err := s.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ab/report"}, keys)
+	require.NoError(t, s.BlobDeleted(ctx, "ab/report"))
+	keys, err = s.PendingBlobDeletions(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestSQLite_APIKeys(t *testing.T) {
+	s := sqliteStore(t)
+	ctx := context.Background()
+	_, err := s.Register(ctx, "hash", "sqlkeys01")
+	require.NoError(t, err)
+	userID, _, err := s.GetCredentials(ctx, "sqlkeys01")
+	require.NoError(t, err)
+
+	key, err := s.CreateAPIKey(ctx, userID, "keyhash", storage.APIKey{Name: "ci", Prefix: "gmk_abc", Scopes: []string{"docs:read"}, CreatedAt: time.Now()})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs:read"}, key.Scopes)
+	assert.Nil(t, key.ExpireAt)
+
+	used, err := s.UseAPIKey(ctx, "keyhash")
+	require.NoError(t, err)
+	assert.Equal(t, key.Id, used.Id)
+	require.NotNil(t, used.LastUsedAt)
+
+	require.NoError(t, s.SetUserDisabled(ctx, "sqlkeys01", true))
+	_, err = s.UseAPIKey(ctx, "keyhash")
+	assert.ErrorIs(t, err, storage.Invalidtoken)
+	require.NoError(t, s.DeleteAPIKey(ctx, userID, key.Id))
+	assert.ErrorIs(t, s.DeleteAPIKey(ctx, userID, key.Id), storage.Invaliddata)
+}
+
+func TestSQLite_Concurrent(t *testing.T) {
+	s := sqliteStore(t)
+	ctx := context.Background()
+	// писатель в SQLite один: остальные ждут busy_timeout, ни одна запись не теряется
+	const n = 20
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = s.AddLoginFailure(ctx, "user:sqlrace1", time.Hour)
+			_, _ = s.Register(ctx, "hash", fmt.Sprintf("sqlrace%03d", i))
+		}()
+	}
+	wg.Wait()
+	failures, err := s.AddLoginFailure(ctx, "user:sqlrace1", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, n+1, failures)
+	users, err := s.ListUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, n)
+}
+
+func TestSQLite_HTTP(t *testing.T) {
+	s := sqliteStore(t)
+	checkHTTPFlow(t, storeServer(t, s), s)
+}
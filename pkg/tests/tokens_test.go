@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"gomodlag/internal/auth"
+	"gomodlag/internal/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRevocations список отозванных токенов без базы
+type fakeRevocations []string
+
+func (f *fakeRevocations) ListRevoked(ctx context.Context) ([]string, error) {
+	return *f, nil
+}
+
+func testKey(b byte, n int) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), n)))
+}
+
+// TestJWTTokens выпуск и локальная проверка подписанных токенов
+func TestJWTTokens(t *testing.T) {
+	ctx := context.Background()
+	revoked := &fakeRevocations{}
+	keys := "old:hs256:" + testKey('a', 32) + ",new:ed25519:" + testKey('b', 32)
+
+	oldTokens, err := auth.NewJWTTokens(keys, "old", revoked)
+	require.NoError(t, err)
+	newTokens, err := auth.NewJWTTokens(keys, "new", revoked)
+	require.NoError(t, err)
+
+	t.Run("validates own token", func(t *testing.T) {
+		token, err := newTokens.Issue(42, "session_1", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		userID, err := newTokens.ValidateToken(ctx, token)
+		require.NoError(t, err)
+		assert.Equal(t, 42, userID)
+
+		sessionToken, err := newTokens.SessionToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, "session_1", sessionToken)
+	})
+
+	t.Run("accepts tokens signed by previous key", func(t *testing.T) {
+		token, err := oldTokens.Issue(7, "session_2", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		userID, err := newTokens.ValidateToken(ctx, token)
+		require.NoError(t, err)
+		assert.Equal(t, 7, userID)
+	})
+
+	t.Run("rejects unknown key", func(t *testing.T) {
+		other, err := auth.NewJWTTokens("old:hs256:"+testKey('c', 32), "", revoked)
+		require.NoError(t, err)
+		token, err := other.Issue(7, "session_3", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		_, err = newTokens.ValidateToken(ctx, token)
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+
+	t.Run("rejects expired token", func(t *testing.T) {
+		token, err := newTokens.Issue(7, "session_4", time.Now().Add(-time.Minute))
+		require.NoError(t, err)
+
+		_, err = newTokens.ValidateToken(ctx, token)
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+
+	t.Run("rejects revoked token after sync", func(t *testing.T) {
+		token, err := newTokens.Issue(7, "session_5", time.Now().Add(time.Minute))
+		require.NoError(t, err)
+
+		*revoked = append(*revoked, "session_5")
+		require.NoError(t, newTokens.SyncRevoked(ctx))
+
+		_, err = newTokens.ValidateToken(ctx, token)
+		assert.Equal(t, storage.Invalidtoken, err)
+	})
+}
+
+// TestJWTTokens_DisabledUser блокировка и удаление пользователя отзывают его JWT после синхронизации
+func TestJWTTokens_DisabledUser(t *testing.T) {
+	ctx := context.Background()
+	m := storage.NewMemory()
+	tokens, err := auth.NewJWTTokens("k:hs256:"+testKey('a', 32), "", m)
+	require.NoError(t, err)
+
+	for name, revoke := range map[string]func(login string) error{
+		"disable": func(login string) error { return m.SetUserDisabled(ctx, login, true) },
+		"delete": func(login string) error {
+			_, err := m.DeleteUser(ctx, login)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			login := "jwt" + name + "1"
+			user, err := m.CreateUser(ctx, login, "hash", storage.RoleUser)
+			require.NoError(t, err)
+			session := "session_" + name
+			require.NoError(t, m.CreateSession(ctx, user.Id, testToken(session, time.Hour),
+				testToken("refresh_"+name, 24*time.Hour), storage.SessionMeta{}))
+			token, err := tokens.Issue(user.Id, session, time.Now().Add(time.Hour))
+			require.NoError(t, err)
+			_, err = tokens.ValidateToken(ctx, token)
+			require.NoError(t, err)
+
+			require.NoError(t, revoke(login))
+			require.NoError(t, tokens.SyncRevoked(ctx))
+			_, err = tokens.ValidateToken(ctx, token)
+			assert.Equal(t, storage.Invalidtoken, err)
+		})
+	}
+}
+
+func TestNewJWTTokens_InvalidKeys(t *testing.T) {
+	_, err := auth.NewJWTTokens("k:hs256:"+testKey('a', 8), "", nil)
+	assert.Error(t, err)
+	_, err = auth.NewJWTTokens("k:rs256:"+testKey('a', 32), "", nil)
+	assert.Error(t, err)
+	_, err = auth.NewJWTTokens("k:hs256:"+testKey('a', 32), "missing", nil)
+	assert.Error(t, err)
+}
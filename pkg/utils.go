@@ -1,36 +1,48 @@
 package pkg
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
-	"gomodlag/internal/storage"
+	"gomodlag/internal/blob"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path/filepath"
 	"unicode"
 )
 
 func Validator(login string, password string) bool {
-	if len([]rune(login)) < 8 || len([]rune(password)) < 8 {
+	return ValidateLogin(login) && ValidatePassword(password)
+}
+
+// ValidateLogin требования к логину: от 8 символов, только латиница и цифры, хотя бы одна цифра
+func ValidateLogin(login string) bool {
+	if len([]rune(login)) < 8 {
 		return false
 	}
 	var hasDigitInLogin bool
 	onlyLatin := true
 	for _, v := range login {
-		if unicode.IsNumber(v) {
+		switch {
+		case v >= '0' && v <= '9':
 			hasDigitInLogin = true
-		}
-		if !unicode.Is(unicode.Latin, v) {
+		case !unicode.Is(unicode.Latin, v):
 			onlyLatin = false
 		}
 	}
-	if !hasDigitInLogin || !onlyLatin {
+	return hasDigitInLogin && onlyLatin
+}
+
+// ValidatePassword требования к паролю: от 8 символов, заглавные и строчные буквы, цифры и спецсимволы
+func ValidatePassword(password string) bool {
+	if len([]rune(password)) < 8 {
 		return false
 	}
-
 	var hasUpper, hasLower, hasDigit, hasSpecial bool
 	for _, v := range password {
 		switch {
@@ -52,20 +64,18 @@ func Validator(login string, password string) bool {
 }
 
 func CreateHash(password string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := PasswordHasher{}.Hash(password)
 	if err != nil {
 		return ""
 	}
-	return string(hash)
+	return hash
+}
+
+func CompareHash(hash string, password string) bool {
+	ok, _ := PasswordHasher{}.Verify(hash, password)
+	return ok
 }
 
-//	func CompareHash(hash string, password string) bool {
-//		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-//		if err != nil {
-//			return false
-//		}
-//		return true
-//	}
 func GenerateDockId() uuid.UUID {
 	return uuid.New()
 }
@@ -73,59 +83,54 @@ func GenerateToken() string {
 	return uuid.New().String()
 }
 
+// GenerateSecret случайная строка для долгоживущих секретов (refresh токены и т.п.)
+func GenerateSecret() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
 var allowedMIMEs = map[string]bool{
 	"image/jpeg": true,
 	"image/png":  true,
 	"video/mp4":  true,
 }
 
-func SaveFile(fileHeader *multipart.FileHeader, destDir string) (string, error) {
+// SaveFile сохраняет файл в хранилище и возвращает ключ и sha256 содержимого
+func SaveFile(ctx context.Context, fileHeader *multipart.FileHeader, store blob.BlobStore) (string, string, error) {
 	file, err := fileHeader.Open()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer file.Close()
 
 	buf := make([]byte, 512)
-	if _, err := file.Read(buf); err != nil {
-		return "", err
+	n, err := file.Read(buf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", "", err
 	}
 
-	mimeType := http.DetectContentType(buf)
+	mimeType := http.DetectContentType(buf[:n])
 	if !allowedMIMEs[mimeType] {
-		return "", errors.New("unsupported file type")
+		return "", "", errors.New("unsupported file type")
 	}
 
 	id := uuid.New().String()
 	ext := filepath.Ext(fileHeader.Filename)
-	filename := id + ext
-	destPath := filepath.Join(destDir, filename)
+	key := id + ext
 
-	out, err := os.Create(destPath)
-	if err != nil {
-		return "", err
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
 	}
-	defer out.Close()
-
-	if _, err := file.Seek(0, 0); err != nil {
-		return "", err
-	}
-	if _, err := io.Copy(out, file); err != nil {
-		return "", err
+	hash := sha256.New()
+	if err := store.Put(ctx, key, io.TeeReader(file, hash), fileHeader.Size, mimeType); err != nil {
+		return "", "", err
 	}
 
-	return filename, nil
+	return key, hex.EncodeToString(hash.Sum(nil)), nil
 }
-func GetFile(path string) ([]byte, error) {
-	FilePath, err := os.Open(path)
 
-	if err != nil {
-		return nil, storage.Internal // 500
-	}
-
-	contents, err := io.ReadAll(FilePath)
-	if err != nil {
-		return nil, storage.Internal /// 500
-	}
-	return contents, nil
+func HashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }